@@ -147,7 +147,10 @@ func TestCount(t *testing.T) {
 	})
 
 	Convey("works for user", t, func() {
-		c, fb := featureBreaker.FilterUser(memory.Use(context.Background()), nil)
+		c := memory.Use(context.Background())
+		user.GetTestable(c).AddOAuthToken("token", "someone@example.com", "client", false, "foo")
+		user.GetTestable(c).SetOAuthToken("token")
+		c, fb := featureBreaker.FilterUser(c, nil)
 		c, ctr := FilterUser(c)
 		So(c, ShouldNotBeNil)
 		So(ctr, ShouldNotBeNil)
@@ -0,0 +1,225 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"sync"
+	"time"
+
+	ds "github.com/luci/gae/service/datastore"
+	"github.com/luci/gae/service/info"
+	mc "github.com/luci/gae/service/memcache"
+
+	"github.com/luci/luci-go/common/clock"
+	"github.com/luci/luci-go/common/errors"
+	log "github.com/luci/luci-go/common/logging"
+
+	"golang.org/x/net/context"
+)
+
+// InvalidationKind is the datastore kind of the pending invalidations
+// recorded while memcache is bypassed. Entities of this kind are never cached.
+const InvalidationKind = "dscache.invalidation"
+
+// invalidation is a list of memcache keys which must be deleted once memcache
+// is reachable again. Invalidations are stored in the default namespace.
+type invalidation struct {
+	_kind string `gae:"$kind,dscache.invalidation"`
+	ID    int64  `gae:"$id"`
+
+	// Namespace is the namespace of the memcache keys.
+	Namespace string `gae:",noindex"`
+	// Keys are the memcache keys to delete.
+	Keys []string `gae:",noindex"`
+
+	Created time.Time
+}
+
+var (
+	breakerLock = sync.Mutex{}
+
+	// breakerFailures is the number of consecutive memcache failures.
+	breakerFailures = 0
+
+	// breakerOpen is true when memcache is bypassed.
+	breakerOpen = false
+
+	// breakerNextProbe is the time at which an open breaker attempts to replay
+	// the pending invalidations, and to close.
+	breakerNextProbe = time.Time{}
+
+	// breakerPending are the keys of the invalidations recorded by this
+	// instance while the breaker was open. They're replayed by key, since they
+	// may not be visible to queries yet.
+	breakerPending []*ds.Key
+)
+
+// memcacheFailed records a memcache failure. After CircuitBreakerThreshold
+// consecutive failures, the breaker opens.
+func (s *supportContext) memcacheFailed() {
+	if CircuitBreakerThreshold <= 0 {
+		return
+	}
+
+	breakerLock.Lock()
+	defer breakerLock.Unlock()
+
+	breakerFailures++
+	if !breakerOpen && breakerFailures >= CircuitBreakerThreshold {
+		log.Errorf(s.c, "dscache: %d consecutive memcache failures, bypassing memcache", breakerFailures)
+		breakerOpen = true
+		breakerNextProbe = clock.Now(s.c).Add(CircuitBreakerRetryInterval)
+	}
+}
+
+// memcacheSucceeded records a memcache success, which resets the number of
+// consecutive failures.
+func (s *supportContext) memcacheSucceeded() {
+	if CircuitBreakerThreshold <= 0 {
+		return
+	}
+
+	breakerLock.Lock()
+	defer breakerLock.Unlock()
+
+	if !breakerOpen {
+		breakerFailures = 0
+	}
+}
+
+// bypassMemcache returns true if the breaker is open, i.e. if memcache must not
+// be used.
+//
+// Once every CircuitBreakerRetryInterval, the caller of an open breaker
+// attempts to replay the pending invalidations. If it succeeds, and no
+// invalidation was recorded in the meantime, the breaker closes.
+func (s *supportContext) bypassMemcache() bool {
+	if CircuitBreakerThreshold <= 0 {
+		return false
+	}
+
+	now := clock.Now(s.c)
+
+	breakerLock.Lock()
+	if !breakerOpen || now.Before(breakerNextProbe) {
+		defer breakerLock.Unlock()
+		return breakerOpen
+	}
+	// Let the other callers bypass memcache while we probe it.
+	breakerNextProbe = now.Add(CircuitBreakerRetryInterval)
+	pending := breakerPending
+	breakerLock.Unlock()
+
+	for {
+		if err := replayInvalidations(s.c, pending); err != nil {
+			(log.Fields{log.ErrorKey: err}).Warningf(s.c, "dscache: memcache is still unavailable")
+			return true
+		}
+
+		breakerLock.Lock()
+		breakerPending = breakerPending[len(pending):]
+		if len(breakerPending) == 0 {
+			defer breakerLock.Unlock()
+			log.Infof(s.c, "dscache: memcache is available again")
+			breakerOpen = false
+			breakerFailures = 0
+			return false
+		}
+		// Invalidations were recorded during the replay. The breaker must stay
+		// open until they are replayed too.
+		pending = breakerPending
+		breakerLock.Unlock()
+	}
+}
+
+// recordInvalidation durably records that the memcache keys mcKeys (in the
+// namespace of the context) must be deleted once memcache is reachable again.
+//
+// It must be called before the mutation which makes the cached values stale.
+// If it fails, the mutation must not occur.
+func (s *supportContext) recordInvalidation(mcKeys []string) error {
+	if len(mcKeys) == 0 {
+		return nil
+	}
+
+	// always go to the default namespace
+	c, err := info.Namespace(s.c, "")
+	if err != nil {
+		return err
+	}
+	inv := &invalidation{
+		Namespace: info.GetNamespace(s.c),
+		Keys:      mcKeys,
+		Created:   clock.Now(s.c).UTC(),
+	}
+	if err := ds.Put(c, inv); err != nil {
+		(log.Fields{log.ErrorKey: err}).Errorf(
+			s.c, "dscache: HARD FAILURE: failed to record an invalidation")
+		return err
+	}
+
+	breakerLock.Lock()
+	defer breakerLock.Unlock()
+	breakerPending = append(breakerPending, ds.KeyForObj(c, inv))
+	return nil
+}
+
+// ReplayInvalidations deletes the memcache keys recorded by the instances
+// which bypassed memcache (see CircuitBreakerThreshold), and then the records
+// themselves.
+//
+// Instances replay the invalidations automatically once memcache is reachable
+// again. This may also be called periodically (e.g. from a cron job), to
+// replay the invalidations of instances which went away before memcache
+// recovered.
+func ReplayInvalidations(c context.Context) error {
+	return replayInvalidations(c, nil)
+}
+
+func replayInvalidations(c context.Context, pending []*ds.Key) error {
+	// always go to the default namespace
+	c, err := info.Namespace(c, "")
+	if err != nil {
+		return err
+	}
+
+	var found []*ds.Key
+	if err := ds.GetAll(c, ds.NewQuery(InvalidationKind).KeysOnly(true), &found); err != nil {
+		return err
+	}
+	seen := make(map[string]struct{}, len(pending)+len(found))
+	var keys []*ds.Key
+	for _, k := range append(pending, found...) {
+		id := k.String()
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range keys {
+		inv := &invalidation{ID: k.IntID()}
+		switch err := ds.Get(c, inv); err {
+		case nil:
+		case ds.ErrNoSuchEntity:
+			// Already replayed.
+			continue
+		default:
+			return err
+		}
+
+		nc, err := info.Namespace(c, inv.Namespace)
+		if err != nil {
+			return err
+		}
+		if err := errors.Filter(mc.Delete(nc, inv.Keys...), mc.ErrCacheMiss); err != nil {
+			return err
+		}
+		if err := ds.Delete(c, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	ds "github.com/luci/gae/service/datastore"
+	"github.com/luci/gae/service/datastore/serialize"
+
+	log "github.com/luci/luci-go/common/logging"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// NoCompressionCodec is the name of the codec which serializes entities
+	// with serialize.WritePropertyMap, without compressing them.
+	NoCompressionCodec = "none"
+
+	// DefaultCodec is the name of the codec used when no other codec is
+	// selected. It serializes entities with serialize.WritePropertyMap, and
+	// compresses them with zlib if they're larger than CompressionThreshold.
+	DefaultCodec = "zlib"
+)
+
+var dsCodecFunctionsKey = "holds []CodecFunction"
+
+// Codec serializes (and possibly compresses) the entities cached in memcache.
+//
+// Every Codec is identified by a CompressionType, which is the first byte of
+// the memcache values it encodes. Values are decoded by the Codec registered
+// for their first byte, regardless of the Codec selected for their key, so
+// entries written by older versions of the application remain readable.
+type Codec interface {
+	// Encode encodes an entity. pm has already been Saved (i.e. it contains no
+	// meta properties).
+	Encode(pm ds.PropertyMap) ([]byte, error)
+
+	// Decode decodes the data returned by Encode.
+	Decode(data []byte, kc ds.KeyContext) (ds.PropertyMap, error)
+}
+
+// Compressor compresses the serialized form of entities. See CompressorCodec.
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// CompressorCodec returns a Codec which serializes entities with
+// serialize.WritePropertyMap, like the default codec, and compresses them with
+// comp (e.g. snappy or zstd).
+func CompressorCodec(comp Compressor) Codec {
+	return compressorCodec{comp}
+}
+
+type compressorCodec struct {
+	comp Compressor
+}
+
+func (cc compressorCodec) Encode(pm ds.PropertyMap) ([]byte, error) {
+	buf := bytes.Buffer{}
+	// errs can't happen, since we're using a byte buffer.
+	_ = serialize.WritePropertyMap(&buf, serialize.WithoutContext, pm)
+	return cc.comp.Compress(buf.Bytes())
+}
+
+func (cc compressorCodec) Decode(data []byte, kc ds.KeyContext) (ds.PropertyMap, error) {
+	data, err := cc.comp.Decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	return serialize.ReadPropertyMap(bytes.NewBuffer(data), serialize.WithoutContext, kc)
+}
+
+type registeredCodec struct {
+	name  string
+	ctype CompressionType
+	codec Codec
+}
+
+var (
+	codecsLock   = sync.RWMutex{}
+	codecsByName = map[string]*registeredCodec{}
+	codecsByType = map[CompressionType]*registeredCodec{}
+)
+
+// RegisterCodec registers codec under name, identified in memcache values by
+// ctype. It's meant to be called from an init() function.
+//
+// NoCompression and ZlibCompression are reserved for the built-in codecs
+// ("none" and "zlib"). Registering a reserved or already registered name or
+// CompressionType will cause a panic.
+//
+// Since values are decoded by the codec registered for their CompressionType,
+// a codec must be registered in every version of the application which may
+// read them before it's selected (see CodecFunction and CacheCodecMeta) by any
+// version. This version of the package fails to decode the values of unknown
+// codecs, and fetches the entities from the datastore instead. Versions which
+// predate codecs, however, decode any value which isn't compressed with zlib as
+// an uncompressed one, so they may misparse the values of a custom codec
+// rather than miss the cache. A rollout must therefore not run such versions
+// alongside versions which select a custom codec.
+func RegisterCodec(name string, ctype CompressionType, codec Codec) {
+	if codec == nil {
+		panic("nil codec provided to RegisterCodec")
+	}
+	switch {
+	case name == NoCompressionCodec || name == DefaultCodec:
+		panic(fmt.Errorf("dscache: codec name %q is reserved", name))
+	case ctype == NoCompression || ctype == ZlibCompression:
+		panic(fmt.Errorf("dscache: %s is reserved", ctype))
+	}
+
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	if _, ok := codecsByName[name]; ok {
+		panic(fmt.Errorf("dscache: codec %q is already registered", name))
+	}
+	if cur, ok := codecsByType[ctype]; ok {
+		panic(fmt.Errorf("dscache: CompressionType(%d) is already registered by %q", ctype, cur.name))
+	}
+	rc := &registeredCodec{name, ctype, codec}
+	codecsByName[name] = rc
+	codecsByType[ctype] = rc
+}
+
+func codecByName(name string) *registeredCodec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	return codecsByName[name]
+}
+
+func codecByType(ctype CompressionType) *registeredCodec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	return codecsByType[ctype]
+}
+
+// CodecFunction is a user-controllable function which selects the codec of
+// the entity with a certain datastore key, by name. The provided key will
+// always be valid and complete. It should return ok=true if it recognized the
+// Key, and false otherwise.
+//
+// The CacheCodecMeta metadata of an entity, if set, takes precedence over
+// CodecFunctions.
+type CodecFunction func(*ds.Key) (codec string, ok bool)
+
+// AddCodecFunctions appends the provided functions to the internal list of
+// codec functions. They are evaluated in the same order as the functions
+// provided to AddShardFunctions.
+//
+// nil functions will cause a panic.
+func AddCodecFunctions(c context.Context, fns ...CodecFunction) context.Context {
+	cur, _ := c.Value(&dsCodecFunctionsKey).([]CodecFunction)
+	new := make([]CodecFunction, 0, len(cur)+len(fns))
+	for _, fn := range fns {
+		if fn == nil {
+			panic("nil function provided to AddCodecFunctions")
+		}
+	}
+	return context.WithValue(c, &dsCodecFunctionsKey, append(append(new, fns...), cur...))
+}
+
+// codecName returns the name of the codec selected for the entity with the
+// given key and metadata.
+func (s *supportContext) codecName(key *ds.Key, mg ds.MetaGetter) string {
+	if name := ds.GetMetaDefault(mg, CacheCodecMeta, "").(string); name != "" {
+		return name
+	}
+	ret := DefaultCodec
+	for _, fn := range s.codecFns {
+		if name, ok := fn(key); ok {
+			ret = name
+		}
+	}
+	return ret
+}
+
+// encodeItemValue encodes pm with the codec selected for key. If that codec
+// is unknown or fails, the default codec is used.
+func (s *supportContext) encodeItemValue(key *ds.Key, mg ds.MetaGetter, pm ds.PropertyMap) []byte {
+	switch name := s.codecName(key, mg); name {
+	case DefaultCodec:
+	case NoCompressionCodec:
+		pm, _ = pm.Save(false)
+		return encodeUncompressed(pm)
+	default:
+		rc := codecByName(name)
+		if rc == nil {
+			log.Warningf(s.c, "dscache: unknown codec %q for %s", name, key)
+			break
+		}
+		pm, _ = pm.Save(false)
+		data, err := rc.codec.Encode(pm)
+		if err != nil {
+			(log.Fields{log.ErrorKey: err}).Warningf(s.c, "dscache: codec %q failed to encode %s", name, key)
+			break
+		}
+		return append([]byte{byte(rc.ctype)}, data...)
+	}
+	return encodeItemValue(pm)
+}
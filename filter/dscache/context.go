@@ -45,12 +45,19 @@ func FilterRDS(c context.Context) context.Context {
 func AlwaysFilterRDS(c context.Context) context.Context {
 	return ds.AddRawFilters(c, func(c context.Context, rds ds.RawInterface) ds.RawInterface {
 		shardFns, _ := c.Value(&dsShardFunctionsKey).([]ShardFunction)
+		queryCacheFns, _ := c.Value(&dsQueryCacheFunctionsKey).([]QueryCacheFunction)
+		codecFns, _ := c.Value(&dsCodecFunctionsKey).([]CodecFunction)
+		eventHandlers, _ := c.Value(&dsEventHandlersKey).([]EventHandler)
 
 		sc := &supportContext{
 			ds.GetKeyContext(c),
 			c,
 			mathrand.Get(c),
 			shardFns,
+			queryCacheFns,
+			codecFns,
+			eventHandlers,
+			getRequestCache(c),
 		}
 
 		v := c.Value(&dsTxnCacheKey)
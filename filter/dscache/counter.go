@@ -0,0 +1,209 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	ds "github.com/luci/gae/service/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// KindCounts is the number of events of each type emitted for a single kind.
+// It's returned by Counter.
+type KindCounts struct {
+	Hits             int64
+	NegativeHits     int64
+	RequestCacheHits int64
+	Misses           int64
+	LockContentions  int64
+	CASFailures      int64
+	MemcacheErrors   int64
+	QueryHits        int64
+	QueryMisses      int64
+}
+
+func (k *KindCounts) String() string {
+	return fmt.Sprintf("{Hits:%d, NegativeHits:%d, RequestCacheHits:%d, Misses:%d, LockContentions:%d, "+
+		"CASFailures:%d, MemcacheErrors:%d, QueryHits:%d, QueryMisses:%d}",
+		k.Hits, k.NegativeHits, k.RequestCacheHits, k.Misses, k.LockContentions,
+		k.CASFailures, k.MemcacheErrors, k.QueryHits, k.QueryMisses)
+}
+
+// Lookups is the number of entity lookups which reached dscache. It's
+// Hits+NegativeHits+RequestCacheHits+Misses+LockContentions.
+func (k *KindCounts) Lookups() int64 {
+	return k.Hits + k.NegativeHits + k.RequestCacheHits + k.Misses + k.LockContentions
+}
+
+// HitRate is the ratio of entity lookups which didn't reach the datastore, or
+// 0 if there were none.
+func (k *KindCounts) HitRate() float64 {
+	lookups := k.Lookups()
+	if lookups == 0 {
+		return 0
+	}
+	return float64(k.Hits+k.NegativeHits+k.RequestCacheHits) / float64(lookups)
+}
+
+func (k *KindCounts) add(t EventType) {
+	switch t {
+	case EventHit:
+		k.Hits++
+	case EventNegativeHit:
+		k.NegativeHits++
+	case EventRequestCacheHit:
+		k.RequestCacheHits++
+	case EventMiss:
+		k.Misses++
+	case EventLockContention:
+		k.LockContentions++
+	case EventCASFailure:
+		k.CASFailures++
+	case EventMemcacheError:
+		k.MemcacheErrors++
+	case EventQueryHit:
+		k.QueryHits++
+	case EventQueryMiss:
+		k.QueryMisses++
+	}
+}
+
+// KeyCounts is the number of lookups of a single entity. It's returned by
+// Counter.HotKeys.
+type KeyCounts struct {
+	Key *ds.Key
+
+	// Lookups is the number of times the entity was looked up in dscache.
+	Lookups int64
+	// LockContentions is the number of those lookups which found the entity
+	// locked by another operation.
+	LockContentions int64
+}
+
+// Counter aggregates the events emitted by the dscache filter, per kind and
+// per entity. It's safe for concurrent use.
+//
+// Since it counts the lookups of every entity, it grows with the number of
+// distinct entities which are looked up. It should be Reset (or replaced)
+// periodically in long-running processes.
+type Counter struct {
+	lock sync.Mutex
+
+	kinds map[string]*KindCounts
+	keys  map[string]*KeyCounts
+}
+
+// AddCounter installs a new Counter as an event handler in the context (see
+// AddEventHandlers).
+func AddCounter(c context.Context) (context.Context, *Counter) {
+	ret := &Counter{}
+	return AddEventHandlers(c, ret.Handle), ret
+}
+
+// Handle counts e. It's an EventHandler.
+func (ctr *Counter) Handle(c context.Context, e *Event) {
+	ctr.lock.Lock()
+	defer ctr.lock.Unlock()
+
+	if ctr.kinds == nil {
+		ctr.kinds = map[string]*KindCounts{}
+		ctr.keys = map[string]*KeyCounts{}
+	}
+
+	kc := ctr.kinds[e.Kind]
+	if kc == nil {
+		kc = &KindCounts{}
+		ctr.kinds[e.Kind] = kc
+	}
+	kc.add(e.Type)
+
+	if e.Key == nil {
+		return
+	}
+	switch e.Type {
+	case EventHit, EventNegativeHit, EventRequestCacheHit, EventMiss, EventLockContention:
+		id := e.Key.String()
+		key := ctr.keys[id]
+		if key == nil {
+			key = &KeyCounts{Key: e.Key}
+			ctr.keys[id] = key
+		}
+		key.Lookups++
+		if e.Type == EventLockContention {
+			key.LockContentions++
+		}
+	}
+}
+
+// Kinds returns a copy of the counts of each kind. Events which aren't related
+// to a kind (e.g. failures to Set locks) are counted under the empty kind.
+func (ctr *Counter) Kinds() map[string]KindCounts {
+	ctr.lock.Lock()
+	defer ctr.lock.Unlock()
+
+	ret := make(map[string]KindCounts, len(ctr.kinds))
+	for kind, kc := range ctr.kinds {
+		ret[kind] = *kc
+	}
+	return ret
+}
+
+// Kind returns a copy of the counts of kind.
+func (ctr *Counter) Kind(kind string) KindCounts {
+	ctr.lock.Lock()
+	defer ctr.lock.Unlock()
+
+	if kc := ctr.kinds[kind]; kc != nil {
+		return *kc
+	}
+	return KindCounts{}
+}
+
+// HotKeys returns the n most looked up entities, most looked up first. Those
+// with a lot of LockContentions may benefit from more shards (see
+// ShardFunction).
+func (ctr *Counter) HotKeys(n int) []KeyCounts {
+	ctr.lock.Lock()
+	defer ctr.lock.Unlock()
+
+	ret := make([]KeyCounts, 0, len(ctr.keys))
+	for _, key := range ctr.keys {
+		ret = append(ret, *key)
+	}
+	sort.Sort(hotKeys(ret))
+	if n >= 0 && n < len(ret) {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+// Reset clears all the counts.
+func (ctr *Counter) Reset() {
+	ctr.lock.Lock()
+	defer ctr.lock.Unlock()
+
+	ctr.kinds = nil
+	ctr.keys = nil
+}
+
+type hotKeys []KeyCounts
+
+func (s hotKeys) Len() int      { return len(s) }
+func (s hotKeys) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s hotKeys) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	switch {
+	case a.Lookups != b.Lookups:
+		return a.Lookups > b.Lookups
+	case a.LockContentions != b.LockContentions:
+		return a.LockContentions > b.LockContentions
+	default:
+		return a.Key.Less(b.Key)
+	}
+}
@@ -31,8 +31,9 @@
 //
 // The memcache value is a compression byte, indicating the scheme (See
 // CompressionType), followed by the encoded (and possibly compressed) value.
-// Encoding is done with datastore.PropertyMap.Write(). The memcache value
-// may also be the empty byte sequence, indicating that this entity is deleted.
+// Encoding is done with datastore.PropertyMap.Write(), unless another Codec
+// was selected for the entity (see RegisterCodec). The memcache value may also
+// be the empty byte sequence, indicating that this entity is deleted.
 //
 // The memcache entry may also have a 'flags' value set to one of the following:
 //   - 0 "entity" (cached value)
@@ -94,6 +95,45 @@
 // Gets and Queries in a transaction pass right through without reading or
 // writing memcache.
 //
+// Algorithm - Request cache
+//
+// Optionally (see WithRequestCache), a bounded in-memory cache may be installed
+// in the context, in front of memcache. Get consults it first, and only goes
+// to memcache (and possibly the datastore) for the entities it doesn't have,
+// adding the results to it. Negative lookups are cached too.
+//
+// Put and Delete remove the entities from the request cache, both before and
+// after the datastore operation.
+//
+// A transaction gets its own (initially empty) view of the request cache,
+// which caches the Gets done in the transaction and forgets the entities
+// mutated in it. If the transaction commits, the mutated entities are removed
+// from the request cache, and the rest of the view is merged into it. If it
+// fails, the entities it mutated are removed from the request cache anyway.
+//
+// Algorithm - Queries
+//
+// Queries only interact with the cache for the kinds for which a
+// QueryCacheFunction (see AddQueryCacheFunctions) enables it, outside of
+// transactions, and only if they have no projection and no cursors.
+//
+// Each such kind has a generation: a random value stored in memcache under
+//
+//   "gae:" | vers | ":qgen:" | Base64_std_nopad(SHA1(kind))
+//
+// The keys-only version of the query is run, and its result is stored in
+// memcache under a key derived from the generation of the kind and the
+// canonical (GQL) form of the keys-only query. The entities are then fetched
+// with the cached Get described above. So a query and its keys-only version
+// share the same cached result.
+//
+// On a Put (or Delete), the generation of the kinds of the mutated entities is
+// set to a new random value along with the locks (so this is a HARD ERROR too),
+// and deleted along with them once the mutation is done. This orphans all the
+// cached results of the kind, which then expire naturally.
+//
+// Callbacks of cached query results can't retrieve cursors.
+//
 // Cache control
 //
 // An entity may expose the following metadata (see
@@ -104,6 +144,10 @@
 //   - `gae:"$dscache.expiration,#seconds"` - the number of seconds of
 //     persistance to use when this item is cached. 0 is infinite. If omitted,
 //     defaults to 0.
+//   - `gae:"$dscache.codec,<name>"` - the name of the codec used to encode
+//     this entity in memcache: "none", "zlib" (the default, which compresses
+//     entities larger than CompressionThreshold), or a codec registered with
+//     RegisterCodec. The codec may also be selected with AddCodecFunctions.
 //
 // In addition, the application may set a function shardsForKey(key) which
 // returns the number of shards to use for a given datastore key. This function
@@ -117,15 +161,30 @@
 // The purpose of sharding is to alleviate hot memcache keys, as recommended by
 // https://cloud.google.com/appengine/articles/best-practices-for-app-engine-memcache#distribute-load .
 //
+// Events
+//
+// The filter emits an Event for every cache hit, miss, lock contention, failed
+// CompareAndSwap and memcache error to the handlers installed with
+// AddEventHandlers. AddCounter installs a Counter, which aggregates them per
+// kind (e.g. to compute hit rates) and per entity (to find hot entities which
+// would benefit from more shards).
+//
 // Caveats
 //
 // A couple things to note that may differ from other appengine datastore
 // caching libraries (like goon, nds, or ndb).
 //
-//   - It does NOT provide in-memory ("per-request") caching.
+//   - In-memory ("per-request") caching is opt-in, see WithRequestCache. It
+//     only sees the mutations done through the same context, so it can return
+//     stale entities if the same entity is modified concurrently by another
+//     request.
 //   - It's INtolerant of some memcache failures, but in exchange will not return
 //     inconsistent results. See DANGER ZONE for details.
-//   - Queries do not interact with the cache at all.
+//   - Queries do not interact with the cache, unless enabled with
+//     AddQueryCacheFunctions. Cached query results may be eventually
+//     consistent, even for ancestor queries, and may be stale if the kind
+//     is mutated through a context which doesn't have the same
+//     QueryCacheFunctions.
 //   - Negative lookups (e.g. ErrNoSuchEntity) are cached.
 //
 // DANGER ZONE
@@ -158,6 +217,23 @@
 // GlobalEnabledCheckInterval time (5 minutes). This equates to essentially once
 // per http request, per 5 minutes, per instance.
 //
+// Circuit breaker
+//
+// Alternatively, set CircuitBreakerThreshold (e.g. in an init() function) to
+// have each instance stop using memcache by itself after that many consecutive
+// memcache failures. While memcache is bypassed, Gets and queries go straight
+// to the datastore, and a Put (or Delete) records the memcache keys it
+// invalidates in a datastore entity of kind InvalidationKind (in the default
+// namespace) before the mutation. If that record can't be written, it's a
+// HARD ERROR.
+//
+// Every CircuitBreakerRetryInterval (30 seconds), the instance tries to replay
+// the recorded invalidations, i.e. to delete their memcache keys. Once it
+// succeeds, it uses memcache again. Other instances may keep using memcache in
+// the meantime, and serve stale entities until the invalidations are replayed.
+// ReplayInvalidations may also be called from a cron job, to replay the
+// invalidations of instances which went away before memcache recovered.
+//
 // AppEngine's memcache reserves the right to evict keys at any moment. This is
 // especially true for shared memcache, which is subject to pressures outside of
 // your application. When eviction happens due to memory pressure,
@@ -178,9 +254,22 @@
 // Note that flusing memcache of a running application may also induce this
 // race. Flushes should be performed with this concern in mind.
 //
-// TODO: A potential mitigation to lock eviction poisoning is to use memcache
-// Statistics to identify the oldest memcache item and use that age to bound
-// the lifetime of cached datastore entries. This would cause dscache items
-// created around the time of a flush to expire quickly (instead of never),
-// bounding the period of time when poisoned data may reside in the cache.
+// Eviction
+//
+// To mitigate lock eviction poisoning, set EvictionBoundEnabled to true (e.g.
+// in an init() function). The lifetime of cached datastore entries (and of
+// cached query results) is then bounded by the age of access of the oldest
+// memcache item, as reported by the memcache Statistics: if memcache is
+// evicting items which were accessed a minute ago, a lock may have been
+// evicted as well, and the poisoned entry it let through will expire within a
+// minute too.
+//
+// Flushes are detected with a sentinel item (SentinelKey, in the default
+// namespace) which holds the time at which it was written. If it's missing,
+// memcache was flushed, so it's written again, and the entries cached around
+// that time expire quickly (instead of never). The lifetime is thus also
+// bounded by the age of the sentinel.
+//
+// The bound is never lower than LockTimeSeconds, and is recomputed once per
+// EvictionBoundCheckInterval (1 minute), per instance.
 package dscache
@@ -37,8 +37,15 @@ func (d *dsCache) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB
 }
 
 func (d *dsCache) GetMulti(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMultiCB) error {
+	if d.rc != nil {
+		return d.rc.getMulti(d.supportContext, keys, metas, cb, d.getMultiMemcache)
+	}
+	return d.getMultiMemcache(keys, metas, cb)
+}
+
+func (d *dsCache) getMultiMemcache(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMultiCB) error {
 	lockItems, nonce := d.mkRandLockItems(keys, metas)
-	if len(lockItems) == 0 {
+	if len(lockItems) == 0 || d.bypassMemcache() {
 		return d.RawInterface.GetMulti(keys, metas, cb)
 	}
 
@@ -50,6 +57,9 @@ func (d *dsCache) GetMulti(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMu
 	if err := errors.Filter(mc.Get(d.c, lockItems...), mc.ErrCacheMiss); err != nil {
 		(log.Fields{log.ErrorKey: err}).Debugf(
 			d.c, "dscache: GetMulti: memcache.Get")
+		d.emitMemcacheError("Get", err, keys)
+	} else {
+		d.memcacheSucceeded()
 	}
 
 	p := d.makeFetchPlan(&facts{keys, metas, lockItems, nonce})
@@ -59,6 +69,8 @@ func (d *dsCache) GetMulti(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMu
 		// to save stuff back to memcache.
 
 		toCas := []mc.Item{}
+		toCasKeys := []*ds.Key{}
+		bound := getEvictionBound(d.c)
 		j := 0
 		err := d.RawInterface.GetMulti(p.toGet, p.toGetMeta, func(pm ds.PropertyMap, err error) error {
 			i := p.idxMap[j]
@@ -73,7 +85,7 @@ func (d *dsCache) GetMulti(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMu
 			if err == nil {
 				p.decoded[i] = pm
 				if toSave != nil {
-					data = encodeItemValue(pm)
+					data = d.encodeItemValue(keys[i], metas.GetSingle(i), pm)
 					if len(data) > internalValueSizeLimit {
 						shouldSave = false
 						log.Warningf(
@@ -92,6 +104,7 @@ func (d *dsCache) GetMulti(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMu
 				if shouldSave { // save
 					mg := metas.GetSingle(i)
 					expSecs := ds.GetMetaDefault(mg, CacheExpirationMeta, CacheTimeSeconds).(int64)
+					expSecs = boundExpiration(expSecs, bound)
 					toSave.SetFlags(uint32(ItemHasData))
 					toSave.SetExpiration(time.Duration(expSecs) * time.Second)
 					toSave.SetValue(data)
@@ -103,6 +116,7 @@ func (d *dsCache) GetMulti(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMu
 					toSave.SetValue(nil)
 				}
 				toCas = append(toCas, toSave)
+				toCasKeys = append(toCasKeys, keys[i])
 			}
 			return nil
 		})
@@ -114,6 +128,7 @@ func (d *dsCache) GetMulti(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMu
 			if err := mc.CompareAndSwap(d.c, toCas...); err != nil {
 				(log.Fields{log.ErrorKey: err}).Debugf(
 					d.c, "dscache: GetMulti: memcache.CompareAndSwap")
+				d.emitCASErrors(err, toCasKeys)
 			}
 		}
 	}
@@ -130,7 +145,7 @@ func (d *dsCache) GetMulti(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMu
 }
 
 func (d *dsCache) RunInTransaction(f func(context.Context) error, opts *ds.TransactionOptions) error {
-	txnState := dsTxnState{}
+	txnState := dsTxnState{parentRC: d.rc}
 	err := d.RawInterface.RunInTransaction(func(ctx context.Context) error {
 		txnState.reset()
 		err := f(context.WithValue(ctx, &dsTxnCacheKey, &txnState))
@@ -141,6 +156,8 @@ func (d *dsCache) RunInTransaction(f func(context.Context) error, opts *ds.Trans
 	}, opts)
 	if err == nil {
 		txnState.release(d.supportContext)
+	} else {
+		txnState.discard()
 	}
 	return err
 }
@@ -18,6 +18,13 @@ type dsTxnCache struct {
 
 var _ ds.RawInterface = (*dsTxnCache)(nil)
 
+func (d *dsTxnCache) GetMulti(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMultiCB) error {
+	if d.state.rc != nil {
+		return d.state.rc.getMulti(d.sc, keys, metas, cb, d.RawInterface.GetMulti)
+	}
+	return d.RawInterface.GetMulti(keys, metas, cb)
+}
+
 func (d *dsTxnCache) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
 	d.state.add(d.sc, keys)
 	return d.RawInterface.DeleteMulti(keys, cb)
@@ -19,6 +19,17 @@ type dsTxnState struct {
 
 	toLock   []mc.Item
 	toDelete map[string]struct{}
+
+	// bypassed is true if the invalidations were recorded in the datastore
+	// instead of locking the memcache keys (see CircuitBreakerThreshold).
+	bypassed bool
+
+	// parentRC is the request cache outside of the transaction, if any. rc is
+	// the transaction's own view of it, and mutated holds the request cache
+	// keys of the entities mutated by the transaction.
+	parentRC *requestCache
+	rc       *requestCache
+	mutated  map[string]struct{}
 }
 
 // reset sets the transaction state back to its 0 state. This is used so that
@@ -32,6 +43,12 @@ func (s *dsTxnState) reset() {
 	// anyway.
 	s.toLock = s.toLock[:0]
 	s.toDelete = make(map[string]struct{}, len(s.toDelete))
+	s.bypassed = false
+
+	if s.parentRC != nil {
+		s.rc = s.parentRC.view()
+		s.mutated = make(map[string]struct{}, len(s.mutated))
+	}
 }
 
 // apply is called right before the trasnaction is about to commit. It's job
@@ -40,14 +57,40 @@ func (s *dsTxnState) apply(sc *supportContext) error {
 	s.Lock()
 	defer s.Unlock()
 
+	if len(s.toLock) == 0 {
+		return nil
+	}
+	if sc.bypassMemcache() {
+		return s.recordInvalidationLocked(sc)
+	}
+
 	// this is a hard failure. No mutation can occur if we're unable to set
 	// locks out. See "DANGER ZONE" in the docs.
 	err := mc.Set(sc.c, s.toLock...)
 	if err != nil {
+		sc.emitMemcacheError("Set", err, nil)
+		if sc.bypassMemcache() {
+			// the circuit breaker just opened.
+			return s.recordInvalidationLocked(sc)
+		}
 		(log.Fields{log.ErrorKey: err}).Errorf(
 			sc.c, "dscache: HARD FAILURE: dsTxnState.apply(): mc.Set")
+		return err
 	}
-	return err
+	sc.memcacheSucceeded()
+	return nil
+}
+
+func (s *dsTxnState) recordInvalidationLocked(sc *supportContext) error {
+	mcKeys := make([]string, 0, len(s.toDelete))
+	for k := range s.toDelete {
+		mcKeys = append(mcKeys, k)
+	}
+	if err := sc.recordInvalidation(mcKeys); err != nil {
+		return err
+	}
+	s.bypassed = true
+	return nil
 }
 
 // release is called right after a successful transaction completion. It's job
@@ -57,20 +100,53 @@ func (s *dsTxnState) release(sc *supportContext) {
 	s.Lock()
 	defer s.Unlock()
 
-	delKeys := make([]string, 0, len(s.toDelete))
-	for k := range s.toDelete {
-		delKeys = append(delKeys, k)
+	if !s.bypassed {
+		delKeys := make([]string, 0, len(s.toDelete))
+		for k := range s.toDelete {
+			delKeys = append(delKeys, k)
+		}
+
+		if err := errors.Filter(mc.Delete(sc.c, delKeys...), mc.ErrCacheMiss); err != nil {
+			(log.Fields{log.ErrorKey: err}).Warningf(
+				sc.c, "dscache: txn.release: memcache.Delete")
+			sc.emitMemcacheError("Delete", err, nil)
+		}
 	}
 
-	if err := errors.Filter(mc.Delete(sc.c, delKeys...), mc.ErrCacheMiss); err != nil {
-		(log.Fields{log.ErrorKey: err}).Warningf(
-			sc.c, "dscache: txn.release: memcache.Delete")
+	if s.parentRC != nil {
+		s.parentRC.merge(s.rc, s.mutated)
+	}
+}
+
+// discard is called when the transaction failed. It invalidates the entities
+// which the transaction meant to mutate in the request cache, since it's
+// possible that the transaction was committed anyway.
+func (s *dsTxnState) discard() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.parentRC != nil {
+		s.parentRC.merge(s.parentRC.view(), s.mutated)
 	}
 }
 
 func (s *dsTxnState) add(sc *supportContext, keys []*datastore.Key) {
+	if s.rc != nil {
+		s.rc.invalidate(keys)
+
+		s.Lock()
+		for _, k := range keys {
+			if !k.IsIncomplete() {
+				s.mutated[requestCacheKeyFor(k)] = struct{}{}
+			}
+		}
+		s.Unlock()
+	}
+
 	lockItems, lockKeys := sc.mkAllLockItems(keys)
-	if lockItems == nil {
+	genItems, genKeys := sc.mkQueryGenerationItems(keys)
+	lockItems, lockKeys = append(lockItems, genItems...), append(lockKeys, genKeys...)
+	if len(lockItems) == 0 {
 		return
 	}
 
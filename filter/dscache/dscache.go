@@ -43,6 +43,22 @@ var (
 	// DefaultEnabled indicates whether or not caching is globally enabled or
 	// disabled by default. Can still be overridden by CacheEnableMeta.
 	DefaultEnabled = true
+
+	// EvictionBoundEnabled allows you to statically (e.g. in an init()
+	// function) bound the lifetime of cached entities by the age of the oldest
+	// memcache item, and by the time since the last memcache flush. See the
+	// "Eviction" section of the package documentation.
+	EvictionBoundEnabled = false
+
+	// CircuitBreakerThreshold is the number of consecutive memcache failures
+	// after which this instance stops using memcache, instead of failing
+	// mutations. A value of 0 disables the circuit breaker. See the "Circuit
+	// breaker" section of the package documentation.
+	CircuitBreakerThreshold = 0
+
+	// CircuitBreakerRetryInterval is how frequently an instance which stopped
+	// using memcache checks whether it's reachable again.
+	CircuitBreakerRetryInterval = 30 * time.Second
 )
 
 const (
@@ -83,12 +99,24 @@ const (
 	// expiration time (in seconds) for an entity type.
 	CacheExpirationMeta = "dscache.expiration"
 
+	// CacheCodecMeta is the gae metadata key name for the name of the codec
+	// (see RegisterCodec) used to encode the cached entities of an entity type.
+	CacheCodecMeta = "dscache.codec"
+
 	// NonceBytes is the number of bytes to use in the 'lock' nonce.
 	NonceBytes = 8
 
 	// GlobalEnabledCheckInterval is how frequently IsGloballyEnabled should check
 	// the globalEnabled datastore entry.
 	GlobalEnabledCheckInterval = 5 * time.Minute
+
+	// EvictionBoundCheckInterval is how frequently the eviction bound is
+	// recomputed from the memcache statistics and the flush sentinel.
+	EvictionBoundCheckInterval = time.Minute
+
+	// SentinelKey is the memcache key of the flush sentinel, in the default
+	// namespace. Its value is the time at which it was written.
+	SentinelKey = "gae:" + MemcacheVersion + ":sentinel"
 )
 
 // internalValueSizeLimit is a var for testing purposes.
@@ -97,7 +125,8 @@ var internalValueSizeLimit = ValueSizeLimit
 // CompressionType is the type of compression a single memcache entry has.
 type CompressionType byte
 
-// Types of compression. ZlibCompression uses "compress/zlib".
+// Types of compression. ZlibCompression uses "compress/zlib". Other types may
+// be registered with RegisterCodec.
 const (
 	NoCompression CompressionType = iota
 	ZlibCompression
@@ -109,9 +138,11 @@ func (c CompressionType) String() string {
 		return "NoCompression"
 	case ZlibCompression:
 		return "ZlibCompression"
-	default:
-		return fmt.Sprintf("UNKNOWN_CompressionType(%d)", c)
 	}
+	if rc := codecByType(c); rc != nil {
+		return fmt.Sprintf("CompressionType(%d, %q)", c, rc.name)
+	}
+	return fmt.Sprintf("UNKNOWN_CompressionType(%d)", c)
 }
 
 // FlagValue is used to indicate if a memcache entry currently contains an
@@ -61,10 +61,28 @@ func noCacheObjFn(k *ds.Key) (amt int, ok bool) {
 	return
 }
 
+// reverseCompressor "compresses" data by reversing it.
+type reverseCompressor struct{}
+
+func (reverseCompressor) reverse(data []byte) []byte {
+	ret := make([]byte, len(data))
+	for i, b := range data {
+		ret[len(data)-1-i] = b
+	}
+	return ret
+}
+
+func (r reverseCompressor) Compress(data []byte) ([]byte, error)   { return r.reverse(data), nil }
+func (r reverseCompressor) Decompress(data []byte) ([]byte, error) { return r.reverse(data), nil }
+
+const reverseCompression = CompressionType(42)
+
 func init() {
 	serialize.WritePropertyMapDeterministic = true
 
 	internalValueSizeLimit = 2048
+
+	RegisterCodec("reverse", reverseCompression, CompressorCodec(reverseCompressor{}))
 }
 
 func TestDSCache(t *testing.T) {
@@ -177,6 +195,129 @@ func TestDSCache(t *testing.T) {
 				So(o.BigData, ShouldResemble, data)
 			})
 
+			Convey("events", func() {
+				var events []string
+				c := AddEventHandlers(c, func(c context.Context, e *Event) {
+					events = append(events, e.String())
+				})
+				c, ctr := AddCounter(c)
+
+				So(ds.Put(c, &object{ID: 1, Value: "hi"}), ShouldBeNil)
+				for i := 0; i < 2; i++ {
+					So(ds.Get(c, &object{ID: 1}), ShouldBeNil)
+					So(ds.Get(c, &object{ID: 99}), ShouldEqual, ds.ErrNoSuchEntity)
+				}
+				So(events, ShouldResemble, []string{
+					`Miss dev~app::/object,1`,
+					`Miss dev~app::/object,99`,
+					`Hit dev~app::/object,1`,
+					`NegativeHit dev~app::/object,99`,
+				})
+
+				kc := ctr.Kind("object")
+				So(kc, ShouldResemble, KindCounts{Hits: 1, NegativeHits: 1, Misses: 2})
+				So(kc.HitRate(), ShouldEqual, 0.5)
+
+				Convey("counts lock contention and hot keys", func() {
+					key := ds.NewKey(c, "object", "", 2, nil)
+					So(ds.Put(underCtx, &object{ID: 2}), ShouldBeNil)
+					So(mc.Set(c, mc.NewItem(c, MakeMemcacheKey(0, key)).
+						SetFlags(uint32(ItemHasLock)).
+						SetValue([]byte("someone else"))), ShouldBeNil)
+					for i := 0; i < 3; i++ {
+						So(ds.Get(c, &object{ID: 2}), ShouldBeNil)
+					}
+
+					So(ctr.Kind("object").LockContentions, ShouldEqual, 3)
+					hot := ctr.HotKeys(2)
+					So(hot, ShouldHaveLength, 2)
+					So(hot[0], ShouldResemble, KeyCounts{Key: key, Lookups: 3, LockContentions: 3})
+					So(hot[1].Key.IntID(), ShouldEqual, 1)
+				})
+
+				Convey("counts memcache errors", func() {
+					c, fb := featureBreaker.FilterMC(c, nil)
+					fb.BreakFeatures(nil, "GetMulti")
+
+					events = nil
+					So(ds.Get(c, &object{ID: 1}), ShouldBeNil)
+					So(events, ShouldHaveLength, 2)
+					So(events[0], ShouldStartWith, "MemcacheError Get: ")
+					So(events[1], ShouldEqual, `Miss dev~app::/object,1`)
+					So(ctr.Kind("").MemcacheErrors, ShouldEqual, 1)
+				})
+
+				Convey("can be reset", func() {
+					ctr.Reset()
+					So(ctr.Kinds(), ShouldBeEmpty)
+					So(ctr.HotKeys(-1), ShouldBeEmpty)
+				})
+			})
+
+			Convey("codecs", func() {
+				bigData := bytes.Repeat([]byte("ABCD"), 300) // above CompressionThreshold
+				cachedValue := func(c context.Context, obj interface{}) []byte {
+					So(ds.Put(c, obj), ShouldBeNil)
+					So(ds.Get(c, obj), ShouldBeNil)
+					itm, err := mc.GetKey(c, MakeMemcacheKey(0, ds.KeyForObj(c, obj)))
+					So(err, ShouldBeNil)
+					return itm.Value()
+				}
+
+				Convey("can be selected with codec functions", func() {
+					c := AddCodecFunctions(c, func(k *ds.Key) (string, bool) {
+						return "reverse", k.Kind() == "object"
+					})
+
+					o := object{ID: 1, Value: "hi", BigData: bigData}
+					So(cachedValue(c, &o)[0], ShouldEqual, reverseCompression)
+
+					// ensure the next Get comes from the cache
+					So(ds.Delete(underCtx, ds.KeyForObj(underCtx, &o)), ShouldBeNil)
+
+					o = object{ID: 1}
+					So(ds.Get(c, &o), ShouldBeNil)
+					So(o.Value, ShouldEqual, "hi")
+					So(o.BigData, ShouldResemble, bigData)
+
+					Convey("and are still decoded without them", func() {
+						o = object{ID: 1}
+						So(ds.Get(underCtx, &o), ShouldEqual, ds.ErrNoSuchEntity)
+						So(ds.Get(AlwaysFilterRDS(underCtx), &o), ShouldBeNil)
+						So(o.Value, ShouldEqual, "hi")
+					})
+				})
+
+				Convey("can be selected with metadata", func() {
+					type model struct {
+						ID    int64  `gae:"$id"`
+						Codec string `gae:"$dscache.codec,none"`
+
+						BigData []byte
+					}
+
+					c := AddCodecFunctions(c, func(k *ds.Key) (string, bool) {
+						return "reverse", true
+					})
+					So(cachedValue(c, &model{ID: 1, BigData: bigData})[0], ShouldEqual, NoCompression)
+				})
+
+				Convey("fall back to the default codec if unknown", func() {
+					c := AddCodecFunctions(c, func(k *ds.Key) (string, bool) {
+						return "unknown", true
+					})
+					So(cachedValue(c, &object{ID: 1, BigData: bigData})[0], ShouldEqual, ZlibCompression)
+				})
+
+				Convey("can't be registered twice", func() {
+					codec := CompressorCodec(reverseCompressor{})
+					So(func() { RegisterCodec("reverse", 43, codec) }, ShouldPanic)
+					So(func() { RegisterCodec("other", reverseCompression, codec) }, ShouldPanic)
+					So(func() { RegisterCodec("other", ZlibCompression, codec) }, ShouldPanic)
+					So(func() { RegisterCodec(DefaultCodec, 43, codec) }, ShouldPanic)
+				})
+			})
+
 			Convey("transactions", func() {
 				Convey("work", func() {
 					// populate an object @ ID1
@@ -232,6 +373,195 @@ func TestDSCache(t *testing.T) {
 				})
 			})
 
+			Convey("request cache", func() {
+				c = WithRequestCache(c, 2)
+
+				// forget removes the entities from the datastore and memcache, bypassing
+				// the request cache.
+				forget := func(objs ...*object) {
+					for _, o := range objs {
+						So(ds.Delete(underCtx, ds.KeyForObj(underCtx, o)), ShouldBeNil)
+					}
+					So(mc.Flush(c), ShouldBeNil)
+				}
+
+				Convey("serves repeated Gets", func() {
+					So(ds.Put(c, &object{ID: 1, Value: "hi"}), ShouldBeNil)
+					So(ds.Get(c, &object{ID: 1}), ShouldBeNil)
+					forget(&object{ID: 1})
+
+					o := &object{ID: 1}
+					So(ds.Get(c, o), ShouldBeNil)
+					So(o.Value, ShouldEqual, "hi")
+
+					Convey("but not in other requests", func() {
+						So(ds.Get(WithRequestCache(c, 0), &object{ID: 1}), ShouldEqual, ds.ErrNoSuchEntity)
+					})
+
+					Convey("and is invalidated by Put and Delete", func() {
+						So(ds.Put(c, &object{ID: 1, Value: "new"}), ShouldBeNil)
+						So(ds.Get(c, o), ShouldBeNil)
+						So(o.Value, ShouldEqual, "new")
+
+						So(ds.Delete(c, ds.KeyForObj(c, o)), ShouldBeNil)
+						So(ds.Get(c, o), ShouldEqual, ds.ErrNoSuchEntity)
+					})
+				})
+
+				Convey("caches negative lookups", func() {
+					So(ds.Get(c, &object{ID: 1}), ShouldEqual, ds.ErrNoSuchEntity)
+					So(ds.Put(underCtx, &object{ID: 1, Value: "hi"}), ShouldBeNil)
+					So(mc.Flush(c), ShouldBeNil)
+					So(ds.Get(c, &object{ID: 1}), ShouldEqual, ds.ErrNoSuchEntity)
+				})
+
+				Convey("is bounded", func() {
+					objs := []*object{{ID: 1}, {ID: 2}, {ID: 3}}
+					So(ds.Put(c, objs), ShouldBeNil)
+					So(ds.Get(c, objs), ShouldBeNil)
+					forget(objs...)
+
+					So(ds.Get(c, &object{ID: 1}), ShouldEqual, ds.ErrNoSuchEntity)
+					So(ds.Get(c, &object{ID: 3}), ShouldBeNil)
+				})
+
+				Convey("skips uncacheable entities", func() {
+					So(ds.Put(c, &noCacheObj{ID: "nurbs", Value: true}), ShouldBeNil)
+					So(ds.Get(c, &noCacheObj{ID: "nurbs"}), ShouldBeNil)
+					So(ds.Delete(underCtx, ds.KeyForObj(underCtx, &noCacheObj{ID: "nurbs"})), ShouldBeNil)
+					So(ds.Get(c, &noCacheObj{ID: "nurbs"}), ShouldEqual, ds.ErrNoSuchEntity)
+				})
+
+				Convey("transactions", func() {
+					So(ds.Put(c, &object{ID: 1, Value: "one"}, &object{ID: 2, Value: "two"}), ShouldBeNil)
+
+					Convey("merge their view on commit", func() {
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							So(ds.Get(c, &object{ID: 1}), ShouldBeNil)
+							So(ds.Get(c, &object{ID: 2}), ShouldBeNil)
+							return ds.Put(c, &object{ID: 2, Value: "txn"})
+						}, &ds.TransactionOptions{XG: true}), ShouldBeNil)
+
+						// ID 1 was read by the transaction, ID 2 was mutated.
+						So(ds.Put(underCtx, &object{ID: 2, Value: "direct"}), ShouldBeNil)
+						forget(&object{ID: 1})
+
+						o := &object{ID: 1}
+						So(ds.Get(c, o), ShouldBeNil)
+						So(o.Value, ShouldEqual, "one")
+						o = &object{ID: 2}
+						So(ds.Get(c, o), ShouldBeNil)
+						So(o.Value, ShouldEqual, "direct")
+					})
+
+					Convey("don't see entities cached outside", func() {
+						So(ds.Get(c, &object{ID: 1}), ShouldBeNil)
+						forget(&object{ID: 1})
+
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							So(ds.Get(c, &object{ID: 1}), ShouldEqual, ds.ErrNoSuchEntity)
+							return nil
+						}, nil), ShouldBeNil)
+					})
+
+					Convey("invalidate mutated entities on failure", func() {
+						So(ds.Get(c, &object{ID: 1}), ShouldBeNil)
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							So(ds.Put(c, &object{ID: 1, Value: "txn"}), ShouldBeNil)
+							return errors.New("OH NOES")
+						}, nil), ShouldNotBeNil)
+
+						forget(&object{ID: 1})
+						So(ds.Get(c, &object{ID: 1}), ShouldEqual, ds.ErrNoSuchEntity)
+					})
+				})
+			})
+
+			Convey("query cache", func() {
+				c = AddQueryCacheFunctions(c, func(kind string) (int64, bool) {
+					if kind == "object" {
+						return 60, true
+					}
+					return 0, false
+				})
+				catchup := func() { ds.GetTestable(c).CatchupIndexes() }
+				values := func(c context.Context, q *ds.Query) []string {
+					var objs []*object
+					So(ds.GetAll(c, q, &objs), ShouldBeNil)
+					ret := make([]string, len(objs))
+					for i, o := range objs {
+						ret[i] = o.Value
+					}
+					return ret
+				}
+
+				So(ds.Put(c, &object{ID: 1, Value: "a"}, &object{ID: 2, Value: "b"}), ShouldBeNil)
+				catchup()
+
+				q := ds.NewQuery("object")
+				So(values(c, q), ShouldResemble, []string{"a", "b"})
+
+				// Bypass the cache.
+				So(ds.Put(underCtx, &object{ID: 3, Value: "c"}), ShouldBeNil)
+				catchup()
+
+				Convey("serves cached results", func() {
+					So(values(c, q), ShouldResemble, []string{"a", "b"})
+					So(values(underCtx, q), ShouldResemble, []string{"a", "b", "c"})
+
+					var keys []*ds.Key
+					So(ds.GetAll(c, q.KeysOnly(true), &keys), ShouldBeNil)
+					So(len(keys), ShouldEqual, 2)
+				})
+
+				Convey("doesn't cache different queries together", func() {
+					So(values(c, q.Limit(1)), ShouldResemble, []string{"a"})
+					So(values(c, q.Gt("Value", "a")), ShouldResemble, []string{"b", "c"})
+				})
+
+				Convey("resolves entities through the cache", func() {
+					So(ds.Put(underCtx, &object{ID: 1, Value: "A"}), ShouldBeNil)
+					So(values(c, q), ShouldResemble, []string{"a", "b"})
+				})
+
+				Convey("invalidates results on mutation", func() {
+					So(ds.Put(c, &object{ID: 4, Value: "d"}), ShouldBeNil)
+					catchup()
+					So(values(c, q), ShouldResemble, []string{"a", "b", "c", "d"})
+
+					So(ds.Delete(c, ds.KeyForObj(c, &object{ID: 1})), ShouldBeNil)
+					catchup()
+					So(values(c, q), ShouldResemble, []string{"b", "c", "d"})
+				})
+
+				Convey("invalidates results on transactional mutation", func() {
+					So(ds.RunInTransaction(c, func(c context.Context) error {
+						return ds.Put(c, &object{ID: 4, Value: "d"})
+					}, nil), ShouldBeNil)
+					catchup()
+					So(values(c, q), ShouldResemble, []string{"a", "b", "c", "d"})
+				})
+
+				Convey("expires results", func() {
+					clk.Add(61 * time.Second)
+					So(values(c, q), ShouldResemble, []string{"a", "b", "c"})
+				})
+
+				Convey("doesn't cache queries over other kinds", func() {
+					var keys []*ds.Key
+					So(ds.Put(c, &shardObj{ID: 1, Value: "x"}), ShouldBeNil)
+					catchup()
+					So(ds.GetAll(c, ds.NewQuery("shardObj").KeysOnly(true), &keys), ShouldBeNil)
+					So(len(keys), ShouldEqual, 1)
+
+					So(ds.Put(underCtx, &shardObj{ID: 2, Value: "y"}), ShouldBeNil)
+					catchup()
+					keys = nil
+					So(ds.GetAll(c, ds.NewQuery("shardObj").KeysOnly(true), &keys), ShouldBeNil)
+					So(len(keys), ShouldEqual, 2)
+				})
+			})
+
 			Convey("control", func() {
 				Convey("per-model bypass", func() {
 					type model struct {
@@ -409,6 +739,7 @@ func TestDSCache(t *testing.T) {
 					So(NoCompression.String(), ShouldEqual, "NoCompression")
 					So(ZlibCompression.String(), ShouldEqual, "ZlibCompression")
 					So(CompressionType(100).String(), ShouldEqual, "UNKNOWN_CompressionType(100)")
+					So(reverseCompression.String(), ShouldEqual, `CompressionType(42, "reverse")`)
 				})
 			})
 		})
@@ -458,3 +789,204 @@ func TestStaticEnable(t *testing.T) {
 		So(newC, ShouldEqual, c)
 	})
 }
+
+func TestEvictionBound(t *testing.T) {
+	// intentionally not parallel b/c deals with global variables
+	// t.Parallel()
+
+	Convey("Test EvictionBoundEnabled", t, func() {
+		EvictionBoundEnabled = true
+		defer func() {
+			EvictionBoundEnabled = false
+			evictionBound = 0
+			evictionBoundNextCheck = time.Time{}
+		}()
+
+		c, clk := testclock.UseTime(context.Background(), time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+		c = memory.Use(c)
+		c = AlwaysFilterRDS(c)
+
+		So(ds.Put(c, &object{ID: 1, Value: "hi"}), ShouldBeNil)
+		mcKey := MakeMemcacheKey(0, ds.KeyForObj(c, &object{ID: 1}))
+
+		isCached := func() bool {
+			_, err := mc.GetKey(c, mcKey)
+			if err == mc.ErrCacheMiss {
+				return false
+			}
+			So(err, ShouldBeNil)
+			return true
+		}
+		cache := func() {
+			clk.Add(EvictionBoundCheckInterval)
+			So(ds.Get(c, &object{ID: 1}), ShouldBeNil)
+			So(isCached(), ShouldBeTrue)
+		}
+
+		Convey("entities cached right after a flush expire quickly", func() {
+			cache()
+			So(evictionBound, ShouldEqual, LockTimeSeconds)
+			_, err := mc.GetKey(c, SentinelKey)
+			So(err, ShouldBeNil)
+
+			clk.Add(time.Duration(LockTimeSeconds+1) * time.Second)
+			So(isCached(), ShouldBeFalse)
+
+			Convey("but live longer as memcache ages", func() {
+				clk.Add(time.Hour)
+				cache()
+				clk.Add(time.Hour)
+				So(isCached(), ShouldBeTrue)
+
+				Convey("until it's flushed again", func() {
+					So(mc.Flush(c), ShouldBeNil)
+					cache()
+					So(evictionBound, ShouldEqual, LockTimeSeconds)
+				})
+			})
+		})
+
+		Convey("the lifetime is bounded by the oldest memcache item", func() {
+			written := make([]byte, 8)
+			binary.BigEndian.PutUint64(written, uint64(clock.Now(c).Add(-time.Hour).UnixNano()))
+			So(mc.Set(c, mc.NewItem(c, SentinelKey).SetValue(written)), ShouldBeNil)
+
+			cache()
+			So(evictionBound, ShouldEqual, 60)
+			clk.Add(61 * time.Second)
+			So(isCached(), ShouldBeFalse)
+		})
+
+		Convey("it's not bounded when disabled", func() {
+			EvictionBoundEnabled = false
+			cache()
+			clk.Add(time.Hour)
+			So(isCached(), ShouldBeTrue)
+			So(evictionBound, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	// intentionally not parallel b/c deals with global variables
+	// t.Parallel()
+
+	Convey("Test CircuitBreakerThreshold", t, func() {
+		CircuitBreakerThreshold = 2
+		defer func() {
+			CircuitBreakerThreshold = 0
+			breakerFailures = 0
+			breakerOpen = false
+			breakerNextProbe = time.Time{}
+			breakerPending = nil
+		}()
+
+		c, clk := testclock.UseTime(context.Background(), time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+		c = memory.Use(c)
+		underCtx := c
+		c, fb := featureBreaker.FilterMC(c, nil)
+		c = AlwaysFilterRDS(c)
+
+		mcFeatures := []string{"GetMulti", "AddMulti", "SetMulti", "DeleteMulti", "CompareAndSwapMulti"}
+		mcKey := MakeMemcacheKey(0, ds.NewKey(c, "object", "", 1, nil))
+		numInvalidations := func() int {
+			var keys []*ds.Key
+			So(ds.GetAll(underCtx, ds.NewQuery(InvalidationKind).KeysOnly(true), &keys), ShouldBeNil)
+			return len(keys)
+		}
+		getValue := func() string {
+			o := &object{ID: 1}
+			So(ds.Get(c, o), ShouldBeNil)
+			return o.Value
+		}
+
+		So(ds.Put(c, &object{ID: 1, Value: "v1"}), ShouldBeNil)
+		So(getValue(), ShouldEqual, "v1")
+
+		fb.BreakFeatures(nil, mcFeatures...)
+
+		// The first failure is still a hard error.
+		So(ds.Put(c, &object{ID: 1, Value: "v2"}).Error(), ShouldContainSubstring, "SetMulti")
+		So(breakerOpen, ShouldBeFalse)
+
+		So(ds.Put(c, &object{ID: 1, Value: "v2"}), ShouldBeNil)
+		So(breakerOpen, ShouldBeTrue)
+		So(numInvalidations(), ShouldEqual, 1)
+		So(getValue(), ShouldEqual, "v2")
+
+		Convey("keeps bypassing memcache while it's down", func() {
+			clk.Add(CircuitBreakerRetryInterval)
+			So(getValue(), ShouldEqual, "v2")
+			So(breakerOpen, ShouldBeTrue)
+			So(numInvalidations(), ShouldEqual, 1)
+		})
+
+		Convey("doesn't cache the queries of the invalidations", func() {
+			c := AddQueryCacheFunctions(c, func(string) (int64, bool) { return 60, true })
+
+			So(ds.Put(c, &object{ID: 1, Value: "v3"}), ShouldBeNil)
+			So(numInvalidations(), ShouldEqual, 2)
+
+			fb.UnbreakFeatures(mcFeatures...)
+			clk.Add(CircuitBreakerRetryInterval)
+			o := &object{ID: 1}
+			So(ds.Get(c, o), ShouldBeNil)
+			So(o.Value, ShouldEqual, "v3")
+			So(breakerOpen, ShouldBeFalse)
+			So(numInvalidations(), ShouldEqual, 0)
+		})
+
+		Convey("replays the invalidations once memcache is back", func() {
+			fb.UnbreakFeatures(mcFeatures...)
+
+			// the stale entity is still in memcache.
+			_, err := mc.GetKey(c, mcKey)
+			So(err, ShouldBeNil)
+			So(getValue(), ShouldEqual, "v2")
+			So(breakerOpen, ShouldBeTrue)
+
+			clk.Add(CircuitBreakerRetryInterval)
+			So(getValue(), ShouldEqual, "v2")
+			So(breakerOpen, ShouldBeFalse)
+			So(numInvalidations(), ShouldEqual, 0)
+
+			itm, err := mc.GetKey(c, mcKey)
+			So(err, ShouldBeNil)
+			So(FlagValue(itm.Flags()), ShouldEqual, ItemHasData)
+		})
+
+		Convey("replays the invalidations recorded during the replay", func() {
+			fb.UnbreakFeatures(mcFeatures...)
+			mcKey2 := MakeMemcacheKey(0, ds.NewKey(c, "object", "", 2, nil))
+			So(mc.Set(underCtx, mc.NewItem(underCtx, mcKey2).SetValue([]byte("stale"))), ShouldBeNil)
+
+			recorded := false
+			fb.BreakFeaturesWithCallback(func(context.Context, string, ...interface{}) error {
+				if !recorded {
+					recorded = true
+					// The breaker is still open, so this records an invalidation.
+					So(ds.Put(c, &object{ID: 2, Value: "v1"}), ShouldBeNil)
+				}
+				return nil
+			}, "DeleteMulti")
+
+			clk.Add(CircuitBreakerRetryInterval)
+			So(getValue(), ShouldEqual, "v2")
+			So(recorded, ShouldBeTrue)
+			So(breakerOpen, ShouldBeFalse)
+			So(breakerPending, ShouldBeEmpty)
+			So(numInvalidations(), ShouldEqual, 0)
+
+			_, err := mc.GetKey(c, mcKey2)
+			So(err, ShouldEqual, mc.ErrCacheMiss)
+		})
+
+		Convey("ReplayInvalidations replays all invalidations", func() {
+			fb.UnbreakFeatures(mcFeatures...)
+			So(ReplayInvalidations(c), ShouldBeNil)
+			So(numInvalidations(), ShouldEqual, 0)
+			_, err := mc.GetKey(c, mcKey)
+			So(err, ShouldEqual, mc.ErrCacheMiss)
+		})
+	})
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"fmt"
+
+	ds "github.com/luci/gae/service/datastore"
+	mc "github.com/luci/gae/service/memcache"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+var dsEventHandlersKey = "holds []EventHandler"
+
+// EventType is the type of an Event.
+type EventType int
+
+// Types of events.
+const (
+	// EventHit is emitted when an entity is served from memcache.
+	EventHit EventType = iota + 1
+	// EventNegativeHit is emitted when memcache records that an entity doesn't
+	// exist.
+	EventNegativeHit
+	// EventRequestCacheHit is emitted when an entity (or its absence) is served
+	// from the request cache (see WithRequestCache).
+	EventRequestCacheHit
+	// EventMiss is emitted when an entity isn't in memcache. It's fetched from
+	// the datastore, and cached.
+	EventMiss
+	// EventLockContention is emitted when an entity is locked by another
+	// operation (a mutation, or a concurrent Get). It's fetched from the
+	// datastore, but not cached.
+	EventLockContention
+	// EventCASFailure is emitted when an entity fetched from the datastore
+	// couldn't be cached, because its lock changed in the meantime.
+	EventCASFailure
+	// EventMemcacheError is emitted when a memcache operation fails. Unless it's
+	// a lock Set (see DANGER ZONE in the package documentation), dscache
+	// degrades to using the datastore.
+	EventMemcacheError
+	// EventQueryHit is emitted when the result of a query is served from
+	// memcache (see AddQueryCacheFunctions).
+	EventQueryHit
+	// EventQueryMiss is emitted when the result of a query isn't in memcache.
+	EventQueryMiss
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventHit:
+		return "Hit"
+	case EventNegativeHit:
+		return "NegativeHit"
+	case EventRequestCacheHit:
+		return "RequestCacheHit"
+	case EventMiss:
+		return "Miss"
+	case EventLockContention:
+		return "LockContention"
+	case EventCASFailure:
+		return "CASFailure"
+	case EventMemcacheError:
+		return "MemcacheError"
+	case EventQueryHit:
+		return "QueryHit"
+	case EventQueryMiss:
+		return "QueryMiss"
+	default:
+		return fmt.Sprintf("UNKNOWN_EventType(%d)", int(t))
+	}
+}
+
+// Event describes something that the dscache filter did.
+type Event struct {
+	Type EventType
+
+	// Kind is the kind of the entity or of the query, if any.
+	Kind string
+	// Key is the key of the entity, if any.
+	Key *ds.Key
+
+	// Op is the name of the failed memcache operation (e.g. "Get"), for
+	// EventMemcacheError.
+	Op string
+	// Err is the error returned by memcache, for EventMemcacheError.
+	Err error
+}
+
+func (e *Event) String() string {
+	ret := e.Type.String()
+	switch {
+	case e.Key != nil:
+		ret += " " + e.Key.String()
+	case e.Kind != "":
+		ret += " " + e.Kind
+	}
+	if e.Op != "" {
+		ret += fmt.Sprintf(" %s: %s", e.Op, e.Err)
+	}
+	return ret
+}
+
+// EventHandler is called with every Event emitted by the dscache filter. It
+// may be called concurrently, and should be fast, since it's called inline.
+type EventHandler func(c context.Context, e *Event)
+
+// AddEventHandlers appends the provided handlers to the internal list of event
+// handlers. All of them are called for every event, in the order they were
+// added.
+//
+// nil handlers will cause a panic.
+func AddEventHandlers(c context.Context, handlers ...EventHandler) context.Context {
+	cur, _ := c.Value(&dsEventHandlersKey).([]EventHandler)
+	new := make([]EventHandler, 0, len(cur)+len(handlers))
+	for _, h := range handlers {
+		if h == nil {
+			panic("nil handler provided to AddEventHandlers")
+		}
+	}
+	return context.WithValue(c, &dsEventHandlersKey, append(append(new, cur...), handlers...))
+}
+
+func (s *supportContext) emit(e *Event) {
+	if len(s.eventHandlers) == 0 {
+		return
+	}
+	if e.Key != nil && e.Kind == "" {
+		e.Kind = e.Key.Kind()
+	}
+	for _, h := range s.eventHandlers {
+		h(s.c, e)
+	}
+}
+
+func (s *supportContext) emitKey(t EventType, key *ds.Key) {
+	if len(s.eventHandlers) > 0 {
+		s.emit(&Event{Type: t, Key: key})
+	}
+}
+
+// emitMemcacheError emits an EventMemcacheError for err, the error of a
+// memcache operation over the items of keys (which may be nil). If err is an
+// errors.MultiError, an event is emitted per failed item.
+//
+// The failure is also recorded by the circuit breaker.
+func (s *supportContext) emitMemcacheError(op string, err error, keys []*ds.Key) {
+	if err == nil {
+		return
+	}
+	s.memcacheFailed()
+	if len(s.eventHandlers) == 0 {
+		return
+	}
+	if me, ok := err.(errors.MultiError); ok && len(me) == len(keys) {
+		for i, err := range me {
+			if err != nil && err != mc.ErrCacheMiss {
+				s.emit(&Event{Type: EventMemcacheError, Key: keys[i], Op: op, Err: err})
+			}
+		}
+		return
+	}
+	s.emit(&Event{Type: EventMemcacheError, Op: op, Err: err})
+}
+
+// emitCASErrors emits an EventCASFailure (or an EventMemcacheError) for each
+// item of keys which CompareAndSwap failed to save.
+func (s *supportContext) emitCASErrors(err error, keys []*ds.Key) {
+	if len(s.eventHandlers) == 0 || err == nil {
+		return
+	}
+	errs, ok := err.(errors.MultiError)
+	if !ok || len(errs) != len(keys) {
+		if len(keys) != 1 {
+			s.emit(&Event{Type: EventMemcacheError, Op: "CompareAndSwap", Err: err})
+			return
+		}
+		errs = errors.MultiError{err}
+	}
+	for i, err := range errs {
+		switch err {
+		case nil:
+		case mc.ErrCASConflict, mc.ErrNotStored:
+			s.emitKey(EventCASFailure, keys[i])
+		default:
+			s.emit(&Event{Type: EventMemcacheError, Key: keys[i], Op: "CompareAndSwap", Err: err})
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/luci/gae/service/info"
+	mc "github.com/luci/gae/service/memcache"
+
+	"github.com/luci/luci-go/common/clock"
+	log "github.com/luci/luci-go/common/logging"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	evictionBoundLock = sync.RWMutex{}
+
+	// evictionBound is the maximum number of seconds that a cached entity may be
+	// retained, or 0 if it's unbounded. It is populated by getEvictionBound.
+	evictionBound = int64(0)
+
+	// evictionBoundNextCheck is the time at which getEvictionBound will sample
+	// the memcache statistics again.
+	evictionBoundNextCheck = time.Time{}
+)
+
+// getEvictionBound returns the maximum number of seconds that a cached entity
+// may be retained, or 0 if it's unbounded.
+//
+// If EvictionBoundEnabled is set, the bound is the age of access of the oldest
+// memcache item, or the time since the flush sentinel was written if it's
+// lower, but never less than LockTimeSeconds. It's recomputed once every
+// EvictionBoundCheckInterval.
+//
+// If memcache can't be reached, the previous bound is kept until the next
+// check.
+func getEvictionBound(c context.Context) int64 {
+	if !EvictionBoundEnabled {
+		return 0
+	}
+
+	now := clock.Now(c)
+
+	evictionBoundLock.RLock()
+	nextCheck := evictionBoundNextCheck
+	bound := evictionBound
+	evictionBoundLock.RUnlock()
+
+	if now.Before(nextCheck) {
+		return bound
+	}
+
+	evictionBoundLock.Lock()
+	defer evictionBoundLock.Unlock()
+	// just in case we raced
+	if now.Before(evictionBoundNextCheck) {
+		return evictionBound
+	}
+	evictionBoundNextCheck = now.Add(EvictionBoundCheckInterval)
+
+	// always go to the default namespace
+	c, err := info.Namespace(c, "")
+	if err != nil {
+		return evictionBound
+	}
+
+	stats, err := mc.Stats(c)
+	if err != nil {
+		(log.Fields{log.ErrorKey: err}).Warningf(c, "dscache: failed to get memcache statistics")
+		return evictionBound
+	}
+	sinceFlush, err := timeSinceFlush(c, now)
+	if err != nil {
+		(log.Fields{log.ErrorKey: err}).Warningf(c, "dscache: failed to check the flush sentinel")
+		return evictionBound
+	}
+
+	bound = stats.Oldest
+	if sinceFlush < bound {
+		bound = sinceFlush
+	}
+	if bound < int64(LockTimeSeconds) {
+		bound = int64(LockTimeSeconds)
+	}
+	evictionBound = bound
+	return evictionBound
+}
+
+// timeSinceFlush returns the number of seconds since the flush sentinel was
+// written. If it's missing, memcache was flushed (or the sentinel was evicted,
+// which is just as bad), so it's written again and 0 is returned.
+func timeSinceFlush(c context.Context, now time.Time) (int64, error) {
+	itm := mc.NewItem(c, SentinelKey)
+	switch err := mc.Get(c, itm); err {
+	case nil:
+		if len(itm.Value()) == 8 {
+			written := time.Unix(0, int64(binary.BigEndian.Uint64(itm.Value())))
+			if age := int64(now.Sub(written) / time.Second); age > 0 {
+				return age, nil
+			}
+			return 0, nil
+		}
+		log.Warningf(c, "dscache: bogus flush sentinel %q", itm.Value())
+	case mc.ErrCacheMiss:
+		log.Infof(c, "dscache: flush sentinel is missing, bounding the cache lifetime")
+	default:
+		return 0, err
+	}
+
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(now.UnixNano()))
+	if err := mc.Set(c, itm.SetValue(value).SetExpiration(0)); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// boundExpiration caps expSecs (where 0 is infinite) by bound (where 0 is
+// unbounded).
+func boundExpiration(expSecs, bound int64) int64 {
+	if bound > 0 && (expSecs <= 0 || expSecs > bound) {
+		return bound
+	}
+	return expSecs
+}
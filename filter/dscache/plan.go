@@ -108,9 +108,11 @@ func (d *dsCache) makeFetchPlan(f *facts) *plan {
 		case ItemHasLock:
 			if bytes.Equal(f.nonce, lockItm.Value()) {
 				// we have the lock
+				d.emitKey(EventMiss, getKey)
 				p.add(i, getKey, m, lockItm)
 			} else {
 				// someone else has the lock, don't save
+				d.emitKey(EventLockContention, getKey)
 				p.add(i, getKey, m, nil)
 			}
 
@@ -118,17 +120,21 @@ func (d *dsCache) makeFetchPlan(f *facts) *plan {
 			pmap, err := decodeItemValue(lockItm.Value(), d.KeyContext)
 			switch err {
 			case nil:
+				d.emitKey(EventHit, getKey)
 				p.decoded[i] = pmap
 			case ds.ErrNoSuchEntity:
+				d.emitKey(EventNegativeHit, getKey)
 				p.lme.Assign(i, ds.ErrNoSuchEntity)
 			default:
 				(logging.Fields{"error": err}).Warningf(d.c,
 					"dscache: error decoding %s, %s", lockItm.Key(), getKey)
+				d.emitKey(EventMiss, getKey)
 				p.add(i, getKey, m, nil)
 			}
 
 		default:
 			// have some other sort of object, or our AddMulti failed to add this item.
+			d.emitKey(EventMiss, getKey)
 			p.add(i, getKey, m, nil)
 		}
 	}
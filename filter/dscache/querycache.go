@@ -0,0 +1,314 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	ds "github.com/luci/gae/service/datastore"
+	"github.com/luci/gae/service/datastore/serialize"
+	mc "github.com/luci/gae/service/memcache"
+
+	log "github.com/luci/luci-go/common/logging"
+
+	"golang.org/x/net/context"
+)
+
+var dsQueryCacheFunctionsKey = "holds []QueryCacheFunction"
+
+// MaxQueryCacheKeys is the maximum number of keys in a cached query result.
+// Queries returning more keys than this are not cached.
+var MaxQueryCacheKeys = 1000
+
+const (
+	// QueryGenerationKeyFormat is the format string used to generate the memcache
+	// key of the generation of a kind. It's
+	//   gae:<version>:qgen:<base64_std_nopad(sha1(kind))>
+	QueryGenerationKeyFormat = "gae:" + MemcacheVersion + ":qgen:%s"
+
+	// QueryKeyFormat is the format string used to generate the memcache key of a
+	// cached query result. It's
+	//   gae:<version>:q:<base64_std_nopad(sha1(generation, query))>
+	QueryKeyFormat = "gae:" + MemcacheVersion + ":q:%s"
+)
+
+// errCursorUnavailable is returned by the cursor callbacks of cached query
+// results.
+var errCursorUnavailable = errors.New("dscache: cursors are not available for cached query results")
+
+// QueryCacheFunction is a user-controllable function which enables caching of
+// the results of queries over a kind. It should return ok=true if it
+// recognized the kind, and false otherwise.
+//
+// cacheSeconds is the number of seconds for which the result of a query is
+// cached. A value <= 0 disables query caching for the kind.
+//
+// Since mutations only invalidate the cached query results of kinds for which
+// query caching is enabled, the same QueryCacheFunctions must be installed in
+// every context which mutates those kinds.
+type QueryCacheFunction func(kind string) (cacheSeconds int64, ok bool)
+
+// AddQueryCacheFunctions appends the provided functions to the internal list
+// of query cache functions. They are evaluated in the same order as the
+// functions provided to AddShardFunctions.
+//
+// nil functions will cause a panic.
+func AddQueryCacheFunctions(c context.Context, fns ...QueryCacheFunction) context.Context {
+	cur, _ := c.Value(&dsQueryCacheFunctionsKey).([]QueryCacheFunction)
+	new := make([]QueryCacheFunction, 0, len(cur)+len(fns))
+	for _, fn := range fns {
+		if fn == nil {
+			panic("nil function provided to AddQueryCacheFunctions")
+		}
+	}
+	return context.WithValue(c, &dsQueryCacheFunctionsKey, append(append(new, fns...), cur...))
+}
+
+// MakeQueryGenerationKey generates the memcache key holding the generation of
+// the cached query results of kind. This is useful for debugging.
+func MakeQueryGenerationKey(kind string) string {
+	return fmt.Sprintf(QueryGenerationKeyFormat, hashBytes([]byte(kind)))
+}
+
+func hashBytes(data []byte) string {
+	dgst := sha1.Sum(data)
+	return base64.StdEncoding.EncodeToString(dgst[:])[:base64.StdEncoding.EncodedLen(len(dgst))-Sha1B64Padding]
+}
+
+func (s *supportContext) queryCacheSeconds(kind string) int64 {
+	if kind == InvalidationKind {
+		return 0
+	}
+	ret := int64(0)
+	for _, fn := range s.queryCacheFns {
+		if secs, ok := fn(kind); ok {
+			ret = secs
+		}
+	}
+	return ret
+}
+
+// mkQueryGenerationItems returns the memcache items which invalidate the
+// cached query results of the kinds of keys.
+func (s *supportContext) mkQueryGenerationItems(keys []*ds.Key) ([]mc.Item, []string) {
+	if len(s.queryCacheFns) == 0 {
+		return nil, nil
+	}
+
+	var (
+		items  []mc.Item
+		mcKeys []string
+		seen   = map[string]struct{}{}
+	)
+	for _, k := range keys {
+		kind := k.Kind()
+		if _, ok := seen[kind]; ok {
+			continue
+		}
+		seen[kind] = struct{}{}
+		if s.queryCacheSeconds(kind) <= 0 {
+			continue
+		}
+		mcKey := MakeQueryGenerationKey(kind)
+		items = append(items, mc.NewItem(s.c, mcKey).SetValue(s.generateNonce()))
+		mcKeys = append(mcKeys, mcKey)
+	}
+	return items, mcKeys
+}
+
+// queryGeneration returns the current generation of the cached query results
+// of kind, creating one if needed.
+func (s *supportContext) queryGeneration(kind string) ([]byte, error) {
+	itm := mc.NewItem(s.c, MakeQueryGenerationKey(kind))
+	switch err := mc.Get(s.c, itm); err {
+	case nil:
+		return itm.Value(), nil
+	case mc.ErrCacheMiss:
+	default:
+		s.emitMemcacheError("Get", err, nil)
+		return nil, err
+	}
+
+	// Adding fails if someone else added a generation in the meantime, so get it
+	// back.
+	itm.SetValue(s.generateNonce())
+	if err := mc.Add(s.c, itm); err != nil && err != mc.ErrNotStored {
+		s.emitMemcacheError("Add", err, nil)
+		return nil, err
+	}
+	if err := mc.Get(s.c, itm); err != nil {
+		s.emitMemcacheError("Get", err, nil)
+		return nil, err
+	}
+	return itm.Value(), nil
+}
+
+// keysOnlyQuery returns the keys-only version of q, or nil if q's results
+// can't be cached.
+func keysOnlyQuery(q *ds.FinalizedQuery) *ds.FinalizedQuery {
+	if q.Kind() == "" || len(q.Project()) > 0 {
+		return nil
+	}
+	if start, end := q.Bounds(); start != nil || end != nil {
+		return nil
+	}
+	if q.KeysOnly() {
+		return q
+	}
+	kq, err := q.Original().KeysOnly(true).Finalize()
+	if err != nil {
+		return nil
+	}
+	return kq
+}
+
+func (d *dsCache) Run(q *ds.FinalizedQuery, cb ds.RawRunCB) error {
+	var (
+		kq   *ds.FinalizedQuery
+		secs int64
+	)
+	if len(d.queryCacheFns) > 0 {
+		if kq = keysOnlyQuery(q); kq != nil {
+			secs = d.queryCacheSeconds(kq.Kind())
+		}
+	}
+	if secs <= 0 || d.bypassMemcache() {
+		return d.RawInterface.Run(q, cb)
+	}
+
+	gen, err := d.queryGeneration(kq.Kind())
+	if err != nil {
+		(log.Fields{log.ErrorKey: err}).Debugf(d.c, "dscache: Run: query generation")
+		return d.RawInterface.Run(q, cb)
+	}
+
+	buf := bytes.Buffer{}
+	_, _ = buf.Write(gen)
+	_ = buf.WriteByte(0)
+	_, _ = fmt.Fprintf(&buf, "%s\x00%s\x00%s", d.AppID, d.Namespace, kq.GQL())
+	if kq.EventuallyConsistent() {
+		_, _ = buf.WriteString(" EVENTUAL")
+	}
+	itm := mc.NewItem(d.c, fmt.Sprintf(QueryKeyFormat, hashBytes(buf.Bytes())))
+
+	var keys []*ds.Key
+	switch err := mc.Get(d.c, itm); err {
+	case nil:
+		if keys, err = decodeQueryKeys(itm.Value(), d.KeyContext); err != nil {
+			(log.Fields{log.ErrorKey: err}).Warningf(d.c, "dscache: error decoding query result %s", itm.Key())
+			keys = nil
+		}
+	case mc.ErrCacheMiss:
+	default:
+		(log.Fields{log.ErrorKey: err}).Debugf(d.c, "dscache: Run: memcache.Get")
+		d.emitMemcacheError("Get", err, nil)
+	}
+
+	if keys != nil {
+		d.emit(&Event{Type: EventQueryHit, Kind: kq.Kind()})
+	} else {
+		d.emit(&Event{Type: EventQueryMiss, Kind: kq.Kind()})
+		var ok bool
+		if keys, ok = d.runKeysOnly(kq); !ok {
+			return d.RawInterface.Run(q, cb)
+		}
+		if data := encodeQueryKeys(keys); len(data) <= internalValueSizeLimit {
+			secs = boundExpiration(secs, getEvictionBound(d.c))
+			itm.SetValue(data).SetExpiration(time.Duration(secs) * time.Second)
+			if err := mc.Set(d.c, itm); err != nil {
+				(log.Fields{log.ErrorKey: err}).Debugf(d.c, "dscache: Run: memcache.Set")
+				d.emitMemcacheError("Set", err, nil)
+			}
+		}
+	}
+
+	return d.serveKeys(q, keys, cb)
+}
+
+// runKeysOnly runs the keys-only query kq. It returns false if the query
+// failed, or returned too many keys to be cached.
+func (d *dsCache) runKeysOnly(kq *ds.FinalizedQuery) ([]*ds.Key, bool) {
+	keys := []*ds.Key{}
+	tooMany := false
+	err := d.RawInterface.Run(kq, func(k *ds.Key, _ ds.PropertyMap, _ ds.CursorCB) error {
+		if len(keys) >= MaxQueryCacheKeys {
+			tooMany = true
+			return ds.Stop
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil && err != ds.Stop {
+		(log.Fields{log.ErrorKey: err}).Debugf(d.c, "dscache: Run: keys-only query")
+		return nil, false
+	}
+	return keys, !tooMany
+}
+
+// serveKeys runs cb for the results of q, given the keys it returned. The
+// entities are fetched through the cache.
+func (d *dsCache) serveKeys(q *ds.FinalizedQuery, keys []*ds.Key, cb ds.RawRunCB) error {
+	noCursor := func() (ds.Cursor, error) { return nil, errCursorUnavailable }
+
+	if q.KeysOnly() {
+		for _, k := range keys {
+			if err := cb(k, nil, noCursor); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var cbErr error
+	i := 0
+	err := d.GetMulti(keys, nil, func(pm ds.PropertyMap, err error) error {
+		k := keys[i]
+		i++
+
+		switch err {
+		case nil:
+		case ds.ErrNoSuchEntity:
+			// Deleted since the query result was cached.
+			return nil
+		default:
+			return err
+		}
+		if cbErr = cb(k, pm, noCursor); cbErr != nil {
+			return cbErr
+		}
+		return nil
+	})
+	if cbErr != nil {
+		return cbErr
+	}
+	return err
+}
+
+func encodeQueryKeys(keys []*ds.Key) []byte {
+	buf := bytes.Buffer{}
+	for _, k := range keys {
+		// errs can't happen, since we're using a byte buffer.
+		_ = serialize.WriteKey(&buf, serialize.WithoutContext, k)
+	}
+	return buf.Bytes()
+}
+
+func decodeQueryKeys(data []byte, kc ds.KeyContext) ([]*ds.Key, error) {
+	buf := bytes.NewBuffer(data)
+	keys := []*ds.Key{}
+	for buf.Len() > 0 {
+		k, err := serialize.ReadKey(buf, serialize.WithoutContext, kc)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
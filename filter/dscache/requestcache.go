@@ -0,0 +1,240 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package dscache
+
+import (
+	"container/list"
+	"sync"
+
+	ds "github.com/luci/gae/service/datastore"
+	"github.com/luci/gae/service/datastore/serialize"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultRequestCacheSize is the number of entities kept by a request cache
+// installed with a non-positive size.
+const DefaultRequestCacheSize = 1000
+
+var requestCacheKey = "holds a *requestCache"
+
+// WithRequestCache installs an in-memory (per-request) cache in the context,
+// which sits in front of memcache for the dscache filter.
+//
+// The request cache holds at most maxEntries entities (or
+// DefaultRequestCacheSize if maxEntries <= 0), evicting the least recently
+// used ones. It's only consulted by the dscache filter, for entities which
+// would otherwise be cached in memcache.
+//
+// The cache belongs to the returned context and to all contexts derived from
+// it, so it should be installed once per request (e.g. right after
+// FilterRDS). It is safe for concurrent use.
+func WithRequestCache(c context.Context, maxEntries int) context.Context {
+	if maxEntries <= 0 {
+		maxEntries = DefaultRequestCacheSize
+	}
+	return context.WithValue(c, &requestCacheKey, newRequestCache(maxEntries))
+}
+
+func getRequestCache(c context.Context) *requestCache {
+	rc, _ := c.Value(&requestCacheKey).(*requestCache)
+	return rc
+}
+
+// requestCacheEntry is a cached Get result: either an entity, or
+// ErrNoSuchEntity.
+type requestCacheEntry struct {
+	key string
+	pm  ds.PropertyMap
+	err error
+}
+
+// requestCache is a bounded LRU cache of Get results.
+type requestCache struct {
+	sync.Mutex
+
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List // of *requestCacheEntry, most recently used first
+
+	// generation is incremented on every invalidation. Get results fetched
+	// while it changed may be stale, and are not cached.
+	generation uint64
+}
+
+func newRequestCache(maxEntries int) *requestCache {
+	return &requestCache{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+func requestCacheKeyFor(k *ds.Key) string {
+	return string(serialize.ToBytes(k))
+}
+
+// view returns a new empty cache of the same size, used by transactions.
+func (rc *requestCache) view() *requestCache {
+	return newRequestCache(rc.maxEntries)
+}
+
+func (rc *requestCache) get(key string) (requestCacheEntry, bool) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	elem, ok := rc.entries[key]
+	if !ok {
+		return requestCacheEntry{}, false
+	}
+	rc.lru.MoveToFront(elem)
+	ent := *elem.Value.(*requestCacheEntry)
+	ent.pm = clonePropertyMap(ent.pm)
+	return ent, true
+}
+
+func (rc *requestCache) currentGeneration() uint64 {
+	rc.Lock()
+	defer rc.Unlock()
+	return rc.generation
+}
+
+// add caches a Get result, unless the cache was invalidated since generation.
+func (rc *requestCache) add(key string, pm ds.PropertyMap, err error, generation uint64) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	if rc.generation == generation {
+		rc.addLocked(key, pm, err)
+	}
+}
+
+func (rc *requestCache) addLocked(key string, pm ds.PropertyMap, err error) {
+	if elem, ok := rc.entries[key]; ok {
+		ent := elem.Value.(*requestCacheEntry)
+		ent.pm, ent.err = pm, err
+		rc.lru.MoveToFront(elem)
+		return
+	}
+
+	rc.entries[key] = rc.lru.PushFront(&requestCacheEntry{key, pm, err})
+	for rc.lru.Len() > rc.maxEntries {
+		oldest := rc.lru.Back()
+		rc.lru.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*requestCacheEntry).key)
+	}
+}
+
+func (rc *requestCache) invalidate(keys []*ds.Key) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	rc.generation++
+	for _, k := range keys {
+		if k.IsIncomplete() {
+			continue
+		}
+		rc.invalidateLocked(requestCacheKeyFor(k))
+	}
+}
+
+func (rc *requestCache) invalidateLocked(key string) {
+	if elem, ok := rc.entries[key]; ok {
+		rc.lru.Remove(elem)
+		delete(rc.entries, key)
+	}
+}
+
+// merge applies the view of a committed transaction: the keys mutated by the
+// transaction are invalidated, and the entities read by it are cached.
+func (rc *requestCache) merge(view *requestCache, mutated map[string]struct{}) {
+	view.Lock()
+	defer view.Unlock()
+	rc.Lock()
+	defer rc.Unlock()
+
+	rc.generation++
+	for key := range mutated {
+		rc.invalidateLocked(key)
+	}
+	// Oldest first, so that the LRU order of the view is preserved.
+	for elem := view.lru.Back(); elem != nil; elem = elem.Prev() {
+		ent := elem.Value.(*requestCacheEntry)
+		if _, ok := mutated[ent.key]; !ok {
+			rc.addLocked(ent.key, ent.pm, ent.err)
+		}
+	}
+}
+
+// getMulti serves the cacheable keys from rc, and the other ones from next.
+//
+// The results obtained from next for cacheable keys are added to rc.
+func (rc *requestCache) getMulti(sc *supportContext, keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMultiCB,
+	next func([]*ds.Key, ds.MultiMetaGetter, ds.GetMultiCB) error) error {
+
+	pms := make([]ds.PropertyMap, len(keys))
+	errs := make([]error, len(keys))
+	rcKeys := make([]string, len(keys))
+
+	var (
+		idxMap      []int
+		toGet       []*ds.Key
+		toGetMeta   ds.MultiMetaGetter
+		hasMetadata = metas != nil
+	)
+	for i, k := range keys {
+		if sc.cacheable(k, metas.GetSingle(i)) {
+			rcKeys[i] = requestCacheKeyFor(k)
+			if ent, ok := rc.get(rcKeys[i]); ok {
+				sc.emitKey(EventRequestCacheHit, k)
+				pms[i], errs[i] = ent.pm, ent.err
+				continue
+			}
+		}
+		idxMap = append(idxMap, i)
+		toGet = append(toGet, k)
+		if hasMetadata {
+			toGetMeta = append(toGetMeta, metas.GetSingle(i))
+		}
+	}
+
+	if len(toGet) > 0 {
+		generation := rc.currentGeneration()
+		j := 0
+		err := next(toGet, toGetMeta, func(pm ds.PropertyMap, err error) error {
+			i := idxMap[j]
+			j++
+
+			pms[i], errs[i] = pm, err
+			if rcKeys[i] != "" && (err == nil || err == ds.ErrNoSuchEntity) {
+				rc.add(rcKeys[i], clonePropertyMap(pm), err, generation)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range keys {
+		if err := cb(pms[i], errs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clonePropertyMap returns a shallow copy of pm, so that callers can't modify
+// the cached map.
+func clonePropertyMap(pm ds.PropertyMap) ds.PropertyMap {
+	if pm == nil {
+		return nil
+	}
+	ret := make(ds.PropertyMap, len(pm))
+	for k, v := range pm {
+		ret[k] = v
+	}
+	return ret
+}
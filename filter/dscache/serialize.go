@@ -7,6 +7,7 @@ package dscache
 import (
 	"bytes"
 	"compress/zlib"
+	"fmt"
 	"io/ioutil"
 
 	ds "github.com/luci/gae/service/datastore"
@@ -16,13 +17,8 @@ import (
 func encodeItemValue(pm ds.PropertyMap) []byte {
 	pm, _ = pm.Save(false)
 
-	buf := bytes.Buffer{}
-	// errs can't happen, since we're using a byte buffer.
-	_ = buf.WriteByte(byte(NoCompression))
-	_ = serialize.WritePropertyMap(&buf, serialize.WithoutContext, pm)
-
-	data := buf.Bytes()
-	if buf.Len() > CompressionThreshold {
+	data := encodeUncompressed(pm)
+	if len(data) > CompressionThreshold {
 		buf2 := bytes.NewBuffer(make([]byte, 0, len(data)))
 		_ = buf2.WriteByte(byte(ZlibCompression))
 		writer := zlib.NewWriter(buf2)
@@ -34,6 +30,14 @@ func encodeItemValue(pm ds.PropertyMap) []byte {
 	return data
 }
 
+func encodeUncompressed(pm ds.PropertyMap) []byte {
+	buf := bytes.Buffer{}
+	// errs can't happen, since we're using a byte buffer.
+	_ = buf.WriteByte(byte(NoCompression))
+	_ = serialize.WritePropertyMap(&buf, serialize.WithoutContext, pm)
+	return buf.Bytes()
+}
+
 func decodeItemValue(val []byte, kc ds.KeyContext) (ds.PropertyMap, error) {
 	if len(val) == 0 {
 		return nil, ds.ErrNoSuchEntity
@@ -44,7 +48,9 @@ func decodeItemValue(val []byte, kc ds.KeyContext) (ds.PropertyMap, error) {
 		return nil, err
 	}
 
-	if CompressionType(compTypeByte) == ZlibCompression {
+	switch compType := CompressionType(compTypeByte); compType {
+	case NoCompression:
+	case ZlibCompression:
 		reader, err := zlib.NewReader(buf)
 		if err != nil {
 			return nil, err
@@ -55,6 +61,12 @@ func decodeItemValue(val []byte, kc ds.KeyContext) (ds.PropertyMap, error) {
 			return nil, err
 		}
 		buf = bytes.NewBuffer(data)
+	default:
+		rc := codecByType(compType)
+		if rc == nil {
+			return nil, fmt.Errorf("dscache: no codec registered for %s", compType)
+		}
+		return rc.codec.Decode(buf.Bytes(), kc)
 	}
 	return serialize.ReadPropertyMap(buf, serialize.WithoutContext, kc)
 }
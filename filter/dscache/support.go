@@ -24,9 +24,19 @@ type supportContext struct {
 	c            context.Context
 	mr           mathrand.Rand
 	shardsForKey []ShardFunction
+
+	queryCacheFns []QueryCacheFunction
+	codecFns      []CodecFunction
+	eventHandlers []EventHandler
+
+	// rc is the request cache, or nil if there is none.
+	rc *requestCache
 }
 
 func (s *supportContext) numShards(k *ds.Key) int {
+	if k.Kind() == InvalidationKind {
+		return 0
+	}
 	ret := DefaultShards
 	for _, fn := range s.shardsForKey {
 		if amt, ok := fn(k); ok {
@@ -42,17 +52,19 @@ func (s *supportContext) numShards(k *ds.Key) int {
 	return ret
 }
 
+// cacheable returns true if the entity with the given key and metadata may be
+// cached at all.
+func (s *supportContext) cacheable(key *ds.Key, mg ds.MetaGetter) bool {
+	return ds.GetMetaDefault(mg, CacheEnableMeta, true).(bool) && s.numShards(key) > 0
+}
+
 func (s *supportContext) mkRandKeys(keys []*ds.Key, metas ds.MultiMetaGetter) []string {
 	ret := []string(nil)
 	for i, key := range keys {
-		mg := metas.GetSingle(i)
-		if !ds.GetMetaDefault(mg, CacheEnableMeta, true).(bool) {
+		if !s.cacheable(key, metas.GetSingle(i)) {
 			continue
 		}
 		shards := s.numShards(key)
-		if shards == 0 {
-			continue
-		}
 		if ret == nil {
 			ret = make([]string, len(keys))
 		}
@@ -87,22 +99,47 @@ func (s *supportContext) mkAllKeys(keys []*ds.Key) []string {
 }
 
 func (s *supportContext) mutation(keys []*ds.Key, f func() error) error {
+	if s.rc != nil {
+		// Invalidate both before and after the mutation, so that concurrent Gets
+		// can't cache the old value.
+		s.rc.invalidate(keys)
+		defer s.rc.invalidate(keys)
+	}
+
 	lockItems, lockKeys := s.mkAllLockItems(keys)
-	if lockItems == nil {
+	genItems, genKeys := s.mkQueryGenerationItems(keys)
+	lockItems, lockKeys = append(lockItems, genItems...), append(lockKeys, genKeys...)
+	if len(lockItems) == 0 {
+		return f()
+	}
+	if s.bypassMemcache() {
+		if err := s.recordInvalidation(lockKeys); err != nil {
+			return err
+		}
 		return f()
 	}
 	if err := mc.Set(s.c, lockItems...); err != nil {
+		s.emitMemcacheError("Set", err, nil)
+		if s.bypassMemcache() {
+			// the circuit breaker just opened.
+			if err := s.recordInvalidation(lockKeys); err != nil {
+				return err
+			}
+			return f()
+		}
 		// this is a hard failure. No mutation can occur if we're unable to set
 		// locks out. See "DANGER ZONE" in the docs.
 		(log.Fields{log.ErrorKey: err}).Errorf(
 			s.c, "dscache: HARD FAILURE: supportContext.mutation(): mc.SetMulti")
 		return err
 	}
+	s.memcacheSucceeded()
 	err := f()
 	if err == nil {
 		if err := errors.Filter(mc.Delete(s.c, lockKeys...), mc.ErrCacheMiss); err != nil {
 			(log.Fields{log.ErrorKey: err}).Debugf(
 				s.c, "dscache: mc.Delete")
+			s.emitMemcacheError("Delete", err, nil)
 		}
 	}
 	return err
@@ -0,0 +1,154 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package featureBreaker
+
+import (
+	"sync"
+	"time"
+
+	ds "github.com/luci/gae/service/datastore"
+
+	"github.com/luci/luci-go/common/clock"
+	"github.com/luci/luci-go/common/data/rand/mathrand"
+
+	"golang.org/x/net/context"
+)
+
+// Predicate selects the calls to which a BreakFeatureCallback applies. See
+// When.
+type Predicate func(feature string, args ...interface{}) bool
+
+// FailWithProbability returns a BreakFeatureCallback which fails calls with
+// err, with a probability p in [0, 1].
+//
+// The randomness comes from the mathrand generator of the context of the
+// filtered service, so the failures are deterministic if it's seeded (see
+// mathrand.Set).
+func FailWithProbability(p float64, err error) BreakFeatureCallback {
+	mustHaveError(err)
+	return func(c context.Context, _ string, _ ...interface{}) error {
+		if mathrand.Float64(c) < p {
+			return err
+		}
+		return nil
+	}
+}
+
+// FailAfter returns a BreakFeatureCallback which lets the first n calls
+// through, and fails all the following calls with err.
+//
+// The calls are counted across all of the features the callback is registered
+// for.
+func FailAfter(n int, err error) BreakFeatureCallback {
+	mustHaveError(err)
+	lock := sync.Mutex{}
+	return func(context.Context, string, ...interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if n > 0 {
+			n--
+			return nil
+		}
+		return err
+	}
+}
+
+// Sequence returns a BreakFeatureCallback which fails the i-th call with
+// errs[i], or lets it through if errs[i] is nil. Once errs is exhausted, all
+// the following calls are let through.
+//
+// The calls are counted across all of the features the callback is registered
+// for.
+func Sequence(errs ...error) BreakFeatureCallback {
+	lock := sync.Mutex{}
+	return func(context.Context, string, ...interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if len(errs) == 0 {
+			return nil
+		}
+		err := errs[0]
+		errs = errs[1:]
+		return err
+	}
+}
+
+// Latency returns a BreakFeatureCallback which delays calls by d, using the
+// clock of the context of the filtered service (so a testclock doesn't
+// actually sleep), and then lets them through. If the context is canceled in
+// the meantime, the call fails with the context's error.
+func Latency(d time.Duration) BreakFeatureCallback {
+	return func(c context.Context, _ string, _ ...interface{}) error {
+		clock.Sleep(c, d)
+		return c.Err()
+	}
+}
+
+// Chain returns a BreakFeatureCallback which calls each of cbs in order, until
+// one of them fails the call. e.g.
+//   Chain(Latency(time.Second), FailWithProbability(0.5, err))
+//
+// delays all calls, and then fails half of them.
+//
+// nil callbacks will cause a panic.
+func Chain(cbs ...BreakFeatureCallback) BreakFeatureCallback {
+	for _, cb := range cbs {
+		if cb == nil {
+			panic("nil callback provided to Chain")
+		}
+	}
+	return func(c context.Context, feature string, args ...interface{}) error {
+		for _, cb := range cbs {
+			if err := cb(c, feature, args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// When returns a BreakFeatureCallback which applies cb to the calls selected
+// by pred, and lets all the other calls through. The other calls don't reach
+// cb, so they aren't counted by e.g. FailAfter.
+func When(pred Predicate, cb BreakFeatureCallback) BreakFeatureCallback {
+	if pred == nil || cb == nil {
+		panic("nil predicate or callback provided to When")
+	}
+	return func(c context.Context, feature string, args ...interface{}) error {
+		if pred(feature, args...) {
+			return cb(c, feature, args...)
+		}
+		return nil
+	}
+}
+
+// ForKind returns a Predicate which selects the datastore calls involving an
+// entity of the given kind (in AllocateIDs, GetMulti, PutMulti and
+// DeleteMulti), or a query of that kind (in Run and Count).
+func ForKind(kind string) Predicate {
+	return func(_ string, args ...interface{}) bool {
+		for _, arg := range args {
+			switch x := arg.(type) {
+			case []*ds.Key:
+				for _, k := range x {
+					if k.Kind() == kind {
+						return true
+					}
+				}
+			case *ds.FinalizedQuery:
+				if x.Kind() == kind {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+func mustHaveError(err error) {
+	if err == nil {
+		panic("featureBreaker: callbacks need a non-nil error")
+	}
+}
@@ -7,4 +7,9 @@
 //
 // In particular, it can be used to cause specific service methods to start
 // returning specific errors during the test.
+//
+// Methods may also be made flaky (FailWithProbability, FailAfter, Sequence) or
+// slow (Latency), for some of their arguments only (When). Since these use the
+// clock and the mathrand generator of the context, retry logic can be tested
+// deterministically.
 package featureBreaker
@@ -10,6 +10,8 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+
+	"golang.org/x/net/context"
 )
 
 // FeatureBreaker is the state-access interface for all Filter* functions in
@@ -29,12 +31,30 @@ import (
 // You may also pass nil as the error for BreakFeatures, and the fake will
 // provide the DefaultError which you passed to the Filter function.
 //
+// Features may also be broken dynamically with BreakFeaturesWithCallback, e.g.
+//   fb.BreakFeaturesWithCallback(
+//     FailWithProbability(0.1, memcache.ErrServerError), "Add", "Set")
+//
+// would make 10% of the calls fail.
+//
 // This interface can only break features which return errors.
 type FeatureBreaker interface {
 	BreakFeatures(err error, feature ...string)
+	BreakFeaturesWithCallback(cb BreakFeatureCallback, feature ...string)
 	UnbreakFeatures(feature ...string)
 }
 
+// BreakFeatureCallback decides, on every call to a feature it's registered
+// for, whether that call fails.
+//
+// It receives the context of the filtered service, the name of the feature and
+// the arguments of the call, without its callbacks (e.g. the keys and the
+// MultiMetaGetter of a datastore GetMulti). It returns the error to fail the
+// call with, or nil to let the call through.
+//
+// It may be called concurrently.
+type BreakFeatureCallback func(c context.Context, feature string, args ...interface{}) error
+
 // ErrBrokenFeaturesBroken is returned from RunIfNotBroken when BrokenFeatures
 // itself isn't working correctly.
 var ErrBrokenFeaturesBroken = errors.New("featureBreaker: Unable to retrieve caller information")
@@ -42,7 +62,7 @@ var ErrBrokenFeaturesBroken = errors.New("featureBreaker: Unable to retrieve cal
 type state struct {
 	sync.Mutex
 
-	broken map[string]error
+	broken map[string]BreakFeatureCallback
 
 	// defaultError is the default error to return when you call
 	// BreakFeatures(nil, ...). If this is unset and the user calls BreakFeatures
@@ -52,7 +72,7 @@ type state struct {
 
 func newState(dflt error) *state {
 	return &state{
-		broken:       map[string]error{},
+		broken:       map[string]BreakFeatureCallback{},
 		defaultError: dflt,
 	}
 }
@@ -68,7 +88,33 @@ func (s *state) BreakFeatures(err error, feature ...string) {
 	s.Lock()
 	defer s.Unlock()
 	for _, f := range feature {
-		s.broken[f] = err
+		err := err
+		switch {
+		case err != nil:
+		case s.defaultError != nil:
+			err = s.defaultError
+		default:
+			err = fmt.Errorf("feature %q is broken", f)
+		}
+		s.broken[f] = func(context.Context, string, ...interface{}) error { return err }
+	}
+}
+
+// BreakFeaturesWithCallback is like BreakFeatures, except that cb decides
+// whether each call to the features fails, and with which error. The callbacks
+// in this package (e.g. FailWithProbability) may be used to inject failures and
+// latency.
+//
+// nil callbacks will cause a panic.
+func (s *state) BreakFeaturesWithCallback(cb BreakFeatureCallback, feature ...string) {
+	if cb == nil {
+		panic("nil callback provided to BreakFeaturesWithCallback")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, f := range feature {
+		s.broken[f] = cb
 	}
 }
 
@@ -82,7 +128,10 @@ func (s *state) UnbreakFeatures(feature ...string) {
 	}
 }
 
-func (s *state) run(f func() error) error {
+// run calls f, unless the feature of the caller is broken. c is the context of
+// the filtered service, and args are the arguments of the call, which are
+// passed to the BreakFeatureCallback of the feature.
+func (s *state) run(c context.Context, f func() error, args ...interface{}) error {
 	if s.noBrokenFeatures() {
 		return f()
 	}
@@ -93,18 +142,13 @@ func (s *state) run(f func() error) error {
 	name := fullNameParts[len(fullNameParts)-1]
 
 	s.Lock()
-	err, ok := s.broken[name]
-	dflt := s.defaultError
+	cb, ok := s.broken[name]
 	s.Unlock()
 
 	if ok {
-		if err != nil {
+		if err := cb(c, name, args...); err != nil {
 			return err
 		}
-		if dflt != nil {
-			return dflt
-		}
-		return fmt.Errorf("feature %q is broken", name)
 	}
 
 	return f()
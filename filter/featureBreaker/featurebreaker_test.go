@@ -5,10 +5,15 @@
 package featureBreaker
 
 import (
+	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/luci/gae/impl/memory"
 	ds "github.com/luci/gae/service/datastore"
+	"github.com/luci/luci-go/common/clock"
+	"github.com/luci/luci-go/common/clock/testclock"
+	"github.com/luci/luci-go/common/data/rand/mathrand"
 	"github.com/luci/luci-go/common/errors"
 
 	"golang.org/x/net/context"
@@ -64,3 +69,100 @@ func TestBrokenFeatures(t *testing.T) {
 		})
 	})
 }
+
+func TestBreakFeatureCallbacks(t *testing.T) {
+	t.Parallel()
+
+	e := errors.New("default err")
+
+	Convey("BreakFeaturesWithCallback", t, func() {
+		c := mathrand.Set(memory.Use(context.Background()), rand.New(rand.NewSource(1)))
+		c, bf := FilterRDS(c, nil)
+
+		vals := []ds.PropertyMap{{
+			"$key": ds.MkPropertyNI(ds.NewKey(c, "Wut", "", 1, nil)),
+		}}
+		get := func() error {
+			err := ds.Get(c, vals)
+			if errors.SingleError(err) == ds.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		failures := func(n int) (ret []bool) {
+			for i := 0; i < n; i++ {
+				ret = append(ret, get() != nil)
+			}
+			return
+		}
+
+		Convey("can see the arguments of the call", func() {
+			bf.BreakFeaturesWithCallback(func(_ context.Context, feature string, args ...interface{}) error {
+				So(feature, ShouldEqual, "GetMulti")
+				So(args[0], ShouldResemble, []*ds.Key{ds.NewKey(c, "Wut", "", 1, nil)})
+				return e
+			}, "GetMulti")
+			So(get(), ShouldEqual, e)
+		})
+
+		Convey("FailWithProbability", func() {
+			bf.BreakFeaturesWithCallback(FailWithProbability(0, e), "GetMulti")
+			So(failures(10), ShouldNotContain, true)
+
+			bf.BreakFeaturesWithCallback(FailWithProbability(1, e), "GetMulti")
+			So(failures(10), ShouldNotContain, false)
+
+			Convey("is deterministic with a seeded mathrand", func() {
+				bf.BreakFeaturesWithCallback(FailWithProbability(0.5, e), "GetMulti")
+
+				c = mathrand.Set(c, rand.New(rand.NewSource(42)))
+				first := failures(20)
+				So(first, ShouldContain, true)
+				So(first, ShouldContain, false)
+
+				c = mathrand.Set(c, rand.New(rand.NewSource(42)))
+				So(failures(20), ShouldResemble, first)
+			})
+		})
+
+		Convey("FailAfter", func() {
+			bf.BreakFeaturesWithCallback(FailAfter(2, e), "GetMulti")
+			So(failures(4), ShouldResemble, []bool{false, false, true, true})
+		})
+
+		Convey("Sequence", func() {
+			bf.BreakFeaturesWithCallback(Sequence(nil, e, e, nil), "GetMulti")
+			So(failures(6), ShouldResemble, []bool{false, true, true, false, false, false})
+		})
+
+		Convey("Latency", func() {
+			now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+			c, tc := testclock.UseTime(c, now)
+			tc.SetTimerCallback(func(d time.Duration, _ clock.Timer) { tc.Add(d) })
+
+			bf.BreakFeaturesWithCallback(Chain(Latency(time.Minute), Sequence(nil, e)), "GetMulti")
+			So(errors.SingleError(ds.Get(c, vals)), ShouldEqual, ds.ErrNoSuchEntity)
+			So(ds.Get(c, vals), ShouldEqual, e)
+			So(clock.Now(c), ShouldResemble, now.Add(2*time.Minute))
+		})
+
+		Convey("When/ForKind", func() {
+			bf.BreakFeaturesWithCallback(When(ForKind("Wut"), FailAfter(1, e)), "GetMulti", "PutMulti")
+
+			So(get(), ShouldBeNil)
+			So(get(), ShouldEqual, e)
+
+			// other kinds aren't affected, nor counted.
+			So(ds.Put(c, ds.PropertyMap{
+				"$key": ds.MkPropertyNI(ds.NewKey(c, "Other", "", 1, nil)),
+			}), ShouldBeNil)
+			So(ds.Put(c, vals), ShouldEqual, e)
+		})
+
+		Convey("can be unbroken", func() {
+			bf.BreakFeaturesWithCallback(FailWithProbability(1, e), "GetMulti")
+			bf.UnbreakFeatures("GetMulti")
+			So(get(), ShouldBeNil)
+		})
+	})
+}
@@ -13,64 +13,65 @@ import (
 type dsState struct {
 	*state
 
+	c   context.Context
 	rds ds.RawInterface
 }
 
 func (r *dsState) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
-	return r.run(func() error {
+	return r.run(r.c, func() error {
 		return r.rds.AllocateIDs(keys, cb)
-	})
+	}, keys)
 }
 
 func (r *dsState) DecodeCursor(s string) (ds.Cursor, error) {
 	curs := ds.Cursor(nil)
-	err := r.run(func() (err error) {
+	err := r.run(r.c, func() (err error) {
 		curs, err = r.rds.DecodeCursor(s)
 		return
-	})
+	}, s)
 	return curs, err
 }
 
 func (r *dsState) Run(q *ds.FinalizedQuery, cb ds.RawRunCB) error {
-	return r.run(func() error {
+	return r.run(r.c, func() error {
 		return r.rds.Run(q, cb)
-	})
+	}, q)
 }
 
 func (r *dsState) Count(q *ds.FinalizedQuery) (int64, error) {
 	count := int64(0)
-	err := r.run(func() (err error) {
+	err := r.run(r.c, func() (err error) {
 		count, err = r.rds.Count(q)
 		return
-	})
+	}, q)
 	return count, err
 }
 
 func (r *dsState) RunInTransaction(f func(c context.Context) error, opts *ds.TransactionOptions) error {
-	return r.run(func() error {
+	return r.run(r.c, func() error {
 		return r.rds.RunInTransaction(f, opts)
-	})
+	}, opts)
 }
 
 // TODO(iannucci): Allow the user to specify a multierror which will propagate
 // to the callback correctly.
 
 func (r *dsState) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
-	return r.run(func() error {
+	return r.run(r.c, func() error {
 		return r.rds.DeleteMulti(keys, cb)
-	})
+	}, keys)
 }
 
 func (r *dsState) GetMulti(keys []*ds.Key, meta ds.MultiMetaGetter, cb ds.GetMultiCB) error {
-	return r.run(func() error {
+	return r.run(r.c, func() error {
 		return r.rds.GetMulti(keys, meta, cb)
-	})
+	}, keys, meta)
 }
 
 func (r *dsState) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
-	return r.run(func() (err error) {
+	return r.run(r.c, func() (err error) {
 		return r.rds.PutMulti(keys, vals, cb)
-	})
+	}, keys, vals)
 }
 
 func (r *dsState) WithoutTransaction() context.Context {
@@ -91,6 +92,6 @@ func (r *dsState) GetTestable() ds.Testable {
 func FilterRDS(c context.Context, defaultError error) (context.Context, FeatureBreaker) {
 	state := newState(defaultError)
 	return ds.AddRawFilters(c, func(ic context.Context, RawDatastore ds.RawInterface) ds.RawInterface {
-		return &dsState{state, RawDatastore}
+		return &dsState{state, ic, RawDatastore}
 	}), state
 }
@@ -8,6 +8,7 @@ import (
 	"golang.org/x/net/context"
 
 	ds "github.com/luci/gae/service/datastore"
+	tq "github.com/luci/gae/service/taskqueue"
 )
 
 var (
@@ -16,16 +17,28 @@ var (
 )
 
 // FilterRDS installs a transaction buffer datastore filter in the context.
+//
+// It also installs a task queue filter which buffers the tasks added inside of
+// nested transactions, so that they're only enqueued if every enclosing
+// transaction commits.
 func FilterRDS(c context.Context) context.Context {
 	// TODO(riannucci): allow the specification of the set of roots to limit this
 	// transaction to, transitively.
-	return ds.AddRawFilters(c, func(c context.Context, rds ds.RawInterface) ds.RawInterface {
+	c = ds.AddRawFilters(c, func(c context.Context, rds ds.RawInterface) ds.RawInterface {
 		if par, _ := c.Value(&dsTxnBufParent).(*txnBufState); par != nil {
 			haveLock, _ := c.Value(&dsTxnBufHaveLock).(bool)
 			return &dsTxnBuf{c, par, haveLock, rds}
 		}
 		return &dsBuf{rds}
 	})
+	return tq.AddRawFilters(c, func(c context.Context, raw tq.RawInterface) tq.RawInterface {
+		// Only nested transactions buffer their tasks. The outermost transaction
+		// uses the (transactional) task queue of the underlying implementation.
+		if par, _ := c.Value(&dsTxnBufParent).(*txnBufState); par != nil && par.depth > 1 {
+			return &tqTxnBuf{raw, par}
+		}
+		return raw
+	})
 }
 
 // impossible is a marker function to indicate that the given error is an
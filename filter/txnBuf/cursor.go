@@ -0,0 +1,82 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package txnBuf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	ds "github.com/luci/gae/service/datastore"
+)
+
+// txnCursorMagic prefixes the encoded txnCursors, to tell them apart from the
+// cursors of the underlying datastore.
+const txnCursorMagic = "txnBuf1:"
+
+// txnCursor is a position in the merged result stream of a query run inside of
+// a buffered transaction.
+type txnCursor struct {
+	// row is the comparable row (see toComparableString) of the last result
+	// returned before this cursor. Results up to (and including) it are skipped
+	// when resuming.
+	row []byte
+
+	// parent, if not nil, is the cursor of the underlying datastore right after
+	// the last result returned before this cursor. The query over the
+	// underlying datastore resumes from it instead of from the beginning.
+	parent ds.Cursor
+}
+
+var _ ds.Cursor = (*txnCursor)(nil)
+
+func (c *txnCursor) String() string {
+	buf := bytes.Buffer{}
+	_, _ = buf.WriteString(txnCursorMagic)
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	_, _ = buf.Write(lenBuf[:binary.PutUvarint(lenBuf, uint64(len(c.row)))])
+	_, _ = buf.Write(c.row)
+	if c.parent != nil {
+		_, _ = buf.WriteString(c.parent.String())
+	}
+	return base64.URLEncoding.EncodeToString(buf.Bytes())
+}
+
+// decodeTxnCursor decodes a cursor produced by txnCursor.String. It returns
+// false if s isn't such a cursor.
+func decodeTxnCursor(s string, decodeParent func(string) (ds.Cursor, error)) (*txnCursor, bool, error) {
+	data, err := base64.URLEncoding.DecodeString(s)
+	if err != nil || !bytes.HasPrefix(data, []byte(txnCursorMagic)) {
+		return nil, false, nil
+	}
+
+	buf := bytes.NewBuffer(data[len(txnCursorMagic):])
+	rowLen, err := binary.ReadUvarint(buf)
+	if err != nil || rowLen > uint64(buf.Len()) {
+		return nil, true, errors.New("txnBuf: malformed cursor")
+	}
+	ret := &txnCursor{row: buf.Next(int(rowLen))}
+	if buf.Len() > 0 {
+		if ret.parent, err = decodeParent(buf.String()); err != nil {
+			return nil, true, fmt.Errorf("txnBuf: malformed cursor: %s", err)
+		}
+	}
+	return ret, true, nil
+}
+
+// toTxnCursor returns c as a *txnCursor, or an error if it's a cursor which
+// wasn't produced by merging the results of a query with the buffer.
+func toTxnCursor(c ds.Cursor) (*txnCursor, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if tc, ok := c.(*txnCursor); ok {
+		return tc, nil
+	}
+	return nil, errors.New(
+		"txnBuf filter doesn't support query cursors produced before the transaction modified the queried entities")
+}
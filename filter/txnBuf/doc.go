@@ -24,6 +24,12 @@
 //     transaction if they don't cause the outer transaction to exceed its
 //     size budget.
 //
+//   - Tasks added to the task queue inside of an inner transaction are
+//     buffered, and are only added to the outer transaction if the inner
+//     transaction commits. Ultimately they're only enqueued if the OUTERMOST
+//     transaction commits. Without the buffer, tasks added in a failed inner
+//     transaction would still be enqueued when the outer transaction commits.
+//
 //   - If an inner transaction would cause the OUTERMOST transaction to exceed
 //     the appengine-imposed 10MB transaction size limit, an error will be
 //     returned from the inner transaction, instead of adding it into the
@@ -36,26 +42,34 @@
 //     a subsequent inner-inner transaction delete some of those entities.
 //
 // LIMITATIONS (only inside of a transaction)
-//   - KeysOnly/Projection/Count queries are supported, but may incur additional
-//     costs.
+//   - Queries which may return entities written by the transaction (i.e.
+//     those of the same kind under the same ancestor) must merge the buffered
+//     writes with the results of the underlying datastore. Other queries run
+//     natively on the underlying datastore, and have none of the limitations
+//     below.
+//
+//   - KeysOnly/Projection/Count merged queries are supported, but may incur
+//     additional costs.
 //
 //     These query types are implemented via projection queries, but will
 //     project all order-by fields in addition to any specified in the original
 //     query.
 //
-//   - Distinct Projection queries do all 'distinct' deduplication in-memory.
-//     This could make them substantially more expensive than their native
-//     equivalent.
+//   - Distinct Projection merged queries do all 'distinct' deduplication
+//     in-memory. This could make them substantially more expensive than their
+//     native equivalent.
 //
 //   - Metadata entities (e.g. `__entity_group__`) will reflect their values as
 //     they were at the beginning of the transaction, and will not increment
 //     as you write inside of the transaction.
 //
-//   - Query cursors are not supported. Since the cursor format for the
-//     in-memory datastore implementation isn't compatible with the production
-//     cursors, it would be pretty tricky to make it so that cursors were
-//     viable outside the transaction as well as inside of it while also having
-//     it accurately reflect the 'merged' query results.
+//   - Query cursors of merged queries are only valid inside of the
+//     transaction which produced them, and native cursors (e.g. those produced
+//     before the transaction wrote any of the queried entities) are rejected.
+//     They record the position in the 'merged' query results, and resume the
+//     query on the underlying datastore from its own cursor when the last
+//     result came from it. The deduplication of Distinct queries doesn't carry
+//     across cursors.
 //
 //   - No parallel access* to datastore while in a transaction; all nested
 //     operations are serialized. This is done for simplicity and correctness.
@@ -74,9 +88,15 @@
 //     just generally a terrible idea anyway, but I thought it was worth
 //     mentioning.
 //
-//   - Currently, the soft transactions are not directly accessible using the
-//     CurrentTransaction interface; it returns the wrapped datastore's
-//     transaction. While this is still correct, it could definitely be made
-//     more useful by adding transaction buffer metadata to the returned
-//     object.
+// TRANSACTION STATE
+//
+// Inside of a buffered transaction, CurrentTransaction returns a Transaction
+// (see also GetTransaction) whose Stats describe the buffer: the nesting depth,
+// the entity groups touched so far, the number of pending puts and deletes, and
+// their estimated size against the size budget. Code doing a lot of writes may
+// use them to split its work before the transaction becomes too large:
+//
+//   if s := txnBuf.GetTransaction(c).Stats(); s.RemainingSize() < 1<<20 {
+//     // Not enough room for another batch; continue in a new transaction.
+//   }
 package txnBuf
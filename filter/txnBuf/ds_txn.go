@@ -30,6 +30,9 @@ type dsTxnBuf struct {
 var _ ds.RawInterface = (*dsTxnBuf)(nil)
 
 func (d *dsTxnBuf) DecodeCursor(s string) (ds.Cursor, error) {
+	if tc, ok, err := decodeTxnCursor(s, d.rds.DecodeCursor); ok {
+		return tc, err
+	}
 	return d.rds.DecodeCursor(s)
 }
 
@@ -49,7 +52,21 @@ func (d *dsTxnBuf) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
 	return d.state.deleteMulti(keys, cb, d.haveLock)
 }
 
+// snapshot returns the buffer and the parent datastore of the transaction, and
+// a copy of the current sizeTracker.
+func (d *dsTxnBuf) snapshot() (bufDS, parentDS ds.RawInterface, sizes *sizeTracker) {
+	if !d.haveLock {
+		d.state.Lock()
+		defer d.state.Unlock()
+	}
+	return d.state.bufDS, d.state.parentDS, d.state.entState.dup()
+}
+
 func (d *dsTxnBuf) Count(fq *ds.FinalizedQuery) (count int64, err error) {
+	if _, parentDS, sizes := d.snapshot(); !bufferAffects(fq, sizes, d.state.kc) {
+		return parentDS.Count(fq)
+	}
+
 	// Unfortunately there's no fast-path here. We literally have to run the
 	// query and count. Fortunately we can optimize to count keys if it's not
 	// a projection query. This will save on bandwidth a bit.
@@ -67,8 +84,21 @@ func (d *dsTxnBuf) Count(fq *ds.FinalizedQuery) (count int64, err error) {
 }
 
 func (d *dsTxnBuf) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
-	if start, end := fq.Bounds(); start != nil || end != nil {
-		return errors.New("txnBuf filter does not support query cursors")
+	bufDS, parentDS, sizes := d.snapshot()
+	if !bufferAffects(fq, sizes, d.state.kc) {
+		// None of the buffered writes can show up in the results, so the parent
+		// datastore can take care of the whole query natively.
+		return parentDS.Run(fq, cb)
+	}
+
+	start, end := fq.Bounds()
+	startCursor, err := toTxnCursor(start)
+	if err != nil {
+		return err
+	}
+	endCursor, err := toTxnCursor(end)
+	if err != nil {
+		return err
 	}
 
 	limit, limitSet := fq.Limit()
@@ -77,15 +107,7 @@ func (d *dsTxnBuf) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
 
 	project := fq.Project()
 
-	bufDS, parentDS, sizes := func() (ds.RawInterface, ds.RawInterface, *sizeTracker) {
-		if !d.haveLock {
-			d.state.Lock()
-			defer d.state.Unlock()
-		}
-		return d.state.bufDS, d.state.parentDS, d.state.entState.dup()
-	}()
-
-	return runMergedQueries(fq, sizes, bufDS, parentDS, func(key *ds.Key, data ds.PropertyMap) error {
+	return runMergedQueries(fq, startCursor, endCursor, sizes, bufDS, parentDS, func(key *ds.Key, data ds.PropertyMap, getCursor ds.CursorCB) error {
 		if offset > 0 {
 			offset--
 			return nil
@@ -105,7 +127,7 @@ func (d *dsTxnBuf) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
 			}
 			data = newData
 		}
-		return cb(key, data, nil)
+		return cb(key, data, getCursor)
 	})
 }
 
@@ -121,6 +143,8 @@ func (d *dsTxnBuf) CurrentTransaction() ds.Transaction {
 	// Return the pointer to the state at this layer of the transaction tree. This
 	// will be the same for multiple calls to CurrentTransaction within this
 	// nested transaction, and globally unique while the transaction is active.
+	//
+	// It implements Transaction, which exposes the state of the buffer.
 	return d.state
 }
 
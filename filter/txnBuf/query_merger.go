@@ -18,18 +18,25 @@ import (
 // will produce either *items or errors.
 //
 //  - d is the raw datastore to run this query on
-//  - filter is a function which will return true if the given key should be
-//    excluded from the result set.
+//
+// The query doesn't advance past an item until the next one is requested, so
+// the cursor of the last produced item remains valid until then.
 func queryToIter(stopChan chan struct{}, fq *ds.FinalizedQuery, d ds.RawInterface) func() (*item, error) {
 	c := make(chan *item)
+	ack := make(chan struct{})
 
 	go func() {
 		defer close(c)
 
-		err := d.Run(fq, func(k *ds.Key, pm ds.PropertyMap, _ ds.CursorCB) error {
-			i := &item{key: k, data: pm}
+		err := d.Run(fq, func(k *ds.Key, pm ds.PropertyMap, getCursor ds.CursorCB) error {
+			i := &item{key: k, data: pm, getCursor: getCursor}
 			select {
 			case c <- i:
+			case <-stopChan:
+				return ds.Stop
+			}
+			select {
+			case <-ack:
 				return nil
 			case <-stopChan:
 				return ds.Stop
@@ -40,7 +47,15 @@ func queryToIter(stopChan chan struct{}, fq *ds.FinalizedQuery, d ds.RawInterfac
 		}
 	}()
 
+	produced := false
 	return func() (*item, error) {
+		if produced {
+			produced = false
+			select {
+			case ack <- struct{}{}:
+			case <-stopChan:
+			}
+		}
 		itm := <-c
 		if itm == nil {
 			return nil, nil
@@ -48,10 +63,29 @@ func queryToIter(stopChan chan struct{}, fq *ds.FinalizedQuery, d ds.RawInterfac
 		if itm.err != nil {
 			return nil, itm.err
 		}
+		produced = true
 		return itm, nil
 	}
 }
 
+// bufferAffects returns true if any of the writes tracked by sizes may change
+// the results of fq, i.e. if it's a write of an entity of the queried kind
+// under the queried ancestor.
+//
+// If it returns false, fq may run natively on the parent datastore, including
+// its projection, distinct, limit, offset and cursors.
+func bufferAffects(fq *ds.FinalizedQuery, sizes *sizeTracker, kc ds.KeyContext) bool {
+	kind, ancestor := fq.Kind(), fq.Ancestor()
+	for encKey := range sizes.keyToSize {
+		k, err := serialize.ReadKey(bytes.NewBufferString(encKey), serialize.WithoutContext, kc)
+		memoryCorruption(err)
+		if (kind == "" || k.Kind() == kind) && (ancestor == nil || k.HasAncestor(ancestor)) {
+			return true
+		}
+	}
+	return false
+}
+
 // adjustQuery applies various mutations to the query to make it suitable for
 // merging. In general, this removes limits and offsets the 'distinct' modifier,
 // and it ensures that if there are sort orders which won't appear in the
@@ -67,6 +101,10 @@ func adjustQuery(fq *ds.FinalizedQuery) (*ds.FinalizedQuery, error) {
 	q = q.Limit(-1)
 	q = q.Offset(-1)
 
+	// cursors of the merged results are resolved by runMergedQueries.
+	q = q.Start(nil)
+	q = q.End(nil)
+
 	// distinction must be done in-memory, because otherwise there's no way
 	// to merge in the effect of the in-flight changes (because there's no way
 	// to push back to the datastore "yeah, I know you told me that the (1, 2)
@@ -113,14 +151,25 @@ func adjustQuery(fq *ds.FinalizedQuery) (*ds.FinalizedQuery, error) {
 // an expanded projection query with more data than the user asked for. It's the
 // caller's responsibility to prune away the extra data.
 //
+// If start is not nil, the results up to (and including) its position are
+// skipped, and the query over parentDS resumes from its parent cursor. If end
+// is not nil, the results after its position are skipped. The cursors
+// passed to cb are only valid for the duration of the callback.
+//
 // See also `dsTxnBuf.Run()`.
-func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
-	memDS, parentDS ds.RawInterface, cb func(k *ds.Key, data ds.PropertyMap) error) error {
+func runMergedQueries(fq *ds.FinalizedQuery, start, end *txnCursor, sizes *sizeTracker,
+	memDS, parentDS ds.RawInterface, cb func(k *ds.Key, data ds.PropertyMap, getCursor ds.CursorCB) error) error {
 
 	toRun, err := adjustQuery(fq)
 	if err != nil {
 		return err
 	}
+	toRunParent := toRun
+	if start != nil && start.parent != nil {
+		if toRunParent, err = toRun.Original().Start(start.parent).Finalize(); err != nil {
+			return err
+		}
+	}
 
 	cmpLower, cmpUpper := memory.GetBinaryBounds(fq)
 	cmpOrder := fq.Orders()
@@ -149,9 +198,14 @@ func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
 
 	stopChan := make(chan struct{})
 
-	parIter := queryToIter(stopChan, toRun, parentDS)
+	parIter := queryToIter(stopChan, toRunParent, parentDS)
 	memIter := queryToIter(stopChan, toRun, memDS)
 
+	// beforeStart returns true if itm is at or before the start cursor.
+	beforeStart := func(itm *item) bool {
+		return start != nil && cmpFn(itm) <= string(start.row)
+	}
+
 	parItemGet := func() (*item, error) {
 		for {
 			itm, err := parIter()
@@ -159,9 +213,10 @@ func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
 				return nil, err
 			}
 			encKey := itm.getEncKey()
-			if sizes.has(encKey) || (dedup != nil && dedup.Has(encKey)) {
+			if sizes.has(encKey) || (dedup != nil && dedup.Has(encKey)) || beforeStart(itm) {
 				continue
 			}
+			itm.fromParent = true
 			return itm, nil
 		}
 	}
@@ -171,7 +226,7 @@ func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
 			if itm == nil || err != nil {
 				return nil, err
 			}
-			if dedup != nil && dedup.Has(itm.getEncKey()) {
+			if (dedup != nil && dedup.Has(itm.getEncKey())) || beforeStart(itm) {
 				continue
 			}
 			return itm, nil
@@ -184,23 +239,25 @@ func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
 		memItemGet()
 	}()
 
-	pitm, err := parItemGet()
-	if err != nil {
-		return err
-	}
-
-	mitm, err := memItemGet()
-	if err != nil {
-		return err
-	}
-
+	var (
+		pitm, mitm       *item
+		parDone, memDone bool
+	)
 	for {
-		// the err can be set during the loop below. If we come around the bend and
-		// it's set, then we need to return it. We don't check it immediately
-		// because it's set after we already have a good result to return to the
-		// user.
-		if err != nil {
-			return err
+		// The next item of an iterator is only requested once the previous one
+		// has been passed to cb, so that the cursor of the underlying datastore
+		// is still positioned on it during the callback.
+		if pitm == nil && !parDone {
+			if pitm, err = parItemGet(); err != nil {
+				return err
+			}
+			parDone = pitm == nil
+		}
+		if mitm == nil && !memDone {
+			if mitm, err = memItemGet(); err != nil {
+				return err
+			}
+			memDone = mitm == nil
 		}
 
 		usePitm := pitm != nil
@@ -211,13 +268,15 @@ func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
 		}
 
 		toUse := (*item)(nil)
-		// we check the error at the beginning of the loop.
 		if usePitm {
-			toUse = pitm
-			pitm, err = parItemGet()
+			toUse, pitm = pitm, nil
 		} else {
-			toUse = mitm
-			mitm, err = memItemGet()
+			toUse, mitm = mitm, nil
+		}
+
+		row := cmpFn(toUse)
+		if end != nil && row > string(end.row) {
+			break
 		}
 
 		if dedup != nil {
@@ -234,7 +293,19 @@ func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
 				continue
 			}
 		}
-		if err := cb(toUse.key, toUse.data); err != nil {
+
+		getCursor := func() (ds.Cursor, error) {
+			ret := &txnCursor{row: []byte(row)}
+			if toUse.fromParent && toUse.getCursor != nil {
+				parent, err := toUse.getCursor()
+				if err != nil {
+					return nil, err
+				}
+				ret.parent = parent
+			}
+			return ret, nil
+		}
+		if err := cb(toUse.key, toUse.data, getCursor); err != nil {
 			return err
 		}
 	}
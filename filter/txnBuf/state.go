@@ -12,6 +12,7 @@ import (
 	"github.com/luci/gae/service/datastore"
 	"github.com/luci/gae/service/datastore/serialize"
 	"github.com/luci/gae/service/info"
+	tq "github.com/luci/gae/service/taskqueue"
 	"github.com/luci/luci-go/common/data/stringset"
 	"github.com/luci/luci-go/common/errors"
 	"github.com/luci/luci-go/common/sync/parallel"
@@ -97,6 +98,14 @@ func (s *sizeTracker) dup() *sizeTracker {
 type txnBufState struct {
 	sync.Mutex
 
+	// depth is the nesting depth of this transaction, starting at 1.
+	depth int
+
+	// statsLock guards the changes to entState and roots, so that Stats may read
+	// them without the main lock, which is held for the whole duration of the
+	// nested transactions and forever after commit.
+	statsLock sync.Mutex
+
 	// encoded key -> size of entity. A size of 0 means that the entity is
 	// deleted.
 	entState *sizeTracker
@@ -118,10 +127,18 @@ type txnBufState struct {
 	// countBudget is the number of entity writes that this transaction has to
 	// operate in.
 	writeCountBudget int
+
+	// tasks are the tasks added by this transaction's nested transactions which
+	// committed, and, for nested transactions, by this transaction itself. They
+	// are handed to the enclosing transaction's buffer when a nested transaction
+	// commits, and added to the real transaction when the outermost one commits.
+	tasksLock sync.Mutex
+	tasks     []bufferedTask
 }
 
 func withTxnBuf(ctx context.Context, cb func(context.Context) error, opts *datastore.TransactionOptions) error {
 	parentState, _ := ctx.Value(&dsTxnBufParent).(*txnBufState)
+	depth := 1
 	roots := stringset.New(0)
 	rootLimit := 1
 	if opts != nil && opts.XG {
@@ -134,6 +151,7 @@ func withTxnBuf(ctx context.Context, cb func(context.Context) error, opts *datas
 		// they're same groups affected by the parent transactions. So instead of
 		// respecting opts.XG for inner transactions, we just dup everything from
 		// the parent transaction.
+		depth = parentState.depth + 1
 		roots = parentState.roots.Dup()
 		rootLimit = parentState.rootLimit
 
@@ -142,6 +160,7 @@ func withTxnBuf(ctx context.Context, cb func(context.Context) error, opts *datas
 	}
 
 	state := &txnBufState{
+		depth:            depth,
 		entState:         &sizeTracker{},
 		bufDS:            memory.NewDatastore(ctx, info.Raw(ctx)),
 		roots:            roots,
@@ -159,6 +178,11 @@ func withTxnBuf(ctx context.Context, cb func(context.Context) error, opts *datas
 	state.Lock()
 
 	if parentState == nil {
+		// If this fails, the real transaction fails too, along with any of the
+		// tasks which were added.
+		if err := state.flushTasks(tq.Raw(ctx)); err != nil {
+			return err
+		}
 		return commitToReal(state)
 	}
 
@@ -167,6 +191,7 @@ func withTxnBuf(ctx context.Context, cb func(context.Context) error, opts *datas
 	}
 
 	parentState.commitLocked(state)
+	parentState.bufferTasks(state.takeTasks())
 	return nil
 }
 
@@ -185,6 +210,11 @@ type item struct {
 	// a query.
 	cmpRow string
 
+	// getCursor and fromParent are set for the items produced by queryToIter.
+	// fromParent is true if the item came from the parent datastore.
+	getCursor  datastore.CursorCB
+	fromParent bool
+
 	// err is a bit of a hack for passing back synchronized errors from
 	// queryToIter.
 	err error
@@ -222,6 +252,8 @@ func (t *txnBufState) updateRootsLocked(roots stringset.Set) error {
 	}
 	// only need to update the roots if they did something that required updating
 	if proposedRoots.Len() > 0 {
+		t.statsLock.Lock()
+		defer t.statsLock.Unlock()
 		proposedRoots.Iter(func(root string) bool {
 			t.roots.Add(root)
 			return true
@@ -334,6 +366,9 @@ func (t *txnBufState) deleteMulti(keys []*datastore.Key, cb datastore.DeleteMult
 			return err
 		}
 
+		t.statsLock.Lock()
+		defer t.statsLock.Unlock()
+
 		i := 0
 		err := t.bufDS.DeleteMulti(keys, func(err error) error {
 			impossible(err)
@@ -429,6 +464,9 @@ func (t *txnBufState) putMulti(keys []*datastore.Key, vals []datastore.PropertyM
 			return err
 		}
 
+		t.statsLock.Lock()
+		defer t.statsLock.Unlock()
+
 		i := 0
 		err := t.bufDS.PutMulti(keys, vals, func(k *datastore.Key, err error) error {
 			impossible(err)
@@ -555,6 +593,56 @@ func (t *txnBufState) commitLocked(s *txnBufState) {
 	}
 }
 
+// takeTasks returns the buffered tasks, and empties the buffer.
+func (t *txnBufState) takeTasks() []bufferedTask {
+	t.tasksLock.Lock()
+	defer t.tasksLock.Unlock()
+
+	tasks := t.tasks
+	t.tasks = nil
+	return tasks
+}
+
+// bufferTasks appends tasks to the buffered tasks.
+func (t *txnBufState) bufferTasks(tasks []bufferedTask) {
+	t.tasksLock.Lock()
+	defer t.tasksLock.Unlock()
+
+	t.tasks = append(t.tasks, tasks...)
+}
+
+// flushTasks adds the buffered tasks to raw, the task queue of the real
+// transaction.
+//
+// Adding the tasks may fail partway, so flushTasks must only be called by the
+// outermost transaction, whose failure discards all of the tasks added to raw.
+func (t *txnBufState) flushTasks(raw tq.RawInterface) error {
+	tasks := t.takeTasks()
+	for len(tasks) > 0 {
+		// Add consecutive tasks for the same queue together, preserving order.
+		queueName := tasks[0].queueName
+		batch := []*tq.Task(nil)
+		for len(tasks) > 0 && tasks[0].queueName == queueName {
+			batch = append(batch, tasks[0].task)
+			tasks = tasks[1:]
+		}
+
+		lme := errors.NewLazyMultiError(len(batch))
+		i := 0
+		err := raw.AddMulti(batch, queueName, func(_ *tq.Task, err error) {
+			lme.Assign(i, err)
+			i++
+		})
+		if err == nil {
+			err = lme.Get()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // toEncoded returns a list of all of the serialized versions of these keys,
 // plus a stringset of all the encoded root keys that `keys` represents.
 func toEncoded(keys []*datastore.Key) (full []string, roots stringset.Set) {
@@ -0,0 +1,103 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package txnBuf
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/luci/luci-go/common/errors"
+
+	tq "github.com/luci/gae/service/taskqueue"
+)
+
+// bufferedTask is a task added inside of a nested transaction, waiting for the
+// nested transaction to commit.
+type bufferedTask struct {
+	queueName string
+	task      *tq.Task
+}
+
+// tqTxnBuf buffers task queue additions made inside of a nested transaction.
+// Once the nested transaction commits, the tasks are handed to the enclosing
+// transaction's buffer, and they're added to the real transaction when the
+// outermost transaction commits (see txnBufState.flushTasks).
+type tqTxnBuf struct {
+	tq.RawInterface
+
+	state *txnBufState
+}
+
+var _ tq.RawInterface = (*tqTxnBuf)(nil)
+
+var (
+	validQueueName = regexp.MustCompile("^[0-9a-zA-Z\\-]{1,100}$")
+	validTaskName  = regexp.MustCompile("^[0-9a-zA-Z\\-\\_]{0,500}$")
+)
+
+// AddMulti buffers the tasks until the nested transaction commits.
+//
+// The tasks are validated right away, so that most invalid tasks are reported to
+// cb, rather than failing the outermost transaction. They aren't buffered.
+func (t *tqTxnBuf) AddMulti(tasks []*tq.Task, queueName string, cb tq.RawTaskCB) error {
+	if queueName != "" && !validQueueName.MatchString(queueName) {
+		return fmt.Errorf("taskqueue: invalid queue name %q", queueName)
+	}
+
+	t.state.tasksLock.Lock()
+	defer t.state.tasksLock.Unlock()
+
+	for _, task := range tasks {
+		if err := checkTask(task); err != nil {
+			cb(nil, err)
+			continue
+		}
+		t.state.tasks = append(t.state.tasks, bufferedTask{queueName, task.Duplicate()})
+		cb(task.Duplicate(), nil)
+	}
+	return nil
+}
+
+// checkTask returns an error if task would be rejected by the task queue of the
+// enclosing transaction.
+func checkTask(task *tq.Task) error {
+	switch task.Method {
+	case "", "POST", "PUT", "PULL", "GET", "HEAD", "DELETE":
+	default:
+		return fmt.Errorf("taskqueue: bad method %q", task.Method)
+	}
+	if !task.ETA.IsZero() && task.Delay != 0 {
+		return errors.New("taskqueue: both Delay and ETA are set")
+	}
+	if !validTaskName.MatchString(task.Name) {
+		return fmt.Errorf("taskqueue: invalid task name %q", task.Name)
+	}
+	return nil
+}
+
+func (t *tqTxnBuf) DeleteMulti([]*tq.Task, string, tq.RawCB) error {
+	return errors.New("taskqueue: cannot DeleteMulti from a transaction")
+}
+
+func (t *tqTxnBuf) Lease(int, string, time.Duration) ([]*tq.Task, error) {
+	return nil, errors.New("taskqueue: cannot Lease from a transaction")
+}
+
+func (t *tqTxnBuf) LeaseByTag(int, string, time.Duration, string) ([]*tq.Task, error) {
+	return nil, errors.New("taskqueue: cannot LeaseByTag from a transaction")
+}
+
+func (t *tqTxnBuf) ModifyLease(*tq.Task, string, time.Duration) error {
+	return errors.New("taskqueue: cannot ModifyLease from a transaction")
+}
+
+func (t *tqTxnBuf) Purge(string) error {
+	return errors.New("taskqueue: cannot Purge from a transaction")
+}
+
+func (t *tqTxnBuf) Stats([]string, tq.RawStatsCB) error {
+	return errors.New("taskqueue: cannot Stats from a transaction")
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package txnBuf
+
+import (
+	"bytes"
+	"sort"
+
+	ds "github.com/luci/gae/service/datastore"
+	"github.com/luci/gae/service/datastore/serialize"
+
+	"golang.org/x/net/context"
+)
+
+// Transaction is the datastore.Transaction returned by CurrentTransaction
+// inside of a buffered transaction.
+type Transaction interface {
+	// Stats returns a snapshot of the state of the transaction buffer.
+	//
+	// It may be called at any time, including after the transaction has
+	// completed.
+	Stats() *TransactionStats
+}
+
+// TransactionStats describes the state of a (possibly nested) buffered
+// transaction.
+type TransactionStats struct {
+	// Depth is the nesting depth of the transaction. The outermost transaction
+	// has a depth of 1.
+	Depth int
+
+	// Roots are the root keys of the entity groups touched by the transaction
+	// and its enclosing transactions so far.
+	Roots []*ds.Key
+	// RootLimit is the maximum number of entity groups which the transaction may
+	// touch (see XGTransactionGroupLimit).
+	RootLimit int
+
+	// Puts is the number of entities put by the transaction, which will be
+	// written when it commits.
+	Puts int
+	// Deletes is the number of entities deleted by the transaction, which will be
+	// deleted when it commits.
+	Deletes int
+	// WriteCountBudget is the maximum number of Puts+Deletes of the transaction
+	// (see DefaultWriteCountBudget).
+	WriteCountBudget int
+
+	// Size is the estimated size, in bytes, of the writes buffered by the
+	// transaction.
+	Size int64
+	// SizeBudget is the maximum Size of the transaction (see
+	// DefaultSizeBudget). The budget of a nested transaction is whatever its
+	// enclosing transaction left when it started.
+	SizeBudget int64
+}
+
+// RemainingSize is the number of bytes which the transaction may still write
+// before exceeding its SizeBudget. It's negative if the budget is exceeded,
+// in which case the transaction will fail to commit.
+func (s *TransactionStats) RemainingSize() int64 {
+	return s.SizeBudget - s.Size
+}
+
+// RemainingWrites is the number of entities which the transaction may still
+// put or delete before exceeding its WriteCountBudget.
+func (s *TransactionStats) RemainingWrites() int {
+	return s.WriteCountBudget - s.Puts - s.Deletes
+}
+
+// GetTransaction returns the buffered transaction of the context, or nil if
+// the context isn't inside of a transaction run through the txnBuf filter.
+func GetTransaction(c context.Context) Transaction {
+	t, _ := ds.CurrentTransaction(c).(Transaction)
+	return t
+}
+
+var _ Transaction = (*txnBufState)(nil)
+
+func (t *txnBufState) Stats() *TransactionStats {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+
+	ret := &TransactionStats{
+		Depth:            t.depth,
+		RootLimit:        t.rootLimit,
+		WriteCountBudget: t.writeCountBudget,
+		Size:             t.entState.total,
+		SizeBudget:       t.sizeBudget,
+	}
+	for _, size := range t.entState.keyToSize {
+		if size == 0 {
+			ret.Deletes++
+		} else {
+			ret.Puts++
+		}
+	}
+
+	roots := t.roots.ToSlice()
+	sort.Strings(roots)
+	ret.Roots = make([]*ds.Key, len(roots))
+	for i, root := range roots {
+		k, err := serialize.ReadKey(bytes.NewBufferString(root), serialize.WithoutContext, t.kc)
+		memoryCorruption(err)
+		ret.Roots[i] = k
+	}
+	return ret
+}
@@ -8,12 +8,15 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/luci/gae/filter/count"
 	"github.com/luci/gae/impl/memory"
 	ds "github.com/luci/gae/service/datastore"
 	"github.com/luci/gae/service/info"
+	tq "github.com/luci/gae/service/taskqueue"
 
 	"github.com/luci/luci-go/common/data/cmpbin"
 	"github.com/luci/luci-go/common/errors"
@@ -265,6 +268,153 @@ func TestTransactionBuffers(t *testing.T) {
 				So(k.IntID(), fooShouldHave(c), nums)
 			})
 
+			Convey("tasks are only enqueued if every transaction commits", func() {
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					So(tq.Add(c, "", &tq.Task{Path: "/outer"}), ShouldBeNil)
+
+					// inner, failing, transaction
+					So(ds.RunInTransaction(c, func(c context.Context) error {
+						So(tq.Add(c, "", &tq.Task{Path: "/inner/failed"}), ShouldBeNil)
+						return errors.New("whaaaa")
+					}, nil), ShouldErrLike, "whaaaa")
+
+					// inner, successful, transaction
+					So(ds.RunInTransaction(c, func(c context.Context) error {
+						So(tq.Add(c, "", &tq.Task{Path: "/inner/ok"}), ShouldBeNil)
+
+						// doubly-nested, successful, transaction
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							So(tq.Add(c, "", &tq.Task{Path: "/inner/inner"}), ShouldBeNil)
+							return nil
+						}, nil), ShouldBeNil)
+
+						return nil
+					}, nil), ShouldBeNil)
+
+					// buffered until this transaction commits.
+					paths := []string{}
+					for _, t := range tq.GetTestable(c).GetTransactionTasks()["default"] {
+						paths = append(paths, t.Path)
+					}
+					So(paths, ShouldResemble, []string{"/outer"})
+					return nil
+				}, nil), ShouldBeNil)
+
+				paths := []string{}
+				for _, t := range tq.GetTestable(c).GetScheduledTasks()["default"] {
+					paths = append(paths, t.Path)
+				}
+				sort.Strings(paths)
+				So(paths, ShouldResemble, []string{"/inner/inner", "/inner/ok", "/outer"})
+
+				Convey("and not at all if the outermost transaction fails", func() {
+					tq.GetTestable(c).ResetTasks()
+					So(ds.RunInTransaction(c, func(c context.Context) error {
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							return tq.Add(c, "", &tq.Task{Path: "/inner"})
+						}, nil), ShouldBeNil)
+						return errors.New("boop")
+					}, nil), ShouldErrLike, "boop")
+
+					So(len(tq.GetTestable(c).GetScheduledTasks()["default"]), ShouldEqual, 0)
+				})
+
+				Convey("and not partially if some of them are invalid", func() {
+					tq.GetTestable(c).ResetTasks()
+					tq.GetTestable(c).CreatePullQueue("pull")
+					addNested := func(tasks map[string][]*tq.Task) error {
+						return ds.RunInTransaction(c, func(c context.Context) error {
+							So(ds.RunInTransaction(c, func(c context.Context) error {
+								for queueName, tasks := range tasks {
+									So(tq.Add(c, queueName, tasks...), ShouldBeNil)
+								}
+								return nil
+							}, nil), ShouldBeNil)
+							return nil
+						}, nil)
+					}
+					scheduled := func() int {
+						n := 0
+						for _, tasks := range tq.GetTestable(c).GetScheduledTasks() {
+							n += len(tasks)
+						}
+						return n
+					}
+
+					So(ds.RunInTransaction(c, func(c context.Context) error {
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							So(tq.Add(c, "bad queue", &tq.Task{Path: "/bad"}), ShouldErrLike, "invalid queue name")
+							So(tq.Add(c, "", &tq.Task{Name: "bad name"}), ShouldErrLike, "invalid task name")
+							So(tq.Add(c, "", &tq.Task{Delay: time.Second, ETA: time.Now()}), ShouldErrLike, "both Delay and ETA")
+							So(tq.Add(c, "", &tq.Task{Method: "PATCH"}), ShouldErrLike, "bad method")
+							return nil
+						}, nil), ShouldBeNil)
+						return nil
+					}, nil), ShouldBeNil)
+
+					tasks := make([]*tq.Task, 6)
+					for i := range tasks {
+						tasks[i] = &tq.Task{Path: fmt.Sprintf("/%d", i)}
+					}
+					So(addNested(map[string][]*tq.Task{"": tasks}), ShouldErrLike, "BAD_REQUEST")
+					So(scheduled(), ShouldEqual, 0)
+
+					So(addNested(map[string][]*tq.Task{
+						"":     {{Path: "/push"}},
+						"pull": {{Method: "PULL"}, {Path: "/push"}},
+					}), ShouldErrLike, "INVALID_QUEUE_MODE")
+					So(scheduled(), ShouldEqual, 0)
+
+					So(addNested(map[string][]*tq.Task{
+						"":        {{Path: "/push"}},
+						"missing": {{Path: "/missing"}},
+					}), ShouldErrLike, "UNKNOWN_QUEUE")
+					So(scheduled(), ShouldEqual, 0)
+				})
+			})
+
+			Convey("exposes the state of the buffer", func() {
+				So(GetTransaction(c), ShouldBeNil)
+
+				var txn Transaction
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					txn = GetTransaction(c)
+					So(txn, ShouldNotBeNil)
+					So(ds.CurrentTransaction(c), ShouldEqual, txn)
+					So(txn.Stats(), ShouldResemble, &TransactionStats{
+						Depth:            1,
+						Roots:            []*ds.Key{},
+						RootLimit:        XGTransactionGroupLimit,
+						WriteCountBudget: DefaultWriteCountBudget,
+						SizeBudget:       DefaultSizeBudget,
+					})
+
+					So(3, fooSetTo(c), 1, 2, 3, 4)
+					So(7, fooSetTo(c))
+
+					outer := txn.Stats()
+					So(outer.Roots, ShouldResemble, []*ds.Key{
+						ds.MakeKey(c, "Foo", 3), ds.MakeKey(c, "Foo", 7)})
+					So(outer.Puts, ShouldEqual, 1)
+					So(outer.Deletes, ShouldEqual, 1)
+					So(outer.Size, ShouldBeGreaterThan, 0)
+					So(outer.RemainingSize(), ShouldEqual, DefaultSizeBudget-outer.Size)
+					So(outer.RemainingWrites(), ShouldEqual, DefaultWriteCountBudget-2)
+
+					return ds.RunInTransaction(c, func(c context.Context) error {
+						inner := GetTransaction(c).Stats()
+						So(inner.Depth, ShouldEqual, 2)
+						So(inner.Roots, ShouldResemble, outer.Roots)
+						So(inner.Puts, ShouldEqual, 0)
+						So(inner.SizeBudget, ShouldEqual, outer.RemainingSize())
+						So(inner.WriteCountBudget, ShouldEqual, outer.RemainingWrites())
+						return nil
+					}, nil)
+				}, &ds.TransactionOptions{XG: true}), ShouldBeNil)
+
+				// still readable after the transaction committed.
+				So(txn.Stats().Puts, ShouldEqual, 1)
+			})
 		})
 
 		Convey("Bad", func() {
@@ -840,6 +990,117 @@ func TestQuerySupport(t *testing.T) {
 
 			})
 
+			Convey("cursors", func() {
+				_, _, c := mkds(dataSingleRoot)
+				q := ds.NewQuery("Foo").Ancestor(root).KeysOnly(true)
+
+				getPage := func(c context.Context, q *ds.Query) (ret []int64, cur ds.Cursor) {
+					So(ds.Run(c, q, func(k *ds.Key, getCursor ds.CursorCB) error {
+						ret = append(ret, k.IntID())
+						var err error
+						cur, err = getCursor()
+						return err
+					}), ShouldBeNil)
+					return
+				}
+
+				Convey("paginate over merged results", func() {
+					So(ds.RunInTransaction(c, func(c context.Context) error {
+						So(ds.Delete(c, ds.MakeKey(c, "Parent", 1, "Foo", 3)), ShouldBeNil)
+						So(ds.Delete(c, ds.MakeKey(c, "Parent", 1, "Foo", 7)), ShouldBeNil)
+						So(ds.Put(c, &Foo{ID: 25, Parent: root}), ShouldBeNil)
+						So(ds.Put(c, &Foo{ID: 9, Parent: root, Value: []int64{1}}), ShouldBeNil)
+
+						all, _ := getPage(c, q)
+						So(len(all), ShouldEqual, 19)
+
+						got := []int64{}
+						var cur ds.Cursor
+						for {
+							pq := q.Limit(4)
+							if cur != nil {
+								// cursors survive a round trip through their string form.
+								var err error
+								cur, err = ds.DecodeCursor(c, cur.String())
+								So(err, ShouldBeNil)
+								pq = pq.Start(cur)
+							}
+							page, next := getPage(c, pq)
+							if len(page) == 0 {
+								break
+							}
+							got = append(got, page...)
+							cur = next
+						}
+						So(got, ShouldResemble, all)
+
+						_, cur = getPage(c, q.Limit(5))
+						page, _ := getPage(c, q.End(cur))
+						So(page, ShouldResemble, all[:5])
+
+						return nil
+					}, nil), ShouldBeNil)
+				})
+
+				Convey("native cursors are only supported until the queried entities are modified", func() {
+					all, _ := getPage(c, q)
+					_, cur := getPage(c, q.Limit(5))
+					So(ds.RunInTransaction(c, func(c context.Context) error {
+						page, _ := getPage(c, q.Start(cur))
+						So(page, ShouldResemble, all[5:])
+
+						// unrelated entities don't matter.
+						So(ds.Put(c, &Foo{ID: 1}), ShouldBeNil)
+						page, _ = getPage(c, q.Start(cur))
+						So(page, ShouldResemble, all[5:])
+
+						So(ds.Put(c, &Foo{ID: 1, Parent: root}), ShouldBeNil)
+						return ds.Run(c, q.Start(cur), func(*ds.Key) {})
+					}, &ds.TransactionOptions{XG: true}), ShouldErrLike,
+						"doesn't support query cursors produced before the transaction modified the queried entities")
+				})
+			})
+
+			Convey("unaffected queries run natively", func() {
+				under, _, c := mkds(dataSingleRoot)
+				q := ds.NewQuery("Foo").Ancestor(root)
+
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					count, err := ds.Count(c, q)
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 20)
+					So(under.Count.Total(), ShouldEqual, 1)
+
+					isTxnCursor := func() (ret bool) {
+						So(ds.Run(c, q.Limit(1), func(_ *ds.Key, getCursor ds.CursorCB) error {
+							cur, err := getCursor()
+							_, ret = cur.(*txnCursor)
+							return err
+						}), ShouldBeNil)
+						return
+					}
+					So(isTxnCursor(), ShouldBeFalse)
+
+					// writes to other kinds and entity groups don't matter.
+					So(ds.Put(c, ds.PropertyMap{
+						"$key":  ds.MkPropertyNI(ds.MakeKey(c, "Parent", 1, "Bar", 1)),
+						"Value": ds.MkProperty(1),
+					}), ShouldBeNil)
+					So(ds.Put(c, &Foo{ID: 1}), ShouldBeNil)
+					So(isTxnCursor(), ShouldBeFalse)
+
+					So(ds.Put(c, &Foo{ID: 25, Parent: root}), ShouldBeNil)
+					So(isTxnCursor(), ShouldBeTrue)
+
+					count, err = ds.Count(c, q)
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 21)
+					So(under.Count.Total(), ShouldEqual, 1)
+
+					return nil
+				}, &ds.TransactionOptions{XG: true}), ShouldBeNil)
+			})
+
 			Convey("start transaction from inside query", func() {
 				_, _, c := mkds(projectData)
 				So(ds.RunInTransaction(c, func(c context.Context) error {
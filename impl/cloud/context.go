@@ -37,6 +37,33 @@ type Config struct {
 	// MC is the memcache service client. If populated, the memcache service will
 	// be installed.
 	MC *memcache.Client
+
+	// TQ is the task queue service to deliver tasks to. If populated, the task
+	// queue service will be installed.
+	//
+	// Tasks added inside of a datastore transaction are written to the datastore
+	// (see TaskOutboxKind) as part of the transaction, and are only delivered to
+	// TQ once the transaction commits. This requires DS to be populated.
+	TQ taskqueue.RawInterface
+
+	// Metadata is the metadata server from which the info service gets the
+	// identity of the running instance, unless it's overridden by environment
+	// variables (GOOGLE_CLOUD_PROJECT, GAE_SERVICE, GAE_VERSION and
+	// GAE_INSTANCE). If nil, the GCE metadata server is used.
+	Metadata *Metadata
+
+	// Signer signs bytes for the info service. If nil, SignBytes and
+	// PublicCertificates return an error.
+	Signer Signer
+
+	// Mail configures the mail service, which delivers the messages through an
+	// SMTP server. If populated, the mail service will be installed.
+	Mail *SMTPConfig
+
+	// User configures the user service. If populated, the user service will be
+	// installed, and will authenticate the users of the requests bound to the
+	// Context with WithRequest.
+	User *UserConfig
 }
 
 // Use installs the Config into the supplied Context. Services will be installed
@@ -46,12 +73,9 @@ type Config struct {
 // stubs will panic if called.
 func (cfg Config) Use(c context.Context) context.Context {
 	// Dummy services that we don't support.
-	c = mail.Set(c, dummy.Mail())
 	c = module.Set(c, dummy.Module())
-	c = taskqueue.SetRaw(c, dummy.TaskQueue())
-	c = user.Set(c, dummy.User())
 
-	c = useInfo(c)
+	c = useInfo(c, newServiceIdentity(cfg.Metadata, cfg.Signer))
 
 	// datastore service
 	if cfg.DS != nil {
@@ -73,6 +97,30 @@ func (cfg Config) Use(c context.Context) context.Context {
 		c = mc.SetRaw(c, dummy.Memcache())
 	}
 
+	// mail service
+	if cfg.Mail != nil {
+		c = cfg.Mail.use(c)
+	} else {
+		c = mail.Set(c, dummy.Mail())
+	}
+
+	// user service
+	if cfg.User != nil {
+		c = cfg.User.use(c)
+	} else {
+		c = user.Set(c, dummy.User())
+	}
+
+	// task queue service
+	if cfg.TQ != nil {
+		ctq := cloudTaskQueue{
+			base: cfg.TQ,
+		}
+		c = ctq.use(c)
+	} else {
+		c = taskqueue.SetRaw(c, dummy.TaskQueue())
+	}
+
 	return c
 }
 
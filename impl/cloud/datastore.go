@@ -80,10 +80,17 @@ func (bds *boundDatastore) RunInTransaction(fn func(context.Context) error, opts
 		attempts = opts.Attempts
 	}
 	for i := 0; i < attempts; i++ {
+		var ob *taskOutbox
 		_, err := bds.client.RunInTransaction(bds, func(tx *datastore.Transaction) error {
-			return fn(withDatastoreTransaction(bds, tx))
+			// The client may retry this function itself, so each attempt gets a fresh
+			// outbox.
+			ob = &taskOutbox{}
+			return fn(withTaskOutbox(withDatastoreTransaction(bds, tx), ob))
 		})
 		if err = normalizeError(err); err != ds.ErrConcurrentTransaction {
+			if err == nil {
+				deliverTaskOutbox(bds, ob)
+			}
 			return err
 		}
 	}
@@ -260,7 +267,7 @@ func (bds *boundDatastore) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) erro
 }
 
 func (bds *boundDatastore) WithoutTransaction() context.Context {
-	return withDatastoreTransaction(bds, nil)
+	return withTaskOutbox(withDatastoreTransaction(bds, nil), nil)
 }
 
 func (bds *boundDatastore) CurrentTransaction() ds.Transaction { return bds.transaction }
@@ -7,13 +7,16 @@ package cloud
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/luci/gae/impl/memory"
 	ds "github.com/luci/gae/service/datastore"
 	"github.com/luci/gae/service/info"
+	tq "github.com/luci/gae/service/taskqueue"
 
 	"cloud.google.com/go/datastore"
 	"github.com/luci/luci-go/common/errors"
@@ -82,7 +85,11 @@ func TestDatastore(t *testing.T) {
 		testTime := ds.RoundTime(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
 		_ = testTime
 
-		cfg := Config{DS: client}
+		// Deliver tasks to an in-memory task queue.
+		memCtx := memory.Use(context.Background())
+		tqt := tq.GetTestable(memCtx)
+
+		cfg := Config{DS: client, TQ: tq.Raw(memCtx)}
 		c = cfg.Use(c)
 
 		Convey(`Supports namespaces`, func() {
@@ -311,6 +318,56 @@ func TestDatastore(t *testing.T) {
 					So(err, ShouldEqual, ds.ErrNoSuchEntity)
 				})
 			})
+
+			Convey(`Delivers transactional tasks only on commit.`, func() {
+				tqt.ResetTasks()
+				outbox := ds.NewQuery(TaskOutboxKind).KeysOnly(true)
+
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					So(tq.Add(c, "", &tq.Task{Path: "/committed"}), ShouldBeNil)
+
+					// Not delivered before the commit.
+					So(len(tqt.GetScheduledTasks()["default"]), ShouldEqual, 0)
+					return nil
+				}, nil), ShouldBeNil)
+
+				scheduled := tqt.GetScheduledTasks()["default"]
+				So(len(scheduled), ShouldEqual, 1)
+				for _, t := range scheduled {
+					So(t.Path, ShouldEqual, "/committed")
+				}
+
+				// The outbox is cleaned up after delivery.
+				var keys []*ds.Key
+				So(ds.GetAll(c, outbox, &keys), ShouldBeNil)
+				So(keys, ShouldBeEmpty)
+
+				testError := errors.New("test error")
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					So(tq.Add(c, "", &tq.Task{Path: "/failed"}), ShouldBeNil)
+					return testError
+				}, nil), ShouldEqual, testError)
+
+				So(len(tqt.GetScheduledTasks()["default"]), ShouldEqual, 1)
+				So(ds.GetAll(c, outbox, &keys), ShouldBeNil)
+				So(keys, ShouldBeEmpty)
+			})
+
+			Convey(`Can flush undelivered tasks from the outbox.`, func() {
+				tqt.ResetTasks()
+
+				task, err := json.Marshal(&tq.Task{Path: "/stuck"})
+				So(err, ShouldBeNil)
+				ent := &outboxEntry{Queue: "default", Task: task, Created: testTime}
+				So(ds.Put(c, ent), ShouldBeNil)
+
+				// Twice, to confirm that delivery is idempotent.
+				for i := 0; i < 2; i++ {
+					So(FlushTaskOutbox(c, time.Minute), ShouldBeNil)
+					So(len(tqt.GetScheduledTasks()["default"]), ShouldEqual, 1)
+				}
+				So(ds.Get(c, &outboxEntry{ID: ent.ID}), ShouldEqual, ds.ErrNoSuchEntity)
+			})
 		})
 	})
 }
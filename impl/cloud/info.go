@@ -5,17 +5,113 @@
 package cloud
 
 import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	infoS "github.com/luci/gae/service/info"
 	"github.com/luci/gae/service/info/support"
 
+	"github.com/luci/luci-go/common/clock"
 	"github.com/luci/luci-go/common/errors"
+	log "github.com/luci/luci-go/common/logging"
 
 	"golang.org/x/net/context"
 )
 
-var errNotImplemented = errors.New("not implemented")
+var (
+	errNoSigner = errors.New("cloud: no Signer is configured")
+)
+
+// Environment variables of the App Engine environments, which take
+// precedence over the metadata server.
+const (
+	envProject  = "GOOGLE_CLOUD_PROJECT"
+	envService  = "GAE_SERVICE"
+	envVersion  = "GAE_VERSION"
+	envInstance = "GAE_INSTANCE"
+	envEnv      = "GAE_ENV"
+)
+
+// metadataRetryDelay is how long a failed lookup of the metadata server is
+// cached, so that the info methods don't each wait for an unreachable server.
+const metadataRetryDelay = time.Minute
+
+// serviceIdentity resolves the identity of the running service, from the
+// environment and from the metadata server. It's shared by all the contexts
+// derived from the same Config.Use.
+type serviceIdentity struct {
+	md     *Metadata
+	signer Signer
+	getenv func(string) string
+
+	lock sync.Mutex
+	// values caches the values fetched from the metadata server, by path.
+	values map[string]metadataValue
+}
+
+// metadataValue is the cached result of a lookup of the metadata server.
+type metadataValue struct {
+	v   string
+	err error
+	// expiry is when a failed lookup may be retried.
+	expiry time.Time
+}
+
+func newServiceIdentity(md *Metadata, signer Signer) *serviceIdentity {
+	return &serviceIdentity{
+		md:     md,
+		signer: signer,
+		getenv: os.Getenv,
+	}
+}
+
+// get returns the value of the environment variable env if it's set, and
+// otherwise the value of the metadata at path (if not empty).
+func (si *serviceIdentity) get(c context.Context, env, path string) (string, error) {
+	if env != "" {
+		if v := si.getenv(env); v != "" {
+			return v, nil
+		}
+	}
+	if path == "" {
+		return "", fmt.Errorf("%s is not set", env)
+	}
+
+	si.lock.Lock()
+	mv, ok := si.values[path]
+	si.lock.Unlock()
+	if ok && (mv.err == nil || clock.Now(c).Before(mv.expiry)) {
+		return mv.v, mv.err
+	}
+
+	v, err := si.md.get(c, si.getenv, path, nil)
+	mv = metadataValue{v: v, err: err}
+	if err != nil {
+		mv.expiry = clock.Now(c).Add(metadataRetryDelay)
+	}
+
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	if si.values == nil {
+		si.values = map[string]metadataValue{}
+	}
+	si.values[path] = mv
+	return v, err
+}
+
+// mustGet is get, for the info methods which can't return errors. Errors are
+// logged, and result in the empty string.
+func (si *serviceIdentity) mustGet(c context.Context, env, path string) string {
+	v, err := si.get(c, env, path)
+	if err != nil {
+		(log.Fields{log.ErrorKey: err}).Errorf(c, "cloud: failed to get the %s/%q info", env, path)
+	}
+	return v
+}
 
 // cloudInfo is a reconstruction of the info service for the cloud API.
 //
@@ -23,6 +119,8 @@ var errNotImplemented = errors.New("not implemented")
 type infoState struct {
 	// namespace is the current namesapce, or the empty string for no namespace.
 	namespace string
+
+	*serviceIdentity
 }
 
 var infoStateKey = "*cloud.infoState"
@@ -49,8 +147,8 @@ type infoService struct {
 	*infoState
 }
 
-func useInfo(c context.Context) context.Context {
-	var baseInfoState infoState
+func useInfo(c context.Context, si *serviceIdentity) context.Context {
+	baseInfoState := infoState{serviceIdentity: si}
 	c = baseInfoState.use(c)
 
 	return infoS.SetFactory(c, func(ic context.Context) infoS.RawInterface {
@@ -61,24 +159,112 @@ func useInfo(c context.Context) context.Context {
 	})
 }
 
-func (*infoService) AppID() string               { panic(errNotImplemented) }
-func (*infoService) FullyQualifiedAppID() string { return "" }
-func (i *infoService) GetNamespace() string      { return i.namespace }
-func (*infoService) IsDevAppServer() bool        { return false }
+func (i *infoService) AppID() string {
+	return i.mustGet(i, envProject, "project/project-id")
+}
 
-func (*infoService) Datacenter() string             { panic(errNotImplemented) }
-func (*infoService) DefaultVersionHostname() string { panic(errNotImplemented) }
-func (*infoService) InstanceID() string             { panic(errNotImplemented) }
-func (*infoService) IsOverQuota(err error) bool     { panic(errNotImplemented) }
-func (*infoService) IsTimeoutError(err error) bool  { panic(errNotImplemented) }
-func (*infoService) ModuleHostname(module, version, instance string) (string, error) {
-	return "", errNotImplemented
+// FullyQualifiedAppID returns the app ID, which has no partition prefix in the
+// cloud.
+func (i *infoService) FullyQualifiedAppID() string { return i.AppID() }
+func (i *infoService) GetNamespace() string        { return i.namespace }
+func (*infoService) IsDevAppServer() bool          { return false }
+
+func (i *infoService) Datacenter() string {
+	// "projects/<number>/zones/<zone>"
+	zone := i.mustGet(i, "", "instance/zone")
+	return zone[strings.LastIndex(zone, "/")+1:]
+}
+
+// DefaultVersionHostname returns the appspot.com hostname of the app, or an
+// empty string if the app ID is unknown.
+func (i *infoService) DefaultVersionHostname() string {
+	appID := i.AppID()
+	if appID == "" {
+		return ""
+	}
+	return appID + ".appspot.com"
+}
+
+func (i *infoService) InstanceID() string {
+	return i.mustGet(i, envInstance, "instance/id")
+}
+
+// IsOverQuota returns false, since the cloud services report no quota errors of
+// their own.
+func (*infoService) IsOverQuota(err error) bool { return false }
+
+// IsTimeoutError returns true if err is the error of an expired context, or a
+// network timeout.
+func (*infoService) IsTimeoutError(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// ModuleHostname returns the "-dot-" separated hostname of a version of a
+// module, under the default appspot.com domain. An empty module is the current
+// module, and an empty version is its default version. Instances can't be
+// addressed.
+func (i *infoService) ModuleHostname(module, version, instance string) (string, error) {
+	if instance != "" {
+		return "", errors.New("cloud: instances can't be addressed")
+	}
+	appID := i.AppID()
+	if appID == "" {
+		return "", errors.New("cloud: the app ID is unknown")
+	}
+	if module == "" {
+		module = i.ModuleName()
+	}
+	parts := []string{}
+	if version != "" {
+		parts = append(parts, version)
+	}
+	if module != "default" {
+		parts = append(parts, module)
+	}
+	return strings.Join(append(parts, appID), "-dot-") + ".appspot.com", nil
+}
+
+func (i *infoService) ModuleName() string {
+	if v, err := i.get(i, envService, ""); err == nil {
+		return v
+	}
+	return "default"
+}
+
+// RequestID returns the ID of the request bound to the context with
+// WithRequest, or an empty string if there's none.
+func (i *infoService) RequestID() string {
+	if rs := getRequestState(i); rs != nil {
+		return rs.requestID()
+	}
+	return ""
+}
+
+// ServerSoftware returns "Google App Engine/" followed by the environment (e.g.
+// "Google App Engine/standard") in the App Engine environments which tell it,
+// "Google App Engine/Flex" in the flexible environment, and "Google Cloud"
+// elsewhere.
+func (i *infoService) ServerSoftware() string {
+	if env, err := i.get(i, envEnv, ""); err == nil {
+		return "Google App Engine/" + env
+	}
+	if _, err := i.get(i, envInstance, ""); err == nil {
+		return "Google App Engine/Flex"
+	}
+	return "Google Cloud"
+}
+
+func (i *infoService) ServiceAccount() (string, error) {
+	return i.get(i, "", "instance/service-accounts/default/email")
+}
+
+func (i *infoService) VersionID() string {
+	return i.mustGet(i, envVersion, "")
 }
-func (*infoService) ModuleName() string              { panic(errNotImplemented) }
-func (*infoService) RequestID() string               { panic(errNotImplemented) }
-func (*infoService) ServerSoftware() string          { panic(errNotImplemented) }
-func (*infoService) ServiceAccount() (string, error) { return "", errNotImplemented }
-func (*infoService) VersionID() string               { panic(errNotImplemented) }
 
 func (i *infoService) Namespace(namespace string) (context.Context, error) {
 	if err := support.ValidNamespace(namespace); err != nil {
@@ -90,16 +276,22 @@ func (i *infoService) Namespace(namespace string) (context.Context, error) {
 	}).use(i), nil
 }
 
-func (*infoService) AccessToken(scopes ...string) (token string, expiry time.Time, err error) {
-	return "", time.Time{}, errNotImplemented
+func (i *infoService) AccessToken(scopes ...string) (token string, expiry time.Time, err error) {
+	return i.md.accessToken(i, i.getenv, scopes)
 }
 
-func (*infoService) PublicCertificates() ([]infoS.Certificate, error) {
-	return nil, errNotImplemented
+func (i *infoService) PublicCertificates() ([]infoS.Certificate, error) {
+	if i.signer == nil {
+		return nil, errNoSigner
+	}
+	return i.signer.PublicCertificates(i)
 }
 
-func (*infoService) SignBytes(bytes []byte) (keyName string, signature []byte, err error) {
-	return "", nil, errNotImplemented
+func (i *infoService) SignBytes(bytes []byte) (keyName string, signature []byte, err error) {
+	if i.signer == nil {
+		return "", nil, errNoSigner
+	}
+	return i.signer.SignBytes(i, bytes)
 }
 
 func (*infoService) GetTestable() infoS.Testable { return nil }
@@ -5,11 +5,18 @@
 package cloud
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/luci/gae/service/info"
+	"github.com/luci/luci-go/common/clock/testclock"
 
 	"golang.org/x/net/context"
 
@@ -23,7 +30,7 @@ func TestInfo(t *testing.T) {
 	Convey(`A testing Info service`, t, func() {
 		const maxNamespaceLen = 100
 
-		c := useInfo(context.Background())
+		c := useInfo(context.Background(), newServiceIdentity(nil, nil))
 
 		Convey(`Can set valid namespaces.`, func() {
 			for _, v := range []string{
@@ -53,3 +60,172 @@ func TestInfo(t *testing.T) {
 		})
 	})
 }
+
+// fakeMetadata is a fake metadata server.
+type fakeMetadata struct {
+	values   map[string]string
+	requests []string
+}
+
+func (fm *fakeMetadata) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Metadata-Flavor") != "Google" {
+		http.Error(rw, "missing Metadata-Flavor", http.StatusForbidden)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/computeMetadata/v1/")
+	if req.URL.RawQuery != "" {
+		path += "?" + req.URL.RawQuery
+	}
+	fm.requests = append(fm.requests, path)
+	v, ok := fm.values[path]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	fmt.Fprint(rw, v)
+}
+
+func TestInfoIdentity(t *testing.T) {
+	t.Parallel()
+
+	Convey(`An Info service backed by a metadata server`, t, func() {
+		now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+		c, tc := testclock.UseTime(context.Background(), now)
+
+		fm := &fakeMetadata{values: map[string]string{
+			"project/project-id": "md-project",
+			"instance/zone":      "projects/1234/zones/us-central1-f",
+			"instance/id":        "12345",
+			"instance/service-accounts/default/email":              "sa@md-project.iam.gserviceaccount.com",
+			"instance/service-accounts/default/token":              `{"access_token":"tok","expires_in":60}`,
+			"instance/service-accounts/default/token?scopes=a%2Cb": `{"access_token":"tok-ab","expires_in":30}`,
+		}}
+		srv := httptest.NewServer(fm)
+		defer srv.Close()
+
+		env := map[string]string{}
+		si := newServiceIdentity(&Metadata{Host: strings.TrimPrefix(srv.URL, "http://")}, nil)
+		si.getenv = func(k string) string { return env[k] }
+		c = useInfo(c, si)
+
+		Convey(`Uses the metadata server`, func() {
+			So(info.AppID(c), ShouldEqual, "md-project")
+			So(info.Datacenter(c), ShouldEqual, "us-central1-f")
+			So(info.InstanceID(c), ShouldEqual, "12345")
+			So(info.ModuleName(c), ShouldEqual, "default")
+			So(info.DefaultVersionHostname(c), ShouldEqual, "md-project.appspot.com")
+
+			sa, err := info.ServiceAccount(c)
+			So(err, ShouldBeNil)
+			So(sa, ShouldEqual, "sa@md-project.iam.gserviceaccount.com")
+
+			Convey(`and caches its values`, func() {
+				fm.requests = nil
+				So(info.AppID(c), ShouldEqual, "md-project")
+				So(fm.requests, ShouldBeEmpty)
+			})
+		})
+
+		Convey(`Caches failed lookups for a while`, func() {
+			delete(fm.values, "instance/zone")
+			So(info.Datacenter(c), ShouldEqual, "")
+			So(fm.requests, ShouldResemble, []string{"instance/zone"})
+
+			_, err := si.get(c, "", "instance/zone")
+			So(err, ShouldErrLike, "HTTP 404")
+			So(fm.requests, ShouldResemble, []string{"instance/zone"})
+
+			fm.values["instance/zone"] = "projects/1234/zones/europe-west1-b"
+			tc.Add(metadataRetryDelay)
+			So(info.Datacenter(c), ShouldEqual, "europe-west1-b")
+			So(fm.requests, ShouldResemble, []string{"instance/zone", "instance/zone"})
+		})
+
+		Convey(`Can't address modules without an app ID`, func() {
+			delete(fm.values, "project/project-id")
+			_, err := info.ModuleHostname(c, "", "", "")
+			So(err, ShouldErrLike, "the app ID is unknown")
+			So(info.DefaultVersionHostname(c), ShouldEqual, "")
+		})
+
+		Convey(`Describes the environment`, func() {
+			So(info.FullyQualifiedAppID(c), ShouldEqual, "md-project")
+			So(info.IsOverQuota(c, fmt.Errorf("over quota")), ShouldBeFalse)
+			So(info.IsTimeoutError(c, context.DeadlineExceeded), ShouldBeTrue)
+			So(info.IsTimeoutError(c, fmt.Errorf("timeout")), ShouldBeFalse)
+
+			So(info.ServerSoftware(c), ShouldEqual, "Google Cloud")
+			env[envInstance] = "inst"
+			So(info.ServerSoftware(c), ShouldEqual, "Google App Engine/Flex")
+			env[envEnv] = "standard"
+			So(info.ServerSoftware(c), ShouldEqual, "Google App Engine/standard")
+		})
+
+		Convey(`Finds the metadata server from the environment`, func() {
+			env[metadataHostEnv] = strings.TrimPrefix(srv.URL, "http://")
+			si := newServiceIdentity(nil, nil)
+			si.getenv = func(k string) string { return env[k] }
+			c := useInfo(c, si)
+
+			So(info.AppID(c), ShouldEqual, "md-project")
+			tok, _, err := info.AccessToken(c)
+			So(err, ShouldBeNil)
+			So(tok, ShouldEqual, "tok")
+		})
+
+		Convey(`Prefers the environment`, func() {
+			env[envProject] = "env-project"
+			env[envService] = "svc"
+			env[envVersion] = "v1"
+			env[envInstance] = "inst"
+
+			So(info.AppID(c), ShouldEqual, "env-project")
+			So(info.ModuleName(c), ShouldEqual, "svc")
+			So(info.VersionID(c), ShouldEqual, "v1")
+			So(info.InstanceID(c), ShouldEqual, "inst")
+
+			host, err := info.ModuleHostname(c, "", "v2", "")
+			So(err, ShouldBeNil)
+			So(host, ShouldEqual, "v2-dot-svc-dot-env-project.appspot.com")
+
+			host, err = info.ModuleHostname(c, "default", "", "")
+			So(err, ShouldBeNil)
+			So(host, ShouldEqual, "env-project.appspot.com")
+		})
+
+		Convey(`Mints access tokens`, func() {
+			tok, exp, err := info.AccessToken(c)
+			So(err, ShouldBeNil)
+			So(tok, ShouldEqual, "tok")
+			So(exp, ShouldResemble, now.Add(time.Minute))
+
+			tok, exp, err = info.AccessToken(c, "a", "b")
+			So(err, ShouldBeNil)
+			So(tok, ShouldEqual, "tok-ab")
+			So(exp, ShouldResemble, now.Add(30*time.Second))
+
+			delete(fm.values, "instance/service-accounts/default/token")
+			_, _, err = info.AccessToken(c)
+			So(err, ShouldErrLike, "HTTP 404")
+		})
+
+		Convey(`Signs bytes`, func() {
+			_, _, err := info.SignBytes(c, []byte("hi"))
+			So(err, ShouldEqual, errNoSigner)
+
+			key, err := rsa.GenerateKey(rand.Reader, 1024)
+			So(err, ShouldBeNil)
+			si.signer = &KeySigner{KeyName: "key", Key: key, Certificate: []byte("CERT")}
+
+			keyName, sig, err := info.SignBytes(c, []byte("hi"))
+			So(err, ShouldBeNil)
+			So(keyName, ShouldEqual, "key")
+			cert := &x509.Certificate{PublicKey: &key.PublicKey}
+			So(cert.CheckSignature(x509.SHA256WithRSA, []byte("hi"), sig), ShouldBeNil)
+
+			certs, err := info.PublicCertificates(c)
+			So(err, ShouldBeNil)
+			So(certs, ShouldResemble, []info.Certificate{{KeyName: "key", Data: []byte("CERT")}})
+		})
+	})
+}
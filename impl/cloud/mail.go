@@ -0,0 +1,215 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	net_mail "net/mail"
+	"net/smtp"
+	"time"
+
+	"github.com/luci/gae/service/mail"
+	"github.com/luci/gae/service/mail/support"
+	"github.com/luci/gae/service/user"
+
+	"github.com/luci/luci-go/common/clock"
+	"github.com/luci/luci-go/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// SMTPConfig configures the mail service, which delivers the messages through
+// an SMTP server.
+//
+// The messages are validated like App Engine does (see support.CheckMessage)
+// before being delivered.
+type SMTPConfig struct {
+	// Addr is the "host:port" address of the SMTP server.
+	Addr string
+
+	// LocalName is the host name sent to the server with EHLO. If empty,
+	// "localhost" is used.
+	LocalName string
+
+	// TLSConfig configures the TLS connection, if the server supports STARTTLS.
+	// If nil, the server's certificate is verified against the host of Addr.
+	TLSConfig *tls.Config
+	// RequireTLS fails the delivery if the server doesn't support STARTTLS.
+	RequireTLS bool
+
+	// Auth authenticates the client to the server (e.g. smtp.PlainAuth), if not
+	// nil.
+	Auth smtp.Auth
+
+	// Admins are the addresses of the administrators of the application, to
+	// which SendToAdmins delivers the messages. They are allowed senders.
+	Admins []string
+	// Senders are additional allowed senders, e.g. a "noreply" address.
+	Senders []string
+	// AllowUserSender allows the signed-in user (see user.Current) to send
+	// messages, like on App Engine. It requires the user service to be
+	// installed.
+	AllowUserSender bool
+
+	// Timeout is the timeout of the delivery of a message, if the context has
+	// no earlier deadline. If zero, there's no timeout.
+	Timeout time.Duration
+}
+
+type smtpMail struct {
+	context.Context
+	cfg *SMTPConfig
+}
+
+var _ mail.RawInterface = (*smtpMail)(nil)
+
+func (cfg *SMTPConfig) use(c context.Context) context.Context {
+	return mail.SetFactory(c, func(ic context.Context) mail.RawInterface {
+		return &smtpMail{ic, cfg}
+	})
+}
+
+func (m *smtpMail) Send(msg *mail.Message) error {
+	return m.send(msg.Copy())
+}
+
+// SendToAdmins sends msg to the Admins, instead of its To recipients.
+func (m *smtpMail) SendToAdmins(msg *mail.Message) error {
+	if len(m.cfg.Admins) == 0 {
+		return errors.New("cloud: no admins are configured")
+	}
+	msg = msg.Copy()
+	msg.To = append([]string(nil), m.cfg.Admins...)
+	return m.send(msg)
+}
+
+func (m *smtpMail) GetTestable() mail.Testable { return nil }
+
+// senders returns the allowed senders.
+func (m *smtpMail) senders() []string {
+	senders := make([]string, 0, len(m.cfg.Admins)+len(m.cfg.Senders)+1)
+	for _, lists := range [][]string{m.cfg.Admins, m.cfg.Senders} {
+		for _, s := range lists {
+			if adr, err := net_mail.ParseAddress(s); err == nil {
+				senders = append(senders, adr.Address)
+			}
+		}
+	}
+	if m.cfg.AllowUserSender {
+		if u := user.Current(m); u != nil {
+			senders = append(senders, u.Email)
+		}
+	}
+	return senders
+}
+
+func (m *smtpMail) send(msg *mail.Message) error {
+	mimeTypes, err := support.CheckMessage(msg, m.senders()...)
+	if err != nil {
+		return err
+	}
+	data, err := support.BuildMessage(msg, mimeTypes, clock.Now(m))
+	if err != nil {
+		return err
+	}
+
+	c := m.Context
+	if m.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		c, cancel = clock.WithTimeout(c, m.cfg.Timeout)
+		defer cancel()
+	}
+	return m.deliver(c, msg, data)
+}
+
+// deliver sends data, the message built from msg, to the SMTP server.
+func (m *smtpMail) deliver(c context.Context, msg *mail.Message, data []byte) error {
+	host, _, err := net.SplitHostPort(m.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("cloud: invalid SMTP address %q: %s", m.cfg.Addr, err)
+	}
+
+	conn, err := (&net.Dialer{Cancel: c.Done()}).Dial("tcp", m.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	// Interrupt the session when c is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	localName := m.cfg.LocalName
+	if localName == "" {
+		localName = "localhost"
+	}
+	if err := client.Hello(localName); err != nil {
+		return err
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		tlsConfig := m.cfg.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: host}
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	} else if m.cfg.RequireTLS {
+		return fmt.Errorf("cloud: the SMTP server %s doesn't support STARTTLS", m.cfg.Addr)
+	}
+
+	if m.cfg.Auth != nil {
+		if err := client.Auth(m.cfg.Auth); err != nil {
+			return err
+		}
+	}
+
+	sender, err := net_mail.ParseAddress(msg.Sender)
+	if err != nil {
+		return err
+	}
+	if err := client.Mail(sender.Address); err != nil {
+		return err
+	}
+	for _, lists := range [][]string{msg.To, msg.Cc, msg.Bcc} {
+		for _, rcpt := range lists {
+			adr, err := net_mail.ParseAddress(rcpt)
+			if err != nil {
+				return err
+			}
+			if err := client.Rcpt(adr.Address); err != nil {
+				return err
+			}
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,395 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	net_mail "net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luci/gae/service/mail"
+	"github.com/luci/luci-go/common/clock/testclock"
+
+	"golang.org/x/net/context"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// smtpSession is a mail transaction received by fakeSMTP.
+type smtpSession struct {
+	TLS  bool
+	User string
+	From string
+	To   []string
+	Data []byte
+}
+
+// fakeSMTP is an in-process SMTP server, which records the messages it
+// receives.
+type fakeSMTP struct {
+	l net.Listener
+
+	// tls enables STARTTLS, if not nil.
+	tls *tls.Config
+	// user and password enable AUTH PLAIN, if not empty.
+	user, password string
+
+	lock     sync.Mutex
+	sessions []*smtpSession
+}
+
+func newFakeSMTP(tlsConfig *tls.Config, user, password string) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &fakeSMTP{l: l, tls: tlsConfig, user: user, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) Addr() string { return s.l.Addr().String() }
+func (s *fakeSMTP) Close()       { s.l.Close() }
+
+func (s *fakeSMTP) Sessions() []*smtpSession {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*smtpSession(nil), s.sessions...)
+}
+
+func (s *fakeSMTP) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	sess := &smtpSession{}
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if idx := strings.IndexByte(line, ' '); idx >= 0 {
+			verb, arg = line[:idx], line[idx+1:]
+		}
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			exts := []string{"fake"}
+			if s.tls != nil && !sess.TLS {
+				exts = append(exts, "STARTTLS")
+			}
+			if s.user != "" {
+				exts = append(exts, "AUTH PLAIN")
+			}
+			for i, ext := range exts {
+				sep := "-"
+				if i == len(exts)-1 {
+					sep = " "
+				}
+				tc.PrintfLine("250%s%s", sep, ext)
+			}
+
+		case "STARTTLS":
+			tc.PrintfLine("220 go ahead")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, tc = tlsConn, textproto.NewConn(tlsConn)
+			sess.TLS = true
+
+		case "AUTH":
+			// "PLAIN <base64 of \x00user\x00password>"
+			fields := strings.Fields(arg)
+			creds := []byte(nil)
+			if len(fields) == 2 && fields[0] == "PLAIN" {
+				creds, _ = base64.StdEncoding.DecodeString(fields[1])
+			}
+			if parts := bytes.Split(creds, []byte{0}); len(parts) == 3 &&
+				string(parts[1]) == s.user && string(parts[2]) == s.password {
+				sess.User = s.user
+				tc.PrintfLine("235 authenticated")
+			} else {
+				tc.PrintfLine("535 authentication failed")
+			}
+
+		case "MAIL":
+			sess.From = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tc.PrintfLine("250 ok")
+
+		case "RCPT":
+			sess.To = append(sess.To, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tc.PrintfLine("250 ok")
+
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			data, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			sess.Data = data
+			s.lock.Lock()
+			s.sessions = append(s.sessions, sess)
+			s.lock.Unlock()
+			tc.PrintfLine("250 queued")
+
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+
+		default:
+			tc.PrintfLine("250 ok")
+		}
+	}
+}
+
+// selfSignedTLS returns the TLS configurations of a server with a self-signed
+// certificate for 127.0.0.1, and of a client trusting it.
+func selfSignedTLS() (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake SMTP"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return
+}
+
+func TestSMTPMail(t *testing.T) {
+	t.Parallel()
+
+	Convey(`An SMTP mail service`, t, func() {
+		c, _ := testclock.UseTime(context.Background(), testclock.TestTimeUTC)
+
+		srv := newFakeSMTP(nil, "", "")
+		defer srv.Close()
+
+		cfg := &SMTPConfig{
+			Addr:    srv.Addr(),
+			Admins:  []string{"Admin <admin@example.com>"},
+			Senders: []string{"noreply@example.com"},
+			Timeout: time.Minute,
+		}
+		c = cfg.use(c)
+
+		msg := &mail.Message{
+			Sender:  "noreply@example.com",
+			To:      []string{"Someone <someone@example.com>"},
+			Cc:      []string{"cc@example.com"},
+			Bcc:     []string{"bcc@example.com"},
+			Subject: "Hello",
+			Body:    "Hello, world!",
+		}
+
+		Convey(`Delivers messages`, func() {
+			So(mail.Send(c, msg), ShouldBeNil)
+
+			sessions := srv.Sessions()
+			So(sessions, ShouldHaveLength, 1)
+			So(sessions[0].From, ShouldEqual, "noreply@example.com")
+			So(sessions[0].To, ShouldResemble, []string{"someone@example.com", "cc@example.com", "bcc@example.com"})
+
+			m, err := net_mail.ReadMessage(bytes.NewReader(sessions[0].Data))
+			So(err, ShouldBeNil)
+			So(m.Header.Get("From"), ShouldEqual, "noreply@example.com")
+			So(m.Header.Get("To"), ShouldEqual, "Someone <someone@example.com>")
+			So(m.Header.Get("Cc"), ShouldEqual, "cc@example.com")
+			So(m.Header.Get("Bcc"), ShouldEqual, "")
+			So(m.Header.Get("Subject"), ShouldEqual, "Hello")
+			So(m.Header.Get("Date"), ShouldEqual, testclock.TestTimeUTC.Format(time.RFC1123Z))
+			So(m.Header.Get("Content-Type"), ShouldEqual, "text/plain; charset=utf-8")
+			body, err := ioutil.ReadAll(m.Body)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "Hello, world!")
+		})
+
+		Convey(`Sends messages to the admins`, func() {
+			So(mail.SendToAdmins(c, msg), ShouldBeNil)
+
+			sessions := srv.Sessions()
+			So(sessions, ShouldHaveLength, 1)
+			So(sessions[0].To, ShouldResemble, []string{"admin@example.com", "cc@example.com", "bcc@example.com"})
+		})
+
+		Convey(`Validates messages`, func() {
+			msg.Sender = "someone@example.com"
+			So(mail.Send(c, msg), ShouldErrLike, "invalid Sender: someone@example.com")
+
+			msg.Sender = "admin@example.com"
+			msg.Attachments = []mail.Attachment{{Name: "evil.exe", Data: []byte("MZ")}}
+			So(mail.Send(c, msg), ShouldErrLike, `illegal attachment extension for "evil.exe"`)
+
+			// CR and LF would inject headers into the message.
+			msg.Attachments = nil
+			msg.ReplyTo = "reply@example.com\r\nBcc: spam@example.com"
+			So(mail.Send(c, msg), ShouldErrLike, "unparsable ReplyTo address")
+
+			msg.ReplyTo = ""
+			msg.Headers = net_mail.Header{"In-Reply-To": {"<1@example.com>\r\n\r\nInjected body"}}
+			So(mail.Send(c, msg), ShouldErrLike, "invalid value of header In-Reply-To")
+
+			msg.Headers = nil
+			msg.Attachments = []mail.Attachment{{Name: "logo.png", Data: []byte("PNG"), ContentID: "x>\r\nContent-Type: text/html"}}
+			So(mail.Send(c, msg), ShouldErrLike, "invalid Content-ID of attachment logo.png")
+
+			msg.Attachments = []mail.Attachment{{Name: "logo\r\n.png", Data: []byte("PNG")}}
+			So(mail.Send(c, msg), ShouldErrLike, "invalid attachment name")
+
+			So(srv.Sessions(), ShouldHaveLength, 0)
+		})
+
+		Convey(`Allows the signed-in user to send messages if configured to`, func() {
+			c := (&UserConfig{TrustAppEngineHeaders: true}).use(c)
+			req, err := http.NewRequest("GET", "https://app.example.com/", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("X-AppEngine-User-Email", "someone@example.com")
+			c = WithRequest(c, req)
+
+			msg.Sender = "someone@example.com"
+			So(mail.Send(c, msg), ShouldErrLike, "invalid Sender")
+
+			cfg.AllowUserSender = true
+			So(mail.Send(c, msg), ShouldBeNil)
+		})
+
+		Convey(`Builds multipart messages`, func() {
+			msg.HTMLBody = `<p>Hello, <img src="cid:logo"></p>`
+			msg.Attachments = []mail.Attachment{
+				{Name: "logo.png", Data: []byte("\x89PNG..."), ContentID: "logo"},
+				{Name: "report.pdf", Data: []byte("%PDF...")},
+			}
+			msg.Headers = net_mail.Header{"in-reply-to": {"<123@example.com>"}}
+			So(mail.Send(c, msg), ShouldBeNil)
+
+			sessions := srv.Sessions()
+			So(sessions, ShouldHaveLength, 1)
+			m, err := net_mail.ReadMessage(bytes.NewReader(sessions[0].Data))
+			So(err, ShouldBeNil)
+			So(m.Header.Get("In-Reply-To"), ShouldEqual, "<123@example.com>")
+
+			mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+			So(err, ShouldBeNil)
+			So(mediaType, ShouldEqual, "multipart/mixed")
+			mixed := multipart.NewReader(m.Body, params["boundary"])
+
+			// The body.
+			part, err := mixed.NextPart()
+			So(err, ShouldBeNil)
+			mediaType, params, err = mime.ParseMediaType(part.Header.Get("Content-Type"))
+			So(err, ShouldBeNil)
+			So(mediaType, ShouldEqual, "multipart/alternative")
+			alternative := multipart.NewReader(part, params["boundary"])
+			for _, expected := range []struct{ contentType, text string }{
+				{"text/plain; charset=utf-8", msg.Body},
+				{"text/html; charset=utf-8", msg.HTMLBody},
+			} {
+				part, err := alternative.NextPart()
+				So(err, ShouldBeNil)
+				So(part.Header.Get("Content-Type"), ShouldEqual, expected.contentType)
+				// The multipart reader decodes quoted-printable parts.
+				text, err := ioutil.ReadAll(part)
+				So(err, ShouldBeNil)
+				So(string(text), ShouldEqual, expected.text)
+			}
+
+			// The attachments.
+			for _, expected := range []struct {
+				contentType, disposition, contentID string
+				data                                []byte
+			}{
+				{`image/png; name=logo.png`, `inline; filename=logo.png`, "<logo>", msg.Attachments[0].Data},
+				{`application/pdf; name=report.pdf`, `attachment; filename=report.pdf`, "", msg.Attachments[1].Data},
+			} {
+				part, err := mixed.NextPart()
+				So(err, ShouldBeNil)
+				So(part.Header.Get("Content-Type"), ShouldEqual, expected.contentType)
+				So(part.Header.Get("Content-Disposition"), ShouldEqual, expected.disposition)
+				So(part.Header.Get("Content-ID"), ShouldEqual, expected.contentID)
+				enc, err := ioutil.ReadAll(part)
+				So(err, ShouldBeNil)
+				data, err := base64.StdEncoding.DecodeString(strings.Replace(string(enc), "\n", "", -1))
+				So(err, ShouldBeNil)
+				So(data, ShouldResemble, expected.data)
+			}
+		})
+
+		Convey(`Requires TLS if configured to`, func() {
+			cfg.RequireTLS = true
+			So(mail.Send(c, msg), ShouldErrLike, "doesn't support STARTTLS")
+		})
+
+		Convey(`Uses STARTTLS and authenticates`, func() {
+			serverTLS, clientTLS := selfSignedTLS()
+			srv := newFakeSMTP(serverTLS, "user", "secret")
+			defer srv.Close()
+
+			cfg.Addr = srv.Addr()
+			cfg.TLSConfig = clientTLS
+			cfg.RequireTLS = true
+			cfg.Auth = smtp.PlainAuth("", "user", "secret", "127.0.0.1")
+			So(mail.Send(c, msg), ShouldBeNil)
+
+			sessions := srv.Sessions()
+			So(sessions, ShouldHaveLength, 1)
+			So(sessions[0].TLS, ShouldBeTrue)
+			So(sessions[0].User, ShouldEqual, "user")
+
+			Convey(`with the right credentials only`, func() {
+				cfg.Auth = smtp.PlainAuth("", "user", "wrong", "127.0.0.1")
+				So(mail.Send(c, msg), ShouldErrLike, "authentication failed")
+			})
+		})
+	})
+}
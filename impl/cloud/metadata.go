@@ -0,0 +1,135 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/luci/luci-go/common/clock"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	// defaultMetadataHost is the host of the GCE metadata server.
+	defaultMetadataHost = "metadata.google.internal"
+
+	// metadataHostEnv is the environment variable which overrides the host of
+	// the metadata server, like in the official client libraries.
+	metadataHostEnv = "GCE_METADATA_HOST"
+
+	// metadataTimeout is the timeout of the requests made by the default client
+	// of the metadata server, which answers quickly when it's reachable at all.
+	metadataTimeout = 5 * time.Second
+)
+
+// defaultMetadataClient is the HTTP client used to reach the metadata server
+// if Metadata.Client is nil.
+var defaultMetadataClient = &http.Client{Timeout: metadataTimeout}
+
+// Metadata is a client of the GCE metadata server, from which the info service
+// gets the identity of the running instance.
+type Metadata struct {
+	// Host is the host (and port) of the metadata server. If empty, the
+	// GCE_METADATA_HOST environment variable is used, and then the GCE metadata
+	// server. Tests may point it to a local fake server.
+	Host string
+
+	// Client is the HTTP client used to reach the metadata server. If nil, a
+	// client with a short timeout is used.
+	Client *http.Client
+}
+
+// host returns the host of the metadata server, looking up the environment
+// with getenv.
+func (m *Metadata) host(getenv func(string) string) string {
+	if m != nil && m.Host != "" {
+		return m.Host
+	}
+	if host := getenv(metadataHostEnv); host != "" {
+		return host
+	}
+	return defaultMetadataHost
+}
+
+func (m *Metadata) client() *http.Client {
+	if m != nil && m.Client != nil {
+		return m.Client
+	}
+	return defaultMetadataClient
+}
+
+// Get returns the value of the metadata at path (e.g. "project/project-id"),
+// relative to "/computeMetadata/v1/".
+func (m *Metadata) Get(c context.Context, path string) (string, error) {
+	return m.get(c, os.Getenv, path, nil)
+}
+
+func (m *Metadata) get(c context.Context, getenv func(string) string, path string, query url.Values) (string, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     m.host(getenv),
+		Path:     "/computeMetadata/v1/" + path,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := ctxhttp.Do(c, m.client(), req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata: %q returned HTTP %d: %s", path, resp.StatusCode, body)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// AccessToken returns an OAuth2 access token of the default service account of
+// the instance, for the given scopes (or for the scopes of the instance, if
+// there are none).
+func (m *Metadata) AccessToken(c context.Context, scopes ...string) (token string, expiry time.Time, err error) {
+	return m.accessToken(c, os.Getenv, scopes)
+}
+
+func (m *Metadata) accessToken(c context.Context, getenv func(string) string, scopes []string) (token string, expiry time.Time, err error) {
+	query := url.Values(nil)
+	if len(scopes) > 0 {
+		query = url.Values{"scopes": {strings.Join(scopes, ",")}}
+	}
+	data, err := m.get(c, getenv, "instance/service-accounts/default/token", query)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(data), &resp); err != nil {
+		return "", time.Time{}, fmt.Errorf("metadata: invalid token response: %s", err)
+	}
+	if resp.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("metadata: no access token in the response")
+	}
+	return resp.AccessToken, clock.Now(c).Add(time.Duration(resp.ExpiresIn) * time.Second), nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	infoS "github.com/luci/gae/service/info"
+	"github.com/luci/gae/service/taskqueue"
+	"github.com/luci/gae/service/user"
+
+	"github.com/luci/luci-go/common/errors"
+	log "github.com/luci/luci-go/common/logging"
+
+	"golang.org/x/net/context"
+)
+
+// The headers of App Engine requests which aren't specific to a service.
+const (
+	namespaceHeader    = "X-AppEngine-Current-Namespace"
+	requestLogIDHeader = "X-AppEngine-Request-Log-Id"
+	traceContextHeader = "X-Cloud-Trace-Context"
+)
+
+var errNoRequest = errors.New("cloud: no request is bound to the context (see WithRequest)")
+
+// requestState is the request bound to a context, and the users authenticated
+// from it so far.
+type requestState struct {
+	req *http.Request
+
+	lock       sync.Mutex
+	userDone   bool
+	user       *user.User
+	oauthDone  bool
+	oauthUser  *user.User
+	oauthErr   error
+	oauthScope map[string]struct{}
+}
+
+var requestStateKey = "*cloud.requestState"
+
+// WithRequest returns a context for serving r, derived from c (which must have
+// the cloud services installed), the way appengine.NewContext does in
+// production:
+//   * X-AppEngine-Current-Namespace sets the namespace.
+//   * X-AppEngine-Request-Log-Id (or else the trace ID of
+//     X-Cloud-Trace-Context) is the request ID of info.
+//   * The user service authenticates the user of r (see UserConfig).
+//   * X-AppEngine-QueueName and the other task headers are available with
+//     taskqueue.GetRequestHeaders.
+//
+// Invalid headers are logged and ignored.
+func WithRequest(c context.Context, r *http.Request) context.Context {
+	c = context.WithValue(c, &requestStateKey, &requestState{req: r})
+
+	if ns := r.Header.Get(namespaceHeader); ns != "" {
+		nc, err := infoS.Namespace(c, ns)
+		if err != nil {
+			(log.Fields{log.ErrorKey: err}).Warningf(c, "cloud: ignoring the namespace %q of the request", ns)
+		} else {
+			c = nc
+		}
+	}
+
+	switch h, err := taskqueue.ParseRequestHeaders(r.Header); {
+	case err != nil:
+		(log.Fields{log.ErrorKey: err}).Warningf(c, "cloud: ignoring the task headers of the request")
+	case h != nil:
+		c = taskqueue.WithRequestHeaders(c, h)
+	}
+	return c
+}
+
+// Middleware returns an http.Handler which serves requests with h, in contexts
+// derived from c with WithRequest.
+func Middleware(c context.Context, h func(c context.Context, rw http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		h(WithRequest(c, r), rw, r)
+	})
+}
+
+func getRequestState(c context.Context) *requestState {
+	rs, _ := c.Value(&requestStateKey).(*requestState)
+	return rs
+}
+
+// requestID returns the ID of the request.
+func (rs *requestState) requestID() string {
+	if id := rs.req.Header.Get(requestLogIDHeader); id != "" {
+		return id
+	}
+	// "TRACE_ID/SPAN_ID;o=TRACE_TRUE"
+	trace := rs.req.Header.Get(traceContextHeader)
+	if idx := strings.IndexByte(trace, '/'); idx >= 0 {
+		trace = trace[:idx]
+	}
+	return trace
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/luci/gae/service/info"
+	"github.com/luci/gae/service/taskqueue"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWithRequest(t *testing.T) {
+	t.Parallel()
+
+	Convey(`A request context`, t, func() {
+		c := useInfo(context.Background(), newServiceIdentity(nil, nil))
+		req, err := http.NewRequest("POST", "https://app.example.com/task", nil)
+		So(err, ShouldBeNil)
+
+		Convey(`Has no request ID without a request`, func() {
+			So(info.RequestID(c), ShouldEqual, "")
+		})
+
+		Convey(`Gets the request ID from the headers`, func() {
+			req.Header.Set("X-Cloud-Trace-Context", "trace-id/123;o=1")
+			So(info.RequestID(WithRequest(c, req)), ShouldEqual, "trace-id")
+
+			req.Header.Set("X-AppEngine-Request-Log-Id", "log-id")
+			So(info.RequestID(WithRequest(c, req)), ShouldEqual, "log-id")
+		})
+
+		Convey(`Installs the namespace and the task headers`, func() {
+			req.Header.Set("X-AppEngine-Current-Namespace", "ns")
+			req.Header.Set(taskqueue.QueueNameHeader, "queue")
+			req.Header.Set(taskqueue.TaskNameHeader, "task")
+
+			ns, queue := "", ""
+			h := Middleware(c, func(c context.Context, rw http.ResponseWriter, r *http.Request) {
+				ns = info.GetNamespace(c)
+				queue = taskqueue.GetRequestHeaders(c).QueueName
+			})
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			So(ns, ShouldEqual, "ns")
+			So(queue, ShouldEqual, "queue")
+		})
+	})
+}
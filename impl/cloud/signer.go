@@ -0,0 +1,57 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+
+	infoS "github.com/luci/gae/service/info"
+
+	"golang.org/x/net/context"
+)
+
+// Signer signs bytes on behalf of the service account of the application, for
+// the info service's SignBytes and PublicCertificates.
+//
+// It may be implemented with a private key (see KeySigner), or with a remote
+// signing service such as the IAM signBlob API.
+type Signer interface {
+	// SignBytes signs bytes, and returns the name of the key it used.
+	SignBytes(c context.Context, bytes []byte) (keyName string, signature []byte, err error)
+
+	// PublicCertificates returns the certificates of the keys used by
+	// SignBytes.
+	PublicCertificates(c context.Context) ([]infoS.Certificate, error)
+}
+
+// KeySigner is a Signer which signs the SHA-256 hash of the bytes with an RSA
+// private key, using RSASSA-PKCS1-v1_5.
+type KeySigner struct {
+	// KeyName is the name of Key, returned by SignBytes.
+	KeyName string
+	// Key is the private key.
+	Key *rsa.PrivateKey
+	// Certificate is the PEM-encoded X.509 certificate of Key.
+	Certificate []byte
+}
+
+var _ Signer = (*KeySigner)(nil)
+
+// SignBytes implements Signer.
+func (s *KeySigner) SignBytes(c context.Context, bytes []byte) (keyName string, signature []byte, err error) {
+	hash := sha256.Sum256(bytes)
+	if signature, err = rsa.SignPKCS1v15(rand.Reader, s.Key, crypto.SHA256, hash[:]); err != nil {
+		return "", nil, err
+	}
+	return s.KeyName, signature, nil
+}
+
+// PublicCertificates implements Signer.
+func (s *KeySigner) PublicCertificates(c context.Context) ([]infoS.Certificate, error) {
+	return []infoS.Certificate{{KeyName: s.KeyName, Data: s.Certificate}}, nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	ds "github.com/luci/gae/service/datastore"
+	tq "github.com/luci/gae/service/taskqueue"
+
+	"github.com/luci/luci-go/common/clock"
+	"github.com/luci/luci-go/common/errors"
+	log "github.com/luci/luci-go/common/logging"
+
+	"golang.org/x/net/context"
+)
+
+// TaskOutboxKind is the datastore kind of the entities which hold the tasks
+// added inside of a transaction until that transaction commits.
+const TaskOutboxKind = "TaskOutbox"
+
+// outboxEntry is a single task waiting in the outbox.
+type outboxEntry struct {
+	_kind string `gae:"$kind,TaskOutbox"`
+	ID    int64  `gae:"$id"`
+
+	Queue   string `gae:",noindex"`
+	Task    []byte `gae:",noindex"`
+	Created time.Time
+}
+
+// taskName returns a name for the outbox entry's task which is stable across
+// deliveries, so that delivering an entry twice is harmless.
+func (e *outboxEntry) taskName(c context.Context) string {
+	h := sha256.Sum256([]byte(ds.KeyForObj(c, e).Encode()))
+	return "outbox-" + hex.EncodeToString(h[:16])
+}
+
+// taskOutbox collects the outbox entries written by a single transaction
+// attempt.
+type taskOutbox struct {
+	sync.Mutex
+
+	entries []*outboxEntry
+}
+
+func (ob *taskOutbox) add(ents []*outboxEntry) {
+	ob.Lock()
+	defer ob.Unlock()
+	ob.entries = append(ob.entries, ents...)
+}
+
+var taskOutboxKey = "*cloud.taskOutbox"
+
+func withTaskOutbox(c context.Context, ob *taskOutbox) context.Context {
+	return context.WithValue(c, &taskOutboxKey, ob)
+}
+
+func getTaskOutbox(c context.Context) *taskOutbox {
+	if ob, ok := c.Value(&taskOutboxKey).(*taskOutbox); ok {
+		return ob
+	}
+	return nil
+}
+
+// cloudTaskQueue installs a task queue service which delivers tasks to base.
+//
+// Tasks added inside of a datastore transaction are written to the outbox as
+// part of that transaction, and are delivered to base once it commits.
+type cloudTaskQueue struct {
+	base tq.RawInterface
+}
+
+func (ctq *cloudTaskQueue) use(c context.Context) context.Context {
+	return tq.SetRawFactory(c, func(ic context.Context) tq.RawInterface {
+		if ob := getTaskOutbox(ic); ob != nil {
+			return &outboxTaskQueue{ctq.base, ic, ob}
+		}
+		return ctq.base
+	})
+}
+
+// outboxTaskQueue is the transactional task queue.
+type outboxTaskQueue struct {
+	tq.RawInterface
+
+	ic context.Context
+	ob *taskOutbox
+}
+
+func (t *outboxTaskQueue) AddMulti(tasks []*tq.Task, queueName string, cb tq.RawTaskCB) error {
+	now := clock.Now(t.ic).UTC()
+	ents := make([]*outboxEntry, len(tasks))
+	for i, task := range tasks {
+		data, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		ents[i] = &outboxEntry{Queue: queueName, Task: data, Created: now}
+	}
+	if err := ds.Put(t.ic, ents); err != nil {
+		return err
+	}
+	t.ob.add(ents)
+
+	for _, task := range tasks {
+		// As in production, tasks added in a transaction have no meaningful name.
+		ret := task.Duplicate()
+		ret.Name = ""
+		cb(ret, nil)
+	}
+	return nil
+}
+
+func (t *outboxTaskQueue) DeleteMulti([]*tq.Task, string, tq.RawCB) error {
+	return errors.New("taskqueue: cannot DeleteMulti from a transaction")
+}
+
+func (t *outboxTaskQueue) Lease(int, string, time.Duration) ([]*tq.Task, error) {
+	return nil, errors.New("taskqueue: cannot Lease from a transaction")
+}
+
+func (t *outboxTaskQueue) LeaseByTag(int, string, time.Duration, string) ([]*tq.Task, error) {
+	return nil, errors.New("taskqueue: cannot LeaseByTag from a transaction")
+}
+
+func (t *outboxTaskQueue) ModifyLease(*tq.Task, string, time.Duration) error {
+	return errors.New("taskqueue: cannot ModifyLease from a transaction")
+}
+
+func (t *outboxTaskQueue) Purge(string) error {
+	return errors.New("taskqueue: cannot Purge from a transaction")
+}
+
+func (t *outboxTaskQueue) Stats([]string, tq.RawStatsCB) error {
+	return errors.New("taskqueue: cannot Stats from a transaction")
+}
+
+// deliverOutbox adds the tasks held by the supplied outbox entries to the
+// (non-transactional) task queue in c, and deletes the entries which were
+// delivered.
+//
+// Entries which could not be delivered are left in the datastore, to be picked
+// up by FlushTaskOutbox.
+func deliverOutbox(c context.Context, ents []*outboxEntry) error {
+	if len(ents) == 0 {
+		return nil
+	}
+
+	var (
+		lme       errors.MultiError
+		delivered []*outboxEntry
+	)
+
+	byQueue := map[string][]*outboxEntry{}
+	for _, e := range ents {
+		byQueue[e.Queue] = append(byQueue[e.Queue], e)
+	}
+	raw := tq.Raw(c)
+	for queueName, qents := range byQueue {
+		tasks := make([]*tq.Task, 0, len(qents))
+		decoded := make([]*outboxEntry, 0, len(qents))
+		for _, e := range qents {
+			task := &tq.Task{}
+			if err := json.Unmarshal(e.Task, task); err != nil {
+				lme = append(lme, err)
+				continue
+			}
+			if task.Name == "" {
+				task.Name = e.taskName(c)
+			}
+			tasks = append(tasks, task)
+			decoded = append(decoded, e)
+		}
+
+		i := 0
+		err := raw.AddMulti(tasks, queueName, func(_ *tq.Task, err error) {
+			if err == nil || err == tq.ErrTaskAlreadyAdded {
+				delivered = append(delivered, decoded[i])
+			} else {
+				lme = append(lme, err)
+			}
+			i++
+		})
+		if err != nil {
+			lme = append(lme, err)
+		}
+	}
+
+	if len(delivered) > 0 {
+		if err := ds.Delete(c, delivered); err != nil {
+			lme = append(lme, err)
+		}
+	}
+
+	if len(lme) > 0 {
+		return lme
+	}
+	return nil
+}
+
+// FlushTaskOutbox delivers the tasks which are still in the outbox of the
+// current namespace, because delivering them right after their transaction
+// committed failed. Only entries older than minAge are delivered, to avoid
+// racing with transactions that are committing right now.
+//
+// It is safe to call this concurrently, and to call it periodically (e.g. from
+// a cron job): each task is delivered under a stable name, so it's enqueued at
+// most once.
+func FlushTaskOutbox(c context.Context, minAge time.Duration) error {
+	q := ds.NewQuery(TaskOutboxKind).Lt("Created", clock.Now(c).UTC().Add(-minAge))
+	var ents []*outboxEntry
+	if err := ds.GetAll(c, q, &ents); err != nil {
+		return err
+	}
+	return deliverOutbox(c, ents)
+}
+
+// deliverTaskOutbox is called after a transaction using ob has committed.
+//
+// The transaction has already been applied at this point, so errors are only
+// logged: the undelivered tasks remain in the outbox.
+func deliverTaskOutbox(c context.Context, ob *taskOutbox) {
+	ob.Lock()
+	ents := ob.entries
+	ob.Unlock()
+
+	if err := deliverOutbox(c, ents); err != nil {
+		(log.Fields{log.ErrorKey: err}).Warningf(c,
+			"cloud: failed to deliver transactional tasks, leaving them in the outbox")
+	}
+}
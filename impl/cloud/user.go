@@ -0,0 +1,370 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luci/gae/service/user"
+
+	"github.com/luci/luci-go/common/clock"
+	"github.com/luci/luci-go/common/errors"
+	log "github.com/luci/luci-go/common/logging"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	// IAPHeader is the header in which the Identity-Aware Proxy sends the signed
+	// JWT assertion of the identity of the user.
+	IAPHeader = "X-Goog-IAP-JWT-Assertion"
+
+	// iapIssuer is the issuer of the IAP JWT assertions.
+	iapIssuer = "https://cloud.google.com/iap"
+
+	// iapSubjectPrefix prefixes the user IDs in the subject of IAP assertions.
+	iapSubjectPrefix = "accounts.google.com:"
+
+	// iapLogoutPath clears the IAP login cookie.
+	iapLogoutPath = "/_gcp_iap/clear_login_cookie"
+
+	// defaultTokenInfoURL is the Google endpoint which validates OAuth access
+	// tokens.
+	defaultTokenInfoURL = "https://www.googleapis.com/oauth2/v3/tokeninfo"
+
+	// clockSkew is the clock skew tolerated when checking the validity period of
+	// assertions.
+	clockSkew = 30 * time.Second
+)
+
+var errNoOAuthToken = errors.New("cloud: the request has no OAuth bearer token")
+
+// UserConfig configures the user service, which authenticates the users of the
+// requests bound to contexts with WithRequest.
+//
+// Users are authenticated by the Identity-Aware Proxy (see IAPHeader), or
+// optionally by the App Engine frontend, for Current, and by Google OAuth2
+// bearer tokens (in the Authorization header) for CurrentOAuth.
+type UserConfig struct {
+	// IAPKeys are the public keys which sign the IAP assertions, by key ID. They
+	// are published at https://www.gstatic.com/iap/verify/public_key-jwk.
+	//
+	// If empty, IAP assertions are ignored.
+	IAPKeys map[string]*ecdsa.PublicKey
+
+	// IAPAudience is the expected audience of the IAP assertions, e.g.
+	// "/projects/<number>/apps/<project-id>". If empty, the audience isn't
+	// checked.
+	IAPAudience string
+
+	// TrustAppEngineHeaders makes Current fall back to the user described by the
+	// X-AppEngine-User-* headers (see user.FromRequestHeaders) of requests
+	// without an IAP assertion. It must only be set if a frontend strips these
+	// headers from the incoming requests.
+	TrustAppEngineHeaders bool
+
+	// TokenInfoURL is the endpoint which validates OAuth access tokens. If empty,
+	// Google's tokeninfo endpoint is used.
+	TokenInfoURL string
+
+	// Client is the HTTP client used to reach TokenInfoURL. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// Admins are the emails of the administrators of the application, for
+	// IsAdmin and User.Admin.
+	Admins []string
+}
+
+func (cfg *UserConfig) isAdmin(email string) bool {
+	for _, a := range cfg.Admins {
+		if strings.EqualFold(a, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *UserConfig) tokenInfoURL() string {
+	if cfg.TokenInfoURL != "" {
+		return cfg.TokenInfoURL
+	}
+	return defaultTokenInfoURL
+}
+
+func (cfg *UserConfig) client() *http.Client {
+	if cfg.Client != nil {
+		return cfg.Client
+	}
+	return http.DefaultClient
+}
+
+type userService struct {
+	context.Context
+	cfg *UserConfig
+}
+
+var _ user.RawInterface = (*userService)(nil)
+
+func (cfg *UserConfig) use(c context.Context) context.Context {
+	return user.SetFactory(c, func(ic context.Context) user.RawInterface {
+		return &userService{ic, cfg}
+	})
+}
+
+// Current returns the user authenticated by the Identity-Aware Proxy (or by
+// the App Engine headers, see TrustAppEngineHeaders), or nil if the request has
+// no valid IAP assertion.
+func (u *userService) Current() *user.User {
+	rs := getRequestState(u)
+	if rs == nil {
+		return nil
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if !rs.userDone {
+		if assertion := rs.req.Header.Get(IAPHeader); assertion != "" {
+			usr, err := u.verifyIAP(assertion)
+			if err != nil {
+				(log.Fields{log.ErrorKey: err}).Warningf(u, "cloud: invalid IAP assertion")
+			}
+			rs.user = usr
+		} else if u.cfg.TrustAppEngineHeaders {
+			if usr := user.FromRequestHeaders(rs.req.Header); usr != nil {
+				usr.Admin = usr.Admin || u.cfg.isAdmin(usr.Email)
+				rs.user = usr
+			}
+		}
+		rs.userDone = true
+	}
+	if rs.user == nil {
+		return nil
+	}
+	ret := *rs.user
+	return &ret
+}
+
+// CurrentOAuth returns the user of the OAuth bearer token of the request, if it
+// grants one of scopes (or if there are no scopes).
+func (u *userService) CurrentOAuth(scopes ...string) (*user.User, error) {
+	usr, granted, err := u.currentOAuth()
+	if err != nil {
+		return nil, err
+	}
+	if len(scopes) > 0 {
+		ok := false
+		for _, s := range scopes {
+			if _, ok = granted[s]; ok {
+				break
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("cloud: the OAuth token doesn't grant any of the scopes %q", scopes)
+		}
+	}
+	ret := *usr
+	return &ret, nil
+}
+
+func (u *userService) currentOAuth() (*user.User, map[string]struct{}, error) {
+	rs := getRequestState(u)
+	if rs == nil {
+		return nil, nil, errNoRequest
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if !rs.oauthDone {
+		rs.oauthUser, rs.oauthScope, rs.oauthErr = u.verifyOAuth(rs.req.Header.Get("Authorization"))
+		rs.oauthDone = true
+	}
+	return rs.oauthUser, rs.oauthScope, rs.oauthErr
+}
+
+// IsAdmin returns true if the current user is one of the configured Admins.
+func (u *userService) IsAdmin() bool {
+	usr := u.Current()
+	return usr != nil && usr.Admin
+}
+
+// LoginURL returns dest, since the Identity-Aware Proxy prompts the users who
+// aren't signed in to do so, on any URL it protects.
+func (u *userService) LoginURL(dest string) (string, error) {
+	return dest, nil
+}
+
+func (u *userService) LoginURLFederated(dest, identity string) (string, error) {
+	return "", errors.New("cloud: LoginURLFederated is not supported")
+}
+
+// LogoutURL returns the URL which clears the IAP login cookie. The user isn't
+// redirected to dest.
+func (u *userService) LogoutURL(dest string) (string, error) {
+	return iapLogoutPath, nil
+}
+
+// OAuthConsumerKey returns the client ID of the OAuth bearer token of the
+// request.
+func (u *userService) OAuthConsumerKey() (string, error) {
+	usr, _, err := u.currentOAuth()
+	if err != nil {
+		return "", err
+	}
+	return usr.ClientID, nil
+}
+
+func (u *userService) GetTestable() user.Testable { return nil }
+
+// makeUser returns the User of email, with the ID id.
+func (u *userService) makeUser(email, id, clientID string) *user.User {
+	return &user.User{
+		Email:      email,
+		AuthDomain: email[strings.LastIndex(email, "@")+1:],
+		Admin:      u.cfg.isAdmin(email),
+		ID:         id,
+		ClientID:   clientID,
+	}
+}
+
+// verifyIAP verifies an IAP JWT assertion, and returns its user.
+func (u *userService) verifyIAP(assertion string) (*user.User, error) {
+	if len(u.cfg.IAPKeys) == 0 {
+		return nil, errors.New("no IAP keys are configured")
+	}
+
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "ES256" {
+		return nil, fmt.Errorf("unexpected JWT algorithm %q", header.Alg)
+	}
+	key := u.cfg.IAPKeys[header.Kid]
+	if key == nil {
+		return nil, fmt.Errorf("unknown IAP key %q", header.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature: %s", err)
+	}
+	if len(sig) != 64 {
+		return nil, fmt.Errorf("malformed ES256 signature of %d bytes", len(sig))
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(key, hash[:], r, s) {
+		return nil, errors.New("invalid JWT signature")
+	}
+
+	var claims struct {
+		Iss   string `json:"iss"`
+		Aud   string `json:"aud"`
+		Sub   string `json:"sub"`
+		Email string `json:"email"`
+		Iat   int64  `json:"iat"`
+		Exp   int64  `json:"exp"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	switch now := clock.Now(u); {
+	case claims.Iss != iapIssuer:
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Iss)
+	case u.cfg.IAPAudience != "" && claims.Aud != u.cfg.IAPAudience:
+		return nil, fmt.Errorf("unexpected audience %q", claims.Aud)
+	case now.Add(clockSkew).Before(time.Unix(claims.Iat, 0)):
+		return nil, errors.New("the assertion is issued in the future")
+	case now.Add(-clockSkew).After(time.Unix(claims.Exp, 0)):
+		return nil, errors.New("the assertion has expired")
+	case !strings.Contains(claims.Email, "@"):
+		return nil, fmt.Errorf("invalid email %q", claims.Email)
+	}
+	return u.makeUser(claims.Email, strings.TrimPrefix(claims.Sub, iapSubjectPrefix), ""), nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed JWT: %s", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("malformed JWT: %s", err)
+	}
+	return nil
+}
+
+// verifyOAuth validates the OAuth bearer token of the Authorization header
+// with the tokeninfo endpoint, and returns its user and scopes.
+func (u *userService) verifyOAuth(authorization string) (*user.User, map[string]struct{}, error) {
+	const prefix = "bearer "
+	if len(authorization) <= len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return nil, nil, errNoOAuthToken
+	}
+	token := strings.TrimSpace(authorization[len(prefix):])
+
+	req, err := http.NewRequest("GET", u.cfg.tokenInfoURL()+"?"+url.Values{"access_token": {token}}.Encode(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ctxhttp.Do(u, u.cfg.client(), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("cloud: invalid OAuth token: HTTP %d: %s", resp.StatusCode, body)
+	}
+
+	var info struct {
+		Azp           string `json:"azp"`
+		Sub           string `json:"sub"`
+		Scope         string `json:"scope"`
+		Exp           string `json:"exp"`
+		Email         string `json:"email"`
+		EmailVerified string `json:"email_verified"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, nil, fmt.Errorf("cloud: invalid tokeninfo response: %s", err)
+	}
+	if exp, err := strconv.ParseInt(info.Exp, 10, 64); err != nil || clock.Now(u).After(time.Unix(exp, 0)) {
+		return nil, nil, errors.New("cloud: the OAuth token has expired")
+	}
+	if info.EmailVerified != "true" || !strings.Contains(info.Email, "@") {
+		return nil, nil, errors.New("cloud: the OAuth token has no verified email")
+	}
+
+	scopes := map[string]struct{}{}
+	for _, s := range strings.Fields(info.Scope) {
+		scopes[s] = struct{}{}
+	}
+	return u.makeUser(info.Email, info.Sub, info.Azp), scopes, nil
+}
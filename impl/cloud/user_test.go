@@ -0,0 +1,203 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package cloud
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/luci/gae/service/user"
+	"github.com/luci/luci-go/common/clock/testclock"
+
+	"golang.org/x/net/context"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// signIAP returns an IAP assertion of claims, signed by key.
+func signIAP(key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			panic(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := enc(map[string]string{"alg": "ES256", "kid": kid}) + "." + enc(claims)
+
+	hash := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		panic(err)
+	}
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):], rb)
+	copy(sig[64-len(sb):], sb)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestUser(t *testing.T) {
+	t.Parallel()
+
+	Convey(`A cloud user service`, t, func() {
+		c, _ := testclock.UseTime(context.Background(), testclock.TestTimeUTC)
+		now := testclock.TestTimeUTC.Unix()
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+
+		tokenInfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("access_token") != "good-token" {
+				http.Error(w, `{"error_description": "Invalid Value"}`, http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"azp": "client-id", "sub": "123", "scope": "scope1 scope2",
+				"exp": "%d", "email": "hello@example.com", "email_verified": "true"}`, now+3600)
+		}))
+		defer tokenInfo.Close()
+
+		cfg := &UserConfig{
+			IAPKeys:      map[string]*ecdsa.PublicKey{"key": &key.PublicKey},
+			IAPAudience:  "/projects/1/apps/app",
+			TokenInfoURL: tokenInfo.URL,
+			Admins:       []string{"admin@example.com"},
+		}
+		c = cfg.use(c)
+
+		req, err := http.NewRequest("GET", "https://app.example.com/", nil)
+		So(err, ShouldBeNil)
+		claims := map[string]interface{}{
+			"iss":   iapIssuer,
+			"aud":   "/projects/1/apps/app",
+			"sub":   "accounts.google.com:123",
+			"email": "admin@example.com",
+			"iat":   now - 60,
+			"exp":   now + 600,
+		}
+
+		Convey(`Has no user without a request`, func() {
+			So(user.Current(c), ShouldBeNil)
+			_, err := user.CurrentOAuth(c)
+			So(err, ShouldEqual, errNoRequest)
+		})
+
+		Convey(`Authenticates IAP users`, func() {
+			req.Header.Set(IAPHeader, signIAP(key, "key", claims))
+			c := WithRequest(c, req)
+
+			So(user.Current(c), ShouldResemble, &user.User{
+				Email:      "admin@example.com",
+				AuthDomain: "example.com",
+				Admin:      true,
+				ID:         "123",
+			})
+			So(user.IsAdmin(c), ShouldBeTrue)
+		})
+
+		Convey(`Only admins are admins`, func() {
+			claims["email"] = "hello@example.com"
+			req.Header.Set(IAPHeader, signIAP(key, "key", claims))
+			c := WithRequest(c, req)
+
+			So(user.Current(c).Email, ShouldEqual, "hello@example.com")
+			So(user.IsAdmin(c), ShouldBeFalse)
+		})
+
+		Convey(`Rejects invalid IAP assertions`, func() {
+			other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			So(err, ShouldBeNil)
+
+			for _, tc := range []struct {
+				name      string
+				assertion string
+			}{
+				{"malformed", "not.a.jwt"},
+				{"unknown key", signIAP(key, "other", claims)},
+				{"bad signature", signIAP(other, "key", claims)},
+				{"expired", func() string {
+					claims["exp"] = now - 600
+					defer func() { claims["exp"] = now + 600 }()
+					return signIAP(key, "key", claims)
+				}()},
+				{"wrong audience", func() string {
+					claims["aud"] = "/projects/2/apps/other"
+					defer func() { claims["aud"] = "/projects/1/apps/app" }()
+					return signIAP(key, "key", claims)
+				}()},
+			} {
+				Convey(tc.name, func() {
+					req.Header.Set(IAPHeader, tc.assertion)
+					c := WithRequest(c, req)
+					So(user.Current(c), ShouldBeNil)
+					So(user.IsAdmin(c), ShouldBeFalse)
+				})
+			}
+		})
+
+		Convey(`Authenticates OAuth bearer tokens`, func() {
+			req.Header.Set("Authorization", "Bearer good-token")
+			c := WithRequest(c, req)
+
+			usr, err := user.CurrentOAuth(c, "other", "scope2")
+			So(err, ShouldBeNil)
+			So(usr, ShouldResemble, &user.User{
+				Email:      "hello@example.com",
+				AuthDomain: "example.com",
+				ID:         "123",
+				ClientID:   "client-id",
+			})
+
+			clientID, err := user.OAuthConsumerKey(c)
+			So(err, ShouldBeNil)
+			So(clientID, ShouldEqual, "client-id")
+
+			_, err = user.CurrentOAuth(c, "other")
+			So(err, ShouldErrLike, "doesn't grant any of the scopes")
+
+			So(user.Current(c), ShouldBeNil)
+		})
+
+		Convey(`Rejects invalid OAuth bearer tokens`, func() {
+			_, err := user.CurrentOAuth(WithRequest(c, req))
+			So(err, ShouldEqual, errNoOAuthToken)
+
+			req.Header.Set("Authorization", "Bearer bad-token")
+			_, err = user.CurrentOAuth(WithRequest(c, req))
+			So(err, ShouldErrLike, "invalid OAuth token")
+		})
+
+		Convey(`Trusts App Engine headers only if configured to`, func() {
+			req.Header.Set(user.EmailHeader, "admin@example.com")
+			So(user.Current(WithRequest(c, req)), ShouldBeNil)
+
+			cfg.TrustAppEngineHeaders = true
+			So(user.Current(WithRequest(c, req)), ShouldResemble, &user.User{
+				Email:      "admin@example.com",
+				AuthDomain: "example.com",
+				Admin:      true,
+			})
+		})
+
+		Convey(`Rejects expired OAuth bearer tokens`, func() {
+			req.Header.Set("Authorization", "Bearer good-token")
+			c, tc := testclock.UseTime(c, testclock.TestTimeUTC)
+			tc.Add(2 * time.Hour)
+
+			_, err := user.CurrentOAuth(WithRequest(c, req))
+			So(err, ShouldErrLike, "has expired")
+		})
+	})
+}
@@ -117,6 +117,7 @@ func UseInfo(c context.Context, aid string) context.Context {
 	return useGI(useGID(c, func(mod *globalInfoData) {
 		mod.appID = aid
 		mod.fqAppID = fqAppID
+		mod.signer = &signingIdentity{}
 	}))
 }
 
@@ -137,12 +138,13 @@ func UseInfo(c context.Context, aid string) context.Context {
 // These can be retrieved with the gae.Get functions.
 //
 // The implementations are all backed by an in-memory implementation, and start
-// with an empty state.
+// with an empty state and no quota limits (see SetQuota).
 //
 // Using this more than once per context.Context will cause a panic.
 func UseWithAppID(c context.Context, aid string) context.Context {
 	c = memlogger.Use(c)
 	c = UseInfo(c, aid) // Panics if UseWithAppID is called twice.
+	c = useQuota(c)
 	return useMod(useMail(useUser(useTQ(useRDS(useMC(c))))))
 }
 
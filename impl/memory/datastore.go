@@ -58,6 +58,10 @@ func NewDatastore(c context.Context, inf info.RawInterface) ds.RawInterface {
 
 //////////////////////////////////// dsImpl ////////////////////////////////////
 
+func consumeDSQuota(c context.Context, ops int) error {
+	return consumeQuota(c, "datastore", DatastoreOps, int64(ops))
+}
+
 // dsImpl exists solely to bind the current c to the datastore data.
 type dsImpl struct {
 	context.Context
@@ -73,15 +77,24 @@ func (d *dsImpl) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
 }
 
 func (d *dsImpl) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
+	if err := consumeDSQuota(d, len(keys)); err != nil {
+		return err
+	}
 	d.data.putMulti(keys, vals, cb)
 	return nil
 }
 
 func (d *dsImpl) GetMulti(keys []*ds.Key, _meta ds.MultiMetaGetter, cb ds.GetMultiCB) error {
+	if err := consumeDSQuota(d, len(keys)); err != nil {
+		return err
+	}
 	return d.data.getMulti(keys, cb)
 }
 
 func (d *dsImpl) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
+	if err := consumeDSQuota(d, len(keys)); err != nil {
+		return err
+	}
 	d.data.delMulti(keys, cb)
 	return nil
 }
@@ -91,6 +104,9 @@ func (d *dsImpl) DecodeCursor(s string) (ds.Cursor, error) {
 }
 
 func (d *dsImpl) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
+	if err := consumeDSQuota(d, 1); err != nil {
+		return err
+	}
 	idx, head := d.data.getQuerySnaps(!fq.EventuallyConsistent())
 	err := executeQuery(fq, d.kc, false, idx, head, cb)
 	if d.data.maybeAutoIndex(err) {
@@ -101,6 +117,9 @@ func (d *dsImpl) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
 }
 
 func (d *dsImpl) Count(fq *ds.FinalizedQuery) (ret int64, err error) {
+	if err = consumeDSQuota(d, 1); err != nil {
+		return
+	}
 	idx, head := d.data.getQuerySnaps(!fq.EventuallyConsistent())
 	ret, err = countQuery(fq, d.kc, false, idx, head)
 	if d.data.maybeAutoIndex(err) {
@@ -187,6 +206,9 @@ func (d *txnDsImpl) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
 }
 
 func (d *txnDsImpl) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
+	if err := consumeDSQuota(d, len(keys)); err != nil {
+		return err
+	}
 	return d.data.run(func() error {
 		d.data.putMulti(keys, vals, cb)
 		return nil
@@ -194,12 +216,18 @@ func (d *txnDsImpl) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKey
 }
 
 func (d *txnDsImpl) GetMulti(keys []*ds.Key, _meta ds.MultiMetaGetter, cb ds.GetMultiCB) error {
+	if err := consumeDSQuota(d, len(keys)); err != nil {
+		return err
+	}
 	return d.data.run(func() error {
 		return d.data.getMulti(keys, cb)
 	})
 }
 
 func (d *txnDsImpl) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
+	if err := consumeDSQuota(d, len(keys)); err != nil {
+		return err
+	}
 	return d.data.run(func() error {
 		return d.data.delMulti(keys, cb)
 	})
@@ -208,6 +236,10 @@ func (d *txnDsImpl) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
 func (d *txnDsImpl) DecodeCursor(s string) (ds.Cursor, error) { return newCursor(s) }
 
 func (d *txnDsImpl) Run(q *ds.FinalizedQuery, cb ds.RawRunCB) error {
+	if err := consumeDSQuota(d, 1); err != nil {
+		return err
+	}
+
 	// note that autoIndex has no effect inside transactions. This is because
 	// the transaction guarantees a consistent view of head at the time that the
 	// transaction opens. At best, we could add the index on head, but then return
@@ -221,6 +253,9 @@ func (d *txnDsImpl) Run(q *ds.FinalizedQuery, cb ds.RawRunCB) error {
 }
 
 func (d *txnDsImpl) Count(fq *ds.FinalizedQuery) (ret int64, err error) {
+	if err = consumeDSQuota(d, 1); err != nil {
+		return
+	}
 	return countQuery(fq, d.kc, true, d.data.snap, d.data.snap)
 }
 
@@ -6,6 +6,8 @@ package memory
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/luci/gae/impl/dummy"
 	"github.com/luci/gae/service/info"
@@ -21,6 +23,29 @@ var defaultGlobalInfoData = globalInfoData{
 	// whatever's in app.yaml.
 	versionID: "testVersionID.1",
 	requestID: "test-request-id",
+
+	moduleName:     "default",
+	instanceID:     "test-instance-id",
+	datacenter:     "us-central1",
+	serverSoftware: "Development/2.0",
+	isDevAppServer: true,
+
+	modules: map[string]*moduleVersions{
+		"default": {defaultVersion: "testVersionID", versions: []string{"testVersionID"}},
+	},
+}
+
+// moduleVersions are the versions of a module in the topology of the
+// application.
+type moduleVersions struct {
+	defaultVersion string
+	// versions is sorted.
+	versions []string
+}
+
+func (mv *moduleVersions) has(version string) bool {
+	idx := sort.SearchStrings(mv.versions, version)
+	return idx < len(mv.versions) && mv.versions[idx] == version
 }
 
 type globalInfoData struct {
@@ -29,6 +54,22 @@ type globalInfoData struct {
 	namespace string
 	versionID string
 	requestID string
+
+	moduleName      string
+	instanceID      string
+	datacenter      string
+	serverSoftware  string
+	isDevAppServer  bool
+	defaultHostname string
+
+	// modules is the topology of the application, by module name. It's
+	// replaced (never modified) by SetModuleVersions.
+	modules map[string]*moduleVersions
+
+	// signer is shared by all the contexts derived from the same UseInfo.
+	signer *signingIdentity
+	// accessTokens maps the (sorted) scopes of SetAccessToken to their token.
+	accessTokens map[string]fakeAccessToken
 }
 
 func curGID(c context.Context) *globalInfoData {
@@ -86,11 +127,52 @@ func (gi *giImpl) FullyQualifiedAppID() string {
 }
 
 func (gi *giImpl) DefaultVersionHostname() string {
+	if gi.defaultHostname != "" {
+		return gi.defaultHostname
+	}
 	return fmt.Sprintf("%s.example.com", gi.appID)
 }
 
 func (gi *giImpl) IsDevAppServer() bool {
-	return true
+	return gi.isDevAppServer
+}
+
+func (gi *giImpl) ModuleName() string     { return gi.moduleName }
+func (gi *giImpl) InstanceID() string     { return gi.instanceID }
+func (gi *giImpl) Datacenter() string     { return gi.datacenter }
+func (gi *giImpl) ServerSoftware() string { return gi.serverSoftware }
+
+// ModuleHostname returns "[instance.]version.module.<DefaultVersionHostname>",
+// after resolving module and version like the production implementation: an
+// empty module is the current module, and an empty version is the current
+// version (if it belongs to module) or the default version of module. Both
+// must be part of the topology (see SetModuleVersions).
+func (gi *giImpl) ModuleHostname(module, version, instance string) (string, error) {
+	if module == "" {
+		module = gi.moduleName
+	}
+	mv, ok := gi.modules[module]
+	if !ok {
+		return "", fmt.Errorf("memory: unknown module %q", module)
+	}
+	if version == "" {
+		// versionID is "X.Y", where X is the version in the topology.
+		cur := strings.SplitN(gi.versionID, ".", 2)[0]
+		if module == gi.moduleName && mv.has(cur) {
+			version = cur
+		} else {
+			version = mv.defaultVersion
+		}
+	}
+	if !mv.has(version) {
+		return "", fmt.Errorf("memory: unknown version %q of module %q", version, module)
+	}
+
+	parts := []string{version, module, gi.DefaultVersionHostname()}
+	if instance != "" {
+		parts = append([]string{instance}, parts...)
+	}
+	return strings.Join(parts, "."), nil
 }
 
 func (gi *giImpl) ServiceAccount() (string, error) {
@@ -120,3 +202,58 @@ func (gi *giImpl) SetRequestID(v string) context.Context {
 		mod.requestID = v
 	})
 }
+
+func (gi *giImpl) SetModuleName(v string) context.Context {
+	return useGID(gi.c, func(mod *globalInfoData) {
+		mod.moduleName = v
+	})
+}
+
+func (gi *giImpl) SetInstanceID(v string) context.Context {
+	return useGID(gi.c, func(mod *globalInfoData) {
+		mod.instanceID = v
+	})
+}
+
+func (gi *giImpl) SetDatacenter(v string) context.Context {
+	return useGID(gi.c, func(mod *globalInfoData) {
+		mod.datacenter = v
+	})
+}
+
+func (gi *giImpl) SetServerSoftware(v string) context.Context {
+	return useGID(gi.c, func(mod *globalInfoData) {
+		mod.serverSoftware = v
+	})
+}
+
+func (gi *giImpl) SetIsDevAppServer(v bool) context.Context {
+	return useGID(gi.c, func(mod *globalInfoData) {
+		mod.isDevAppServer = v
+	})
+}
+
+func (gi *giImpl) SetDefaultVersionHostname(v string) context.Context {
+	return useGID(gi.c, func(mod *globalInfoData) {
+		mod.defaultHostname = v
+	})
+}
+
+func (gi *giImpl) SetModuleVersions(module, defaultVersion string, versions ...string) context.Context {
+	mv := &moduleVersions{defaultVersion: defaultVersion}
+	mv.versions = append(mv.versions, versions...)
+	sort.Strings(mv.versions)
+	if !mv.has(defaultVersion) {
+		mv.versions = append(mv.versions, defaultVersion)
+		sort.Strings(mv.versions)
+	}
+
+	return useGID(gi.c, func(mod *globalInfoData) {
+		modules := make(map[string]*moduleVersions, len(mod.modules)+1)
+		for k, v := range mod.modules {
+			modules[k] = v
+		}
+		modules[module] = mv
+		mod.modules = modules
+	})
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luci/gae/service/info"
+
+	"github.com/luci/luci-go/common/clock"
+
+	"golang.org/x/net/context"
+)
+
+// fakeAccessTokenLifetime is the lifetime of the access tokens minted by
+// AccessToken.
+const fakeAccessTokenLifetime = time.Hour
+
+// signingIdentity is the fake private key of an application. It's generated
+// lazily, since it's expensive and most tests don't need it.
+type signingIdentity struct {
+	once sync.Once
+	err  error
+
+	key  *rsa.PrivateKey
+	cert info.Certificate
+}
+
+func (s *signingIdentity) get(c context.Context, serviceAccount string) (*signingIdentity, error) {
+	s.once.Do(func() {
+		s.err = s.generate(c, serviceAccount)
+	})
+	return s, s.err
+}
+
+func (s *signingIdentity) generate(c context.Context, serviceAccount string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	keyHash := sha256.Sum256(pub)
+	keyName := hex.EncodeToString(keyHash[:8])
+
+	now := clock.Now(c).UTC()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: serviceAccount},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	s.key = key
+	s.cert = info.Certificate{
+		KeyName: keyName,
+		Data:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+	return nil
+}
+
+type fakeAccessToken struct {
+	token  string
+	expiry time.Time
+}
+
+// scopesKey returns the key of a set of scopes in globalInfoData.accessTokens.
+func scopesKey(scopes []string) string {
+	scopes = append([]string(nil), scopes...)
+	sort.Strings(scopes)
+	return strings.Join(scopes, " ")
+}
+
+// AccessToken returns the token set for scopes with SetAccessToken, or mints a
+// fake token, valid for an hour.
+func (gi *giImpl) AccessToken(scopes ...string) (token string, expiry time.Time, err error) {
+	key := scopesKey(scopes)
+	if tok, ok := gi.accessTokens[key]; ok {
+		return tok.token, tok.expiry, nil
+	}
+
+	sa, err := gi.ServiceAccount()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return fmt.Sprintf("fake_access_token:%s:%s", sa, key),
+		clock.Now(gi.c).Add(fakeAccessTokenLifetime), nil
+}
+
+// PublicCertificates returns the self-signed certificate of the key used by
+// SignBytes.
+func (gi *giImpl) PublicCertificates() ([]info.Certificate, error) {
+	id, err := gi.signingIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return []info.Certificate{id.cert}, nil
+}
+
+// SignBytes signs the SHA-256 hash of bytes with RSASSA-PKCS1-v1_5, like the
+// production implementation.
+func (gi *giImpl) SignBytes(bytes []byte) (keyName string, signature []byte, err error) {
+	id, err := gi.signingIdentity()
+	if err != nil {
+		return "", nil, err
+	}
+	hash := sha256.Sum256(bytes)
+	signature, err = rsa.SignPKCS1v15(rand.Reader, id.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", nil, err
+	}
+	return id.cert.KeyName, signature, nil
+}
+
+func (gi *giImpl) signingIdentity() (*signingIdentity, error) {
+	sa, err := gi.ServiceAccount()
+	if err != nil {
+		return nil, err
+	}
+	return gi.signer.get(gi.c, sa)
+}
+
+func (gi *giImpl) SetAccessToken(token string, expiry time.Time, scopes ...string) context.Context {
+	return useGID(gi.c, func(mod *globalInfoData) {
+		tokens := make(map[string]fakeAccessToken, len(mod.accessTokens)+1)
+		for k, v := range mod.accessTokens {
+			tokens[k] = v
+		}
+		tokens[scopesKey(scopes)] = fakeAccessToken{token, expiry}
+		mod.accessTokens = tokens
+	})
+}
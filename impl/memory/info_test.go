@@ -5,11 +5,17 @@
 package memory
 
 import (
+	"crypto/x509"
+	"encoding/pem"
 	"testing"
+	"time"
 
 	"github.com/luci/gae/service/info"
+	"github.com/luci/gae/service/module"
+	"github.com/luci/luci-go/common/clock/testclock"
 	"golang.org/x/net/context"
 
+	. "github.com/luci/luci-go/common/testing/assertions"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -34,3 +40,148 @@ func TestMustNamespace(t *testing.T) {
 		So(info.RequestID(c), ShouldEqual, "override")
 	})
 }
+
+func TestSigning(t *testing.T) {
+	t.Parallel()
+
+	Convey("Signing", t, func() {
+		now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+		c, _ := testclock.UseTime(context.Background(), now)
+		c = Use(c)
+
+		Convey("SignBytes is consistent with PublicCertificates", func() {
+			certs, err := info.PublicCertificates(c)
+			So(err, ShouldBeNil)
+			So(len(certs), ShouldEqual, 1)
+
+			block, _ := pem.Decode(certs[0].Data)
+			So(block, ShouldNotBeNil)
+			So(block.Type, ShouldEqual, "CERTIFICATE")
+			cert, err := x509.ParseCertificate(block.Bytes)
+			So(err, ShouldBeNil)
+			So(cert.Subject.CommonName, ShouldEqual, "gae_service_account@example.com")
+
+			blob := []byte("sign me")
+			keyName, sig, err := info.SignBytes(c, blob)
+			So(err, ShouldBeNil)
+			So(keyName, ShouldEqual, certs[0].KeyName)
+			So(cert.CheckSignature(x509.SHA256WithRSA, blob, sig), ShouldBeNil)
+
+			Convey("in derived contexts too", func() {
+				c = info.MustNamespace(c, "other")
+				keyName2, sig, err := info.SignBytes(c, blob)
+				So(err, ShouldBeNil)
+				So(keyName2, ShouldEqual, keyName)
+				So(cert.CheckSignature(x509.SHA256WithRSA, blob, sig), ShouldBeNil)
+			})
+
+			Convey("but not in other contexts", func() {
+				certs2, err := info.PublicCertificates(Use(context.Background()))
+				So(err, ShouldBeNil)
+				So(certs2[0].KeyName, ShouldNotEqual, keyName)
+			})
+		})
+
+		Convey("AccessToken", func() {
+			Convey("mints fake tokens", func() {
+				tok, exp, err := info.AccessToken(c, "b", "a")
+				So(err, ShouldBeNil)
+				So(tok, ShouldEqual, "fake_access_token:gae_service_account@example.com:a b")
+				So(exp, ShouldResemble, now.Add(time.Hour))
+			})
+
+			Convey("can be configured", func() {
+				exp := now.Add(time.Minute)
+				c = info.GetTestable(c).SetAccessToken("tok", exp, "a", "b")
+
+				tok, tokExp, err := info.AccessToken(c, "b", "a")
+				So(err, ShouldBeNil)
+				So(tok, ShouldEqual, "tok")
+				So(tokExp, ShouldResemble, exp)
+
+				tok, _, err = info.AccessToken(c, "a")
+				So(err, ShouldBeNil)
+				So(tok, ShouldEqual, "fake_access_token:gae_service_account@example.com:a")
+			})
+		})
+	})
+}
+
+func TestTopology(t *testing.T) {
+	t.Parallel()
+
+	Convey("Deployment topology", t, func() {
+		c := UseWithAppID(context.Background(), "dev~app-id")
+
+		Convey("has defaults", func() {
+			So(info.ModuleName(c), ShouldEqual, "default")
+			So(info.InstanceID(c), ShouldEqual, "test-instance-id")
+			So(info.Datacenter(c), ShouldEqual, "us-central1")
+			So(info.ServerSoftware(c), ShouldEqual, "Development/2.0")
+			So(info.IsDevAppServer(c), ShouldBeTrue)
+			So(info.DefaultVersionHostname(c), ShouldEqual, "app-id.example.com")
+
+			host, err := info.ModuleHostname(c, "", "", "")
+			So(err, ShouldBeNil)
+			So(host, ShouldEqual, "testVersionID.default.app-id.example.com")
+		})
+
+		Convey("can be set per context", func() {
+			tc := info.GetTestable(c)
+			c2 := tc.SetModuleName("backend")
+			c2 = info.GetTestable(c2).SetInstanceID("inst")
+			c2 = info.GetTestable(c2).SetDatacenter("europe-west1")
+			c2 = info.GetTestable(c2).SetServerSoftware("Google App Engine/1.9.40")
+			c2 = info.GetTestable(c2).SetIsDevAppServer(false)
+			c2 = info.GetTestable(c2).SetDefaultVersionHostname("app-id.appspot.com")
+
+			So(info.ModuleName(c2), ShouldEqual, "backend")
+			So(info.InstanceID(c2), ShouldEqual, "inst")
+			So(info.Datacenter(c2), ShouldEqual, "europe-west1")
+			So(info.ServerSoftware(c2), ShouldEqual, "Google App Engine/1.9.40")
+			So(info.IsDevAppServer(c2), ShouldBeFalse)
+			So(info.DefaultVersionHostname(c2), ShouldEqual, "app-id.appspot.com")
+
+			// the original context is untouched.
+			So(info.ModuleName(c), ShouldEqual, "default")
+			So(info.IsDevAppServer(c), ShouldBeTrue)
+		})
+
+		Convey("ModuleHostname resolves hostnames from the topology", func() {
+			c = info.GetTestable(c).SetModuleVersions("backend", "v2", "v1", "v3")
+			c = info.GetTestable(c).SetModuleName("backend")
+			c = info.GetTestable(c).SetVersionID("v3.1234")
+
+			host := func(module, version, instance string) string {
+				ret, err := info.ModuleHostname(c, module, version, instance)
+				So(err, ShouldBeNil)
+				return ret
+			}
+
+			// the current version of the current module.
+			So(host("", "", ""), ShouldEqual, "v3.backend.app-id.example.com")
+			So(host("", "v1", "2"), ShouldEqual, "2.v1.backend.app-id.example.com")
+			// the default version of other modules.
+			So(host("default", "", ""), ShouldEqual, "testVersionID.default.app-id.example.com")
+
+			_, err := info.ModuleHostname(c, "nope", "", "")
+			So(err, ShouldErrLike, `unknown module "nope"`)
+			_, err = info.ModuleHostname(c, "backend", "v4", "")
+			So(err, ShouldErrLike, `unknown version "v4" of module "backend"`)
+
+			Convey("consistently with the module service", func() {
+				mods, err := module.List(c)
+				So(err, ShouldBeNil)
+				So(mods, ShouldResemble, []string{"backend", "default"})
+
+				vers, err := module.Versions(c, "")
+				So(err, ShouldBeNil)
+				So(vers, ShouldResemble, []string{"v1", "v2", "v3"})
+
+				dflt, err := module.DefaultVersion(c, "backend")
+				So(err, ShouldBeNil)
+				So(dflt, ShouldEqual, "v2")
+			})
+		})
+	})
+}
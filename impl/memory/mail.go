@@ -5,15 +5,16 @@
 package memory
 
 import (
+	"bytes"
 	"fmt"
+	"net/http"
 	net_mail "net/mail"
-	"net/textproto"
-	"path/filepath"
-	"strings"
 	"sync"
 
 	"github.com/luci/gae/service/mail"
+	"github.com/luci/gae/service/mail/support"
 	"github.com/luci/gae/service/user"
+	"github.com/luci/luci-go/common/clock"
 	"golang.org/x/net/context"
 )
 
@@ -22,6 +23,7 @@ type mailData struct {
 	queue       []*mail.TestMessage
 	admins      []string
 	adminsPlain []string
+	inbound     http.Handler
 }
 
 // mailImpl is a contextual pointer to the current mailData.
@@ -46,83 +48,16 @@ func useMail(c context.Context) context.Context {
 	})
 }
 
-func parseEmails(emails ...string) error {
-	for _, e := range emails {
-		if _, err := net_mail.ParseAddress(e); err != nil {
-			return fmt.Errorf("invalid email (%q): %s", e, err)
-		}
-	}
-	return nil
-}
-
 func checkMessage(msg *mail.TestMessage, adminsPlain []string, user string) error {
-	sender, err := net_mail.ParseAddress(msg.Sender)
-	if err != nil {
-		return fmt.Errorf("unparsable Sender address: %s: %s", msg.Sender, err)
-	}
-	senderOK := user != "" && sender.Address == user
-	if !senderOK {
-		for _, a := range adminsPlain {
-			if sender.Address == a {
-				senderOK = true
-				break
-			}
-		}
+	senders := adminsPlain
+	if user != "" {
+		senders = append([]string{user}, adminsPlain...)
 	}
-	if !senderOK {
-		return fmt.Errorf("invalid Sender: %s", msg.Sender)
-	}
-
-	if len(msg.To) == 0 && len(msg.Cc) == 0 && len(msg.Bcc) == 0 {
-		return fmt.Errorf("one of To, Cc or Bcc must be non-empty")
-	}
-
-	if err := parseEmails(msg.To...); err != nil {
-		return err
-	}
-	if err := parseEmails(msg.Cc...); err != nil {
-		return err
-	}
-	if err := parseEmails(msg.Bcc...); err != nil {
+	mimeTypes, err := support.CheckMessage(&msg.Message, senders...)
+	if err != nil {
 		return err
 	}
-
-	if len(msg.Body) == 0 && len(msg.HTMLBody) == 0 {
-		return fmt.Errorf("one of Body or HTMLBody must be non-empty")
-	}
-
-	if len(msg.Attachments) > 0 {
-		msg.MIMETypes = make([]string, len(msg.Attachments))
-		for i := range msg.Attachments {
-			n := msg.Attachments[i].Name
-			ext := strings.TrimLeft(strings.ToLower(filepath.Ext(n)), ".")
-			if badExtensions.Has(ext) {
-				return fmt.Errorf("illegal attachment extension for %q", n)
-			}
-			mimetype := extensionMapping[ext]
-			if mimetype == "" {
-				mimetype = "application/octet-stream"
-			}
-			msg.MIMETypes[i] = mimetype
-		}
-	}
-
-	fixKeys := map[string]string{}
-	for k := range msg.Headers {
-		canonK := textproto.CanonicalMIMEHeaderKey(k)
-		if !okHeaders.Has(canonK) {
-			return fmt.Errorf("disallowed header: %s", k)
-		}
-		if canonK != k {
-			fixKeys[k] = canonK
-		}
-	}
-	for k, canonK := range fixKeys {
-		vals := msg.Headers[k]
-		delete(msg.Headers, k)
-		msg.Headers[canonK] = vals
-	}
-
+	msg.MIMETypes = mimeTypes
 	return nil
 }
 
@@ -141,6 +76,10 @@ func (m *mailImpl) sendImpl(msg *mail.Message) error {
 	if err := checkMessage(testMsg, adminsPlain, email); err != nil {
 		return err
 	}
+	recipients := len(msg.To) + len(msg.Cc) + len(msg.Bcc)
+	if err := consumeQuota(m, "mail", MailRecipients, int64(recipients)); err != nil {
+		return err
+	}
 	m.data.Lock()
 	m.data.queue = append(m.data.queue, testMsg)
 	m.data.Unlock()
@@ -198,3 +137,102 @@ func (m *mailImpl) Reset() {
 	m.data.queue = nil
 	m.data.Unlock()
 }
+
+func (m *mailImpl) SetInboundHandler(h http.Handler) {
+	m.data.Lock()
+	m.data.inbound = h
+	m.data.Unlock()
+}
+
+func (m *mailImpl) DeliverInbound(msg *mail.Message) error {
+	mimeTypes := make([]string, len(msg.Attachments))
+	for i, att := range msg.Attachments {
+		var err error
+		if mimeTypes[i], err = support.AttachmentMIMEType(att.Name); err != nil {
+			mimeTypes[i] = "application/octet-stream"
+		}
+	}
+	data, err := support.BuildMessage(msg, mimeTypes, clock.Now(m))
+	if err != nil {
+		return err
+	}
+
+	for _, lists := range [][]string{msg.To, msg.Cc, msg.Bcc} {
+		for _, rcpt := range lists {
+			adr, err := net_mail.ParseAddress(rcpt)
+			if err != nil {
+				return fmt.Errorf("invalid email (%q): %s", rcpt, err)
+			}
+			r, err := mail.NewInboundRequest(adr.Address, data)
+			if err != nil {
+				return err
+			}
+			if err := m.serveInbound(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *mailImpl) DeliverBounce(n *mail.BounceNotification) error {
+	r, err := mail.NewBounceRequest(n)
+	if err != nil {
+		return err
+	}
+	return m.serveInbound(r)
+}
+
+// serveInbound serves r with the inbound handler, and returns an error if it
+// doesn't respond with 200.
+func (m *mailImpl) serveInbound(r *http.Request) error {
+	m.data.Lock()
+	h := m.data.inbound
+	m.data.Unlock()
+	if h == nil {
+		return fmt.Errorf("memory: no inbound mail handler (see SetInboundHandler)")
+	}
+
+	rw := &inboundResponse{}
+	h.ServeHTTP(rw, r)
+	if code := rw.code(); code != http.StatusOK {
+		return fmt.Errorf("memory: %s: the inbound mail handler responded with %d: %s",
+			r.URL.Path, code, rw.body.String())
+	}
+	return nil
+}
+
+// inboundResponse is the http.ResponseWriter of the inbound mail handler. It
+// records the status code and the body of the response.
+type inboundResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *inboundResponse) Header() http.Header {
+	if rw.header == nil {
+		rw.header = http.Header{}
+	}
+	return rw.header
+}
+
+func (rw *inboundResponse) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *inboundResponse) Write(data []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.body.Write(data)
+}
+
+// code returns the status code of the response, which is 200 if the handler
+// didn't write anything.
+func (rw *inboundResponse) code() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
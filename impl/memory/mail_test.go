@@ -232,7 +232,111 @@ func TestMail(t *testing.T) {
 
 			})
 
+			Convey("multi-line headers are a problem", func() {
+				So(mail.SendToAdmins(c, &mail.Message{
+					Sender:  "admin@example.com",
+					Subject: "Reminder",
+					Body:    "I forgot",
+					Headers: net_mail.Header{"In-Reply-To": []string{"cats\r\nBcc: spam@example.com"}},
+				}), ShouldErrLike, `invalid value of header In-Reply-To`)
+			})
+
+			Convey("bad ReplyTo is a problem", func() {
+				So(mail.SendToAdmins(c, &mail.Message{
+					Sender:  "admin@example.com",
+					ReplyTo: "reply@example.com\r\nBcc: spam@example.com",
+					Subject: "Reminder",
+					Body:    "I forgot",
+				}), ShouldErrLike, `unparsable ReplyTo address`)
+			})
+
+			Convey("multi-line Content-IDs are a problem", func() {
+				So(mail.SendToAdmins(c, &mail.Message{
+					Sender:  "admin@example.com",
+					Subject: "Reminder",
+					Body:    "I forgot",
+					Attachments: []mail.Attachment{{
+						Name:      "reminder.png",
+						Data:      []byte("PNG"),
+						ContentID: "x>\r\nContent-Type: text/html",
+					}},
+				}), ShouldErrLike, `invalid Content-ID of attachment reminder.png`)
+			})
+
 		})
 
+		Convey("inbound messages", func() {
+			rt := &mail.Router{}
+			var got []*mail.InboundMessage
+			rt.Handle("support@*", func(c context.Context, msg *mail.InboundMessage) error {
+				got = append(got, msg)
+				return nil
+			})
+			var bounces []*mail.BounceNotification
+			rt.Bounce = func(c context.Context, n *mail.BounceNotification) error {
+				bounces = append(bounces, n)
+				return nil
+			}
+			tm := mail.GetTestable(c)
+
+			Convey("require an inbound handler", func() {
+				So(tm.DeliverInbound(&mail.Message{
+					Sender: "customer@example.com",
+					To:     []string{"support@app.example.com"},
+					Body:   "Help",
+				}), ShouldErrLike, "no inbound mail handler")
+			})
+
+			Convey("are delivered to the handler", func() {
+				tm.SetInboundHandler(Middleware(c, rt.ServeRequest))
+
+				So(tm.DeliverInbound(&mail.Message{
+					Sender:      "Valued Customer <customer@example.com>",
+					To:          []string{"support@app.example.com"},
+					Bcc:         []string{"Support <SUPPORT@other.example.com>"},
+					Subject:     "Help",
+					Body:        "It's broken.",
+					HTMLBody:    "<p>It's broken.</p>",
+					Attachments: []mail.Attachment{{Name: "screenshot.png", Data: []byte("\x89PNG")}},
+				}), ShouldBeNil)
+
+				So(got, ShouldHaveLength, 2)
+				So(got[0].Recipient, ShouldEqual, "support@app.example.com")
+				So(got[1].Recipient, ShouldEqual, "SUPPORT@other.example.com")
+				So(got[0].Sender, ShouldEqual, `"Valued Customer" <customer@example.com>`)
+				So(got[0].To, ShouldResemble, []string{"support@app.example.com"})
+				So(got[0].Subject, ShouldEqual, "Help")
+				So(got[0].Body, ShouldEqual, "It's broken.")
+				So(got[0].HTMLBody, ShouldEqual, "<p>It's broken.</p>")
+				So(got[0].Attachments, ShouldResemble, []mail.Attachment{{Name: "screenshot.png", Data: []byte("\x89PNG")}})
+
+				Convey("failing for unrouted recipients", func() {
+					So(tm.DeliverInbound(&mail.Message{
+						Sender: "customer@example.com",
+						To:     []string{"sales@app.example.com"},
+						Body:   "Hi",
+					}), ShouldErrLike, "responded with 404")
+				})
+
+				Convey("with the bounce notifications", func() {
+					So(tm.DeliverBounce(&mail.BounceNotification{
+						Original: mail.Message{
+							Sender:  "admin@example.com",
+							To:      []string{"nobody@example.com"},
+							Subject: "Hello",
+							Body:    "Hello",
+						},
+						Notification: mail.Message{
+							Sender: "mailer-daemon@example.com",
+							To:     []string{"admin@example.com"},
+							Body:   "Delivery failed",
+						},
+					}), ShouldBeNil)
+					So(bounces, ShouldHaveLength, 1)
+					So(bounces[0].Original.To, ShouldResemble, []string{"nobody@example.com"})
+					So(bounces[0].Notification.Body, ShouldEqual, "Delivery failed")
+				})
+			})
+		})
 	})
 }
@@ -66,6 +66,9 @@ type mcDataItem struct {
 	flags      uint32
 	expiration time.Time
 	casID      uint64
+
+	// accessed is the last time the item was set or retrieved.
+	accessed time.Time
 }
 
 func (m *mcDataItem) toUserItem(key string) *mcItem {
@@ -99,6 +102,7 @@ func (m *memcacheData) mkDataItemLocked(now time.Time, i mc.Item) (ret *mcDataIt
 		expiration: exp,
 		value:      value,
 		casID:      m.casID,
+		accessed:   now,
 	}
 }
 
@@ -134,6 +138,21 @@ func (m *memcacheData) hasItemLocked(now time.Time, key string) bool {
 	return ok
 }
 
+// oldestLocked returns the age of access of the least recently accessed live
+// item, in seconds.
+func (m *memcacheData) oldestLocked(now time.Time) int64 {
+	oldest := now
+	for _, itm := range m.items {
+		if !itm.expiration.IsZero() && itm.expiration.Before(now) {
+			continue
+		}
+		if itm.accessed.Before(oldest) {
+			oldest = itm.accessed
+		}
+	}
+	return int64(now.Sub(oldest) / time.Second)
+}
+
 func (m *memcacheData) retrieveLocked(now time.Time, key string) (*mcDataItem, error) {
 	if !m.hasItemLocked(now, key) {
 		m.stats.Misses++
@@ -141,6 +160,7 @@ func (m *memcacheData) retrieveLocked(now time.Time, key string) (*mcDataItem, e
 	}
 
 	ret := m.items[key]
+	ret.accessed = now
 	m.stats.Hits++
 	m.stats.ByteHits += uint64(len(ret.value))
 	return ret, nil
@@ -185,6 +205,15 @@ func (m *memcacheImpl) NewItem(key string) mc.Item {
 	return &mcItem{key: key}
 }
 
+// consumeQuota consumes the MemcacheBytes quota needed to write items.
+func (m *memcacheImpl) consumeQuota(items []mc.Item) error {
+	size := 0
+	for _, itm := range items {
+		size += len(itm.Key()) + len(itm.Value())
+	}
+	return consumeQuota(m.ctx, "memcache", MemcacheBytes, int64(size))
+}
+
 func doCBs(items []mc.Item, cb mc.RawCB, inner func(mc.Item) error) {
 	// This weird construction is so that we:
 	//   - don't take the lock for the entire multi operation, since it could imply
@@ -202,6 +231,9 @@ func doCBs(items []mc.Item, cb mc.RawCB, inner func(mc.Item) error) {
 }
 
 func (m *memcacheImpl) AddMulti(items []mc.Item, cb mc.RawCB) error {
+	if err := m.consumeQuota(items); err != nil {
+		return err
+	}
 	now := clock.Now(m.ctx)
 	doCBs(items, cb, func(itm mc.Item) error {
 		m.data.lock.Lock()
@@ -216,6 +248,9 @@ func (m *memcacheImpl) AddMulti(items []mc.Item, cb mc.RawCB) error {
 }
 
 func (m *memcacheImpl) CompareAndSwapMulti(items []mc.Item, cb mc.RawCB) error {
+	if err := m.consumeQuota(items); err != nil {
+		return err
+	}
 	now := clock.Now(m.ctx)
 	doCBs(items, cb, func(itm mc.Item) error {
 		m.data.lock.Lock()
@@ -240,6 +275,9 @@ func (m *memcacheImpl) CompareAndSwapMulti(items []mc.Item, cb mc.RawCB) error {
 }
 
 func (m *memcacheImpl) SetMulti(items []mc.Item, cb mc.RawCB) error {
+	if err := m.consumeQuota(items); err != nil {
+		return err
+	}
 	now := clock.Now(m.ctx)
 	doCBs(items, cb, func(itm mc.Item) error {
 		m.data.lock.Lock()
@@ -345,9 +383,12 @@ func (m *memcacheImpl) Increment(key string, delta int64, initialValue *uint64)
 }
 
 func (m *memcacheImpl) Stats() (*mc.Statistics, error) {
+	now := clock.Now(m.ctx)
+
 	m.data.lock.Lock()
 	defer m.data.lock.Unlock()
 
 	ret := m.data.stats
+	ret.Oldest = m.data.oldestLocked(now)
 	return &ret, nil
 }
@@ -201,6 +201,7 @@ func TestMemcache(t *testing.T) {
 				value:      []byte("cool"),
 				expiration: curTime.Add(time.Second * 2).Truncate(time.Second),
 				casID:      1,
+				accessed:   curTime,
 			})
 
 			getItm, err := mc.GetKey(c, "sup")
@@ -216,6 +217,28 @@ func TestMemcache(t *testing.T) {
 			So(getItm, ShouldResemble, testItem)
 		})
 
+		Convey("Stats reports the age of the least recently accessed item", func() {
+			So(mc.Set(c, mc.NewItem(c, "a").SetValue([]byte("a"))), ShouldBeNil)
+			tc.Add(10 * time.Second)
+			So(mc.Set(c, mc.NewItem(c, "b").SetValue([]byte("b"))), ShouldBeNil)
+			tc.Add(5 * time.Second)
+
+			stats, err := mc.Stats(c)
+			So(err, ShouldBeNil)
+			So(stats.Oldest, ShouldEqual, 15)
+
+			_, err = mc.GetKey(c, "a")
+			So(err, ShouldBeNil)
+			stats, err = mc.Stats(c)
+			So(err, ShouldBeNil)
+			So(stats.Oldest, ShouldEqual, 5)
+
+			So(mc.Flush(c), ShouldBeNil)
+			stats, err = mc.Stats(c)
+			So(err, ShouldBeNil)
+			So(stats.Oldest, ShouldEqual, 0)
+		})
+
 		Convey("When adding an item to an unset namespace", func() {
 			So(info.GetNamespace(c), ShouldEqual, "")
 
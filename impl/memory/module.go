@@ -5,6 +5,9 @@
 package memory
 
 import (
+	"fmt"
+	"sort"
+
 	"github.com/luci/gae/service/module"
 	"golang.org/x/net/context"
 )
@@ -19,20 +22,39 @@ type moduleVersion struct {
 
 type modImpl struct {
 	numInstances map[moduleVersion]int
+
+	// gid holds the topology of the application (see
+	// info.Testable.SetModuleVersions).
+	gid *globalInfoData
 }
 
 // useMod adds a Module interface to the context
 func useMod(c context.Context) context.Context {
 	modMap := map[moduleVersion]int{}
 	return module.SetFactory(c, func(ic context.Context) module.RawInterface {
-		return &modImpl{modMap}
+		return &modImpl{modMap, curGID(ic)}
 	})
 }
 
 var _ = module.RawInterface((*modImpl)(nil))
 
 func (mod *modImpl) List() ([]string, error) {
-	return []string{"testModule1", "testModule2"}, nil
+	ret := make([]string, 0, len(mod.gid.modules))
+	for m := range mod.gid.modules {
+		ret = append(ret, m)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (mod *modImpl) getModule(module string) (*moduleVersions, error) {
+	if module == "" {
+		module = mod.gid.moduleName
+	}
+	if mv, ok := mod.gid.modules[module]; ok {
+		return mv, nil
+	}
+	return nil, fmt.Errorf("memory: unknown module %q", module)
 }
 
 func (mod *modImpl) NumInstances(module, version string) (int, error) {
@@ -48,11 +70,19 @@ func (mod *modImpl) SetNumInstances(module, version string, instances int) error
 }
 
 func (mod *modImpl) Versions(module string) ([]string, error) {
-	return []string{"testVersion1", "testVersion2"}, nil
+	mv, err := mod.getModule(module)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), mv.versions...), nil
 }
 
 func (mod *modImpl) DefaultVersion(module string) (string, error) {
-	return "testVersion1", nil
+	mv, err := mod.getModule(module)
+	if err != nil {
+		return "", err
+	}
+	return mv.defaultVersion, nil
 }
 
 func (mod *modImpl) Start(module, version string) error { return nil }
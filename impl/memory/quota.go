@@ -0,0 +1,179 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// QuotaResource is a resource of the memory services which may be limited
+// with SetQuota.
+type QuotaResource int
+
+const (
+	// DatastoreOps is the number of datastore operations: each entity read,
+	// written or deleted counts as one operation, and so does each query.
+	DatastoreOps QuotaResource = iota
+	// MemcacheBytes is the number of bytes (keys and values) written to
+	// memcache by Add, Set and CompareAndSwap.
+	MemcacheBytes
+	// MailRecipients is the number of recipients (To, Cc and Bcc) of the sent
+	// mail messages.
+	MailRecipients
+	// TaskAdds is the number of tasks added to the task queues.
+	TaskAdds
+)
+
+func (r QuotaResource) String() string {
+	switch r {
+	case DatastoreOps:
+		return "datastore operations"
+	case MemcacheBytes:
+		return "memcache bytes"
+	case MailRecipients:
+		return "mail recipients"
+	case TaskAdds:
+		return "task adds"
+	default:
+		return fmt.Sprintf("QuotaResource(%d)", int(r))
+	}
+}
+
+// OverQuotaError is returned by the memory services when an operation would
+// exceed the quota set with SetQuota. It's recognized by info.IsOverQuota.
+type OverQuotaError struct {
+	// Resource is the exhausted resource.
+	Resource QuotaResource
+}
+
+func (e *OverQuotaError) Error() string {
+	return fmt.Sprintf("memory: over quota: %s", e.Resource)
+}
+
+// TimeoutError is returned by the memory services when they're called with a
+// context whose deadline has passed. It's recognized by info.IsTimeoutError.
+//
+// It may also be injected in other services (e.g. with the featureBreaker
+// filter) to exercise the code handling API deadlines.
+type TimeoutError struct {
+	// Service is the name of the service which timed out, e.g. "datastore".
+	Service string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("memory: %s: API deadline exceeded", e.Service)
+}
+
+// isError returns true if err, or any of the errors of err if it's a
+// MultiError, satisfies pred.
+func isError(err error, pred func(error) bool) bool {
+	if me, ok := err.(errors.MultiError); ok {
+		for _, err := range me {
+			if err != nil && isError(err, pred) {
+				return true
+			}
+		}
+		return false
+	}
+	return err != nil && pred(err)
+}
+
+func (gi *giImpl) IsOverQuota(err error) bool {
+	return isError(err, func(err error) bool {
+		_, ok := err.(*OverQuotaError)
+		return ok
+	})
+}
+
+func (gi *giImpl) IsTimeoutError(err error) bool {
+	return isError(err, func(err error) bool {
+		if _, ok := err.(*TimeoutError); ok {
+			return true
+		}
+		return err == context.DeadlineExceeded
+	})
+}
+
+// quotaData holds the remaining budget of the limited resources. It's shared
+// by all the contexts derived from the same UseWithAppID.
+type quotaData struct {
+	sync.Mutex
+	remaining map[QuotaResource]int64
+}
+
+var quotaContextKey = "holds a *quotaData"
+
+func useQuota(c context.Context) context.Context {
+	return context.WithValue(c, &quotaContextKey, &quotaData{
+		remaining: map[QuotaResource]int64{},
+	})
+}
+
+func curQuota(c context.Context) *quotaData {
+	qd, _ := c.Value(&quotaContextKey).(*quotaData)
+	if qd == nil {
+		panic("memory: the quota of the memory services requires memory.Use")
+	}
+	return qd
+}
+
+// SetQuota limits the resource r of the memory services of c to budget
+// further units. Operations which would exceed it fail with an
+// OverQuotaError, without consuming any of it.
+//
+// The budget is shared by all the contexts derived from the same Use (e.g.
+// regardless of the namespace).
+func SetQuota(c context.Context, r QuotaResource, budget int64) {
+	qd := curQuota(c)
+	qd.Lock()
+	defer qd.Unlock()
+	qd.remaining[r] = budget
+}
+
+// ClearQuota removes the limit set with SetQuota on the resource r. This is the
+// initial state of all the resources.
+func ClearQuota(c context.Context, r QuotaResource) {
+	qd := curQuota(c)
+	qd.Lock()
+	defer qd.Unlock()
+	delete(qd.remaining, r)
+}
+
+// RemainingQuota returns the remaining budget of the resource r, and false if
+// r isn't limited.
+func RemainingQuota(c context.Context, r QuotaResource) (int64, bool) {
+	qd := curQuota(c)
+	qd.Lock()
+	defer qd.Unlock()
+	budget, ok := qd.remaining[r]
+	return budget, ok
+}
+
+// consumeQuota checks that the deadline of c hasn't passed, and consumes n
+// units of the resource r of service, if there are enough left.
+func consumeQuota(c context.Context, service string, r QuotaResource, n int64) error {
+	if c.Err() == context.DeadlineExceeded {
+		return &TimeoutError{service}
+	}
+
+	qd, _ := c.Value(&quotaContextKey).(*quotaData)
+	if qd == nil {
+		return nil
+	}
+	qd.Lock()
+	defer qd.Unlock()
+	if budget, ok := qd.remaining[r]; ok {
+		if budget < n {
+			return &OverQuotaError{r}
+		}
+		qd.remaining[r] = budget - n
+	}
+	return nil
+}
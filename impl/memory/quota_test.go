@@ -0,0 +1,152 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	ds "github.com/luci/gae/service/datastore"
+	"github.com/luci/gae/service/info"
+	"github.com/luci/gae/service/mail"
+	mc "github.com/luci/gae/service/memcache"
+	tq "github.com/luci/gae/service/taskqueue"
+
+	"github.com/luci/luci-go/common/clock"
+	"github.com/luci/luci-go/common/clock/testclock"
+	lerrors "github.com/luci/luci-go/common/errors"
+
+	"golang.org/x/net/context"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type QuotaEntity struct {
+	ID    int64 `gae:"$id"`
+	Value string
+}
+
+func TestQuota(t *testing.T) {
+	t.Parallel()
+
+	Convey("quota", t, func() {
+		c := Use(context.Background())
+
+		Convey("resources are unlimited by default", func() {
+			_, limited := RemainingQuota(c, DatastoreOps)
+			So(limited, ShouldBeFalse)
+			So(ds.Put(c, &QuotaEntity{ID: 1}), ShouldBeNil)
+		})
+
+		Convey("datastore operations", func() {
+			SetQuota(c, DatastoreOps, 3)
+
+			So(ds.Put(c, []*QuotaEntity{{ID: 1}, {ID: 2}}), ShouldBeNil)
+			remaining, limited := RemainingQuota(c, DatastoreOps)
+			So(limited, ShouldBeTrue)
+			So(remaining, ShouldEqual, 1)
+
+			Convey("fail when the budget is exhausted", func() {
+				err := ds.Get(c, []*QuotaEntity{{ID: 1}, {ID: 2}})
+				So(err, ShouldErrLike, "over quota: datastore operations")
+				So(info.IsOverQuota(c, err), ShouldBeTrue)
+				So(info.IsTimeoutError(c, err), ShouldBeFalse)
+
+				// The failed operation didn't consume anything.
+				So(ds.Get(c, &QuotaEntity{ID: 1}), ShouldBeNil)
+				_, err = ds.Count(c, ds.NewQuery("QuotaEntity"))
+				So(info.IsOverQuota(c, err), ShouldBeTrue)
+			})
+
+			Convey("are counted in transactions", func() {
+				err := ds.RunInTransaction(c, func(c context.Context) error {
+					return ds.Get(c, []*QuotaEntity{{ID: 1}, {ID: 2}})
+				}, nil)
+				So(info.IsOverQuota(c, err), ShouldBeTrue)
+			})
+
+			Convey("can be unlimited again", func() {
+				ClearQuota(c, DatastoreOps)
+				So(ds.Get(c, []*QuotaEntity{{ID: 1}, {ID: 2}}), ShouldBeNil)
+			})
+
+			Convey("are shared across namespaces", func() {
+				nc := info.MustNamespace(c, "other")
+				err := ds.Put(c, []*QuotaEntity{{ID: 1}, {ID: 2}})
+				So(info.IsOverQuota(nc, err), ShouldBeTrue)
+			})
+		})
+
+		Convey("memcache bytes", func() {
+			SetQuota(c, MemcacheBytes, 10)
+
+			So(mc.Set(c, mc.NewItem(c, "key").SetValue([]byte("value"))), ShouldBeNil)
+			err := mc.Set(c, mc.NewItem(c, "key").SetValue([]byte("value")))
+			So(err, ShouldErrLike, "over quota: memcache bytes")
+			So(info.IsOverQuota(c, err), ShouldBeTrue)
+
+			// Reads are free.
+			itm := mc.NewItem(c, "key")
+			So(mc.Get(c, itm), ShouldBeNil)
+			So(itm.Value(), ShouldResemble, []byte("value"))
+		})
+
+		Convey("mail recipients", func() {
+			SetQuota(c, MailRecipients, 2)
+
+			msg := &mail.Message{
+				Sender: "admin@example.com",
+				To:     []string{"a@example.com", "b@example.com"},
+				Body:   "hello",
+			}
+			So(mail.Send(c, msg), ShouldBeNil)
+			err := mail.Send(c, msg)
+			So(info.IsOverQuota(c, err), ShouldBeTrue)
+			So(mail.GetTestable(c).SentMessages(), ShouldHaveLength, 1)
+		})
+
+		Convey("task adds", func() {
+			SetQuota(c, TaskAdds, 1)
+
+			So(tq.Add(c, "", &tq.Task{Path: "/hello"}), ShouldBeNil)
+			err := tq.Add(c, "", &tq.Task{Path: "/hello"})
+			So(err, ShouldErrLike, "over quota: task adds")
+			So(info.IsOverQuota(c, err), ShouldBeTrue)
+		})
+
+		Convey("deadlines", func() {
+			c, tc := testclock.UseTime(c, testclock.TestTimeUTC)
+			c, cancel := clock.WithTimeout(c, time.Second)
+			defer cancel()
+
+			So(ds.Put(c, &QuotaEntity{ID: 1}), ShouldBeNil)
+
+			tc.Add(2 * time.Second)
+			<-c.Done()
+
+			err := ds.Put(c, &QuotaEntity{ID: 1})
+			So(err, ShouldErrLike, "datastore: API deadline exceeded")
+			So(info.IsTimeoutError(c, err), ShouldBeTrue)
+			So(info.IsOverQuota(c, err), ShouldBeFalse)
+
+			err = mc.Set(c, mc.NewItem(c, "key"))
+			So(info.IsTimeoutError(c, err), ShouldBeTrue)
+		})
+
+		Convey("errors are recognized", func() {
+			So(info.IsOverQuota(c, &OverQuotaError{TaskAdds}), ShouldBeTrue)
+			So(info.IsOverQuota(c, lerrors.MultiError{nil, &OverQuotaError{TaskAdds}}), ShouldBeTrue)
+			So(info.IsOverQuota(c, errors.New("over quota")), ShouldBeFalse)
+			So(info.IsOverQuota(c, nil), ShouldBeFalse)
+
+			So(info.IsTimeoutError(c, &TimeoutError{"urlfetch"}), ShouldBeTrue)
+			So(info.IsTimeoutError(c, context.DeadlineExceeded), ShouldBeTrue)
+			So(info.IsTimeoutError(c, lerrors.MultiError{&TimeoutError{"urlfetch"}}), ShouldBeTrue)
+			So(info.IsTimeoutError(c, errors.New("timeout")), ShouldBeFalse)
+		})
+	})
+}
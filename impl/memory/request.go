@@ -0,0 +1,73 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/luci/gae/service/info"
+	tq "github.com/luci/gae/service/taskqueue"
+	"github.com/luci/gae/service/user"
+
+	log "github.com/luci/luci-go/common/logging"
+
+	"golang.org/x/net/context"
+)
+
+var requestLogID = http.CanonicalHeaderKey("X-AppEngine-Request-Log-Id")
+
+// WithRequest returns a context for serving r, derived from c (which must have
+// the memory services installed), the way appengine.NewContext does in
+// production:
+//   * X-AppEngine-Current-Namespace sets the namespace.
+//   * X-AppEngine-Request-Log-Id sets the request ID of info.
+//   * X-AppEngine-User-Email and the other user headers (see
+//     user.FromRequestHeaders) set the current user, and an
+//     "Authorization: Bearer" header sets the OAuth token of the request (see
+//     user.Testable's AddOAuthToken). They take precedence over the user
+//     Testable.
+//   * X-AppEngine-QueueName and the other task headers are available with
+//     taskqueue.GetRequestHeaders.
+//
+// Invalid headers are logged and ignored.
+func WithRequest(c context.Context, r *http.Request) context.Context {
+	if ns := r.Header.Get(currentNamespace); ns != "" {
+		nc, err := info.Namespace(c, ns)
+		if err != nil {
+			(log.Fields{log.ErrorKey: err}).Warningf(c, "memory: ignoring the namespace %q of the request", ns)
+		} else {
+			c = nc
+		}
+	}
+
+	if id := r.Header.Get(requestLogID); id != "" {
+		c = info.GetTestable(c).SetRequestID(id)
+	}
+
+	req := &requestIdentity{user: user.FromRequestHeaders(r.Header)}
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		req.oauthToken = strings.TrimSpace(auth[7:])
+	}
+	if req.user != nil || req.oauthToken != "" {
+		c = context.WithValue(c, &requestIdentityKey, req)
+	}
+
+	switch h, err := tq.ParseRequestHeaders(r.Header); {
+	case err != nil:
+		(log.Fields{log.ErrorKey: err}).Warningf(c, "memory: ignoring the task headers of the request")
+	case h != nil:
+		c = tq.WithRequestHeaders(c, h)
+	}
+	return c
+}
+
+// Middleware returns an http.Handler which serves requests with h, in contexts
+// derived from c with WithRequest.
+func Middleware(c context.Context, h func(c context.Context, rw http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		h(WithRequest(c, r), rw, r)
+	})
+}
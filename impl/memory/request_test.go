@@ -0,0 +1,120 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/luci/gae/service/info"
+	tq "github.com/luci/gae/service/taskqueue"
+	"github.com/luci/gae/service/user"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWithRequest(t *testing.T) {
+	t.Parallel()
+
+	Convey("WithRequest", t, func() {
+		c := Use(context.Background())
+		req, err := http.NewRequest("POST", "https://app.example.com/task", nil)
+		So(err, ShouldBeNil)
+
+		Convey("leaves the context alone without headers", func() {
+			rc := WithRequest(c, req)
+			So(info.GetNamespace(rc), ShouldEqual, "")
+			So(info.RequestID(rc), ShouldEqual, "test-request-id")
+			So(user.Current(rc), ShouldBeNil)
+			So(tq.GetRequestHeaders(rc), ShouldBeNil)
+		})
+
+		Convey("installs the namespace and the request ID", func() {
+			req.Header.Set("X-AppEngine-Current-Namespace", "ns")
+			req.Header.Set("X-AppEngine-Request-Log-Id", "log-id")
+
+			rc := WithRequest(c, req)
+			So(info.GetNamespace(rc), ShouldEqual, "ns")
+			So(info.RequestID(rc), ShouldEqual, "log-id")
+
+			Convey("ignoring invalid namespaces", func() {
+				req.Header.Set("X-AppEngine-Current-Namespace", "bad namespace")
+				So(info.GetNamespace(WithRequest(c, req)), ShouldEqual, "")
+			})
+		})
+
+		Convey("installs the user", func() {
+			user.GetTestable(c).Login("someone@example.com", "", false)
+
+			req.Header.Set(user.EmailHeader, "admin@example.com")
+			req.Header.Set(user.IDHeader, "123")
+			req.Header.Set(user.IsAdminHeader, "1")
+
+			rc := WithRequest(c, req)
+			So(user.Current(rc), ShouldResemble, &user.User{
+				Email:      "admin@example.com",
+				AuthDomain: "example.com",
+				Admin:      true,
+				ID:         "123",
+			})
+			So(user.IsAdmin(rc), ShouldBeTrue)
+
+			// The request doesn't affect the other contexts.
+			So(user.Current(c).Email, ShouldEqual, "someone@example.com")
+			So(user.IsAdmin(c), ShouldBeFalse)
+		})
+
+		Convey("installs the OAuth token", func() {
+			user.GetTestable(c).AddOAuthToken("token", "someone@example.com", "client", false, "scope")
+			req.Header.Set("Authorization", "Bearer token")
+
+			usr, err := user.CurrentOAuth(WithRequest(c, req), "scope")
+			So(err, ShouldBeNil)
+			So(usr.Email, ShouldEqual, "someone@example.com")
+
+			_, err = user.CurrentOAuth(c, "scope")
+			So(err, ShouldEqual, ErrOAuthInvalidRequest)
+		})
+
+		Convey("installs the task headers", func() {
+			req.Header.Set(tq.QueueNameHeader, "queue")
+			req.Header.Set(tq.TaskNameHeader, "task")
+			req.Header.Set(tq.TaskRetryCountHeader, "2")
+			req.Header.Set(tq.TaskExecutionCountHeader, "1")
+			req.Header.Set(tq.TaskETAHeader, "1454472306.500000")
+
+			So(tq.GetRequestHeaders(WithRequest(c, req)), ShouldResemble, &tq.RequestHeaders{
+				QueueName:          "queue",
+				TaskName:           "task",
+				TaskRetryCount:     2,
+				TaskExecutionCount: 1,
+				TaskETA:            time.Unix(1454472306, int64(500*time.Millisecond)).UTC(),
+			})
+
+			Convey("ignoring invalid ones", func() {
+				req.Header.Set(tq.TaskRetryCountHeader, "two")
+				So(tq.GetRequestHeaders(WithRequest(c, req)), ShouldBeNil)
+			})
+		})
+
+		Convey("Middleware serves requests in their context", func() {
+			req.Header.Set("X-AppEngine-Current-Namespace", "ns")
+
+			ns := ""
+			h := Middleware(c, func(c context.Context, rw http.ResponseWriter, r *http.Request) {
+				ns = info.GetNamespace(c)
+				rw.WriteHeader(http.StatusNoContent)
+			})
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			So(ns, ShouldEqual, "ns")
+		})
+	})
+}
@@ -45,6 +45,10 @@ type taskqueueImpl struct {
 var _ tq.RawInterface = (*taskqueueImpl)(nil)
 
 func (t *taskqueueImpl) AddMulti(tasks []*tq.Task, queueName string, cb tq.RawTaskCB) error {
+	if err := consumeQuota(t.ctx, "taskqueue", TaskAdds, int64(len(tasks))); err != nil {
+		return err
+	}
+
 	t.Lock()
 	defer t.Unlock()
 
@@ -145,7 +149,7 @@ func (t *taskqueueImpl) Constraints() tq.Constraints {
 	return t.taskQueueData.getConstraints()
 }
 
-func (t *taskqueueImpl) GetTestable() tq.Testable { return &taskQueueTestable{t.ns, t} }
+func (t *taskqueueImpl) GetTestable() tq.Testable { return &taskQueueTestable{t.ns, t.ctx, t} }
 
 /////////////////////////////// taskqueueTxnImpl ///////////////////////////////
 
@@ -163,6 +167,11 @@ func (t *taskqueueTxnImpl) addLocked(task *tq.Task, q *sortedQueue) (*tq.Task, e
 	if err != nil {
 		return nil, err
 	}
+	// sortedQueue.addTask checks this too, but only once the transaction is
+	// applied, when it can't fail anymore.
+	if (toSched.Method == "PULL") != q.isPullQueue {
+		return nil, errInvalidQueueMode
+	}
 
 	numTasks := 0
 	for _, vs := range t.anony {
@@ -195,6 +204,9 @@ func (t *taskqueueTxnImpl) AddMulti(tasks []*tq.Task, queueName string, cb tq.Ra
 	if err := assertTxnValid(t.ctx); err != nil {
 		return err
 	}
+	if err := consumeQuota(t.ctx, "taskqueue", TaskAdds, int64(len(tasks))); err != nil {
+		return err
+	}
 
 	t.Lock()
 	defer t.Unlock()
@@ -249,7 +261,7 @@ func (t *taskqueueImpl) SetConstraints(c *tq.Constraints) error {
 	return nil
 }
 
-func (t *taskqueueTxnImpl) GetTestable() tq.Testable { return &taskQueueTestable{t.ns, t} }
+func (t *taskqueueTxnImpl) GetTestable() tq.Testable { return &taskQueueTestable{t.ns, t.ctx, t} }
 
 ////////////////////////// private functions ///////////////////////////////////
 
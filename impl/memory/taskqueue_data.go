@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,6 +21,7 @@ import (
 	ds "github.com/luci/gae/service/datastore"
 	tq "github.com/luci/gae/service/taskqueue"
 
+	"github.com/luci/luci-go/common/clock"
 	"github.com/luci/luci-go/common/data/rand/mathrand"
 )
 
@@ -35,7 +37,7 @@ var (
 	errTombstonedTask   = errors.New("TOMBSTONED_TASK")
 	errUnknownTask      = errors.New("UNKNOWN_TASK")
 	errInvalidQueueMode = errors.New("INVALID_QUEUE_MODE")
-	errTaskLeaseExpired = errors.New("TASK_LEASE_EXPIRED")
+	errTaskLeaseExpired = tq.ErrTaskLeaseExpired
 )
 
 //////////////////////////////// sortedQueue ///////////////////////////////////
@@ -49,6 +51,10 @@ type sortedQueue struct {
 
 	sorted       taskIndex             // sorted by (ETA, name)
 	sortedPerTag map[string]*taskIndex // tag => tasks sorted by (ETA, name)
+
+	// leased are the names of the tasks which were leased. Their lease is over
+	// once their ETA is past.
+	leased map[string]struct{}
 }
 
 func newSortedQueue(name string, isPullQueue bool) *sortedQueue {
@@ -58,6 +64,7 @@ func newSortedQueue(name string, isPullQueue bool) *sortedQueue {
 		tasks:        map[string]*tq.Task{},
 		archived:     map[string]*tq.Task{},
 		sortedPerTag: map[string]*taskIndex{},
+		leased:       map[string]struct{}{},
 	}
 }
 
@@ -117,6 +124,7 @@ func (q *sortedQueue) deleteTask(task *tq.Task) error {
 	t := q.tasks[task.Name]
 	q.archived[task.Name] = t
 	delete(q.tasks, task.Name)
+	delete(q.leased, task.Name)
 
 	if q.isPullQueue {
 		q.sorted.remove(t)
@@ -180,6 +188,7 @@ func (q *sortedQueue) leaseTasks(now time.Time, maxTasks int, leaseTime time.Dur
 		t.ETA = newETA
 		q.sorted.add(t)
 		q.sortedPerTag[t.Tag].add(t)
+		q.leased[t.Name] = struct{}{}
 	}
 
 	out := make([]*tq.Task, len(tasks))
@@ -238,6 +247,24 @@ func (q *sortedQueue) purge() {
 	q.archived = map[string]*tq.Task{}
 	q.sorted = taskIndex{}
 	q.sortedPerTag = map[string]*taskIndex{}
+	q.leased = map[string]struct{}{}
+}
+
+// clone returns a deep copy of the queue.
+func (q *sortedQueue) clone() *sortedQueue {
+	ret := newSortedQueue(q.name, q.isPullQueue)
+	for _, t := range q.tasks {
+		if err := ret.addTask(t.Duplicate()); err != nil {
+			panic(err)
+		}
+	}
+	for name, t := range q.archived {
+		ret.archived[name] = t.Duplicate()
+	}
+	for name := range q.leased {
+		ret.leased[name] = struct{}{}
+	}
+	return ret
 }
 
 func (q *sortedQueue) getStats() *tq.Statistics {
@@ -254,6 +281,46 @@ func (q *sortedQueue) getStats() *tq.Statistics {
 	return &s
 }
 
+// getTagStats returns the statistics of the tasks which aren't leased at now,
+// per tag.
+func (q *sortedQueue) getTagStats(now time.Time) ([]tq.TagStatistics, error) {
+	if !q.isPullQueue {
+		return nil, errInvalidQueueMode
+	}
+
+	ret := make([]tq.TagStatistics, 0, len(q.sortedPerTag))
+	for tag, idx := range q.sortedPerTag {
+		s := tq.TagStatistics{Tag: tag}
+		for _, t := range idx.data {
+			if _, ok := q.leased[t.Name]; ok && t.ETA.After(now) {
+				continue
+			}
+			if s.Tasks == 0 || t.ETA.Before(s.OldestETA) {
+				s.OldestETA = t.ETA
+			}
+			s.Tasks++
+		}
+		if s.Tasks > 0 {
+			ret = append(ret, s)
+		}
+	}
+	sort.Sort(tagStatsSlice(ret))
+	return ret, nil
+}
+
+// tagStatsSlice sorts tq.TagStatistics by (OldestETA, Tag).
+type tagStatsSlice []tq.TagStatistics
+
+func (s tagStatsSlice) Len() int      { return len(s) }
+func (s tagStatsSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s tagStatsSlice) Less(i, j int) bool {
+	if s[i].OldestETA.Equal(s[j].OldestETA) {
+		return s[i].Tag < s[j].Tag
+	}
+	return s[i].OldestETA.Before(s[j].OldestETA)
+}
+
 /////////////////////////////// Indexing helpers ///////////////////////////////
 
 // taskIndex is a heap of tasks sorted by (ETA, name), oldest first.
@@ -402,6 +469,17 @@ func (t *taskQueueData) getScheduledTasks(ns string) tq.QueueData {
 	return r
 }
 
+func (t *taskQueueData) getTagStats(now time.Time, queueName string) ([]tq.TagStatistics, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	q, err := t.getQueueLocked(queueName)
+	if err != nil {
+		return nil, err
+	}
+	return q.getTagStats(now)
+}
+
 func (t *taskQueueData) getTombstonedTasks(ns string) tq.QueueData {
 	t.Lock()
 	defer t.Unlock()
@@ -418,6 +496,33 @@ func (t *taskQueueData) getTombstonedTasks(ns string) tq.QueueData {
 	return r
 }
 
+// taskQueueSnapshot is a tq.TestingSnapshot of all the queues.
+type taskQueueSnapshot map[string]*sortedQueue
+
+func (taskQueueSnapshot) ImATestingSnapshot() {}
+
+func (s taskQueueSnapshot) clone() taskQueueSnapshot {
+	ret := make(taskQueueSnapshot, len(s))
+	for qn, q := range s {
+		ret[qn] = q.clone()
+	}
+	return ret
+}
+
+func (t *taskQueueData) takeSnapshot() tq.TestingSnapshot {
+	t.Lock()
+	defer t.Unlock()
+
+	return taskQueueSnapshot(t.queues).clone()
+}
+
+func (t *taskQueueData) restoreSnapshot(snap tq.TestingSnapshot) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.queues = snap.(taskQueueSnapshot).clone()
+}
+
 func (t *taskQueueData) resetTasksWithLock() {
 	for _, q := range t.queues {
 		q.purge()
@@ -537,6 +642,18 @@ func (t *txnTaskQueueData) getScheduledTasks(ns string) tq.QueueData {
 	return t.parent.getScheduledTasks(ns)
 }
 
+func (t *txnTaskQueueData) getTagStats(now time.Time, queueName string) ([]tq.TagStatistics, error) {
+	return t.parent.getTagStats(now, queueName)
+}
+
+func (t *txnTaskQueueData) takeSnapshot() tq.TestingSnapshot {
+	return t.parent.takeSnapshot()
+}
+
+func (t *txnTaskQueueData) restoreSnapshot(snap tq.TestingSnapshot) {
+	t.parent.restoreSnapshot(snap)
+}
+
 func (t *txnTaskQueueData) createQueue(queueName string) {
 	t.parent.createQueue(queueName)
 }
@@ -549,13 +666,17 @@ func (t *txnTaskQueueData) createPullQueue(queueName string) {
 // specified namespace.
 type taskQueueTestable struct {
 	ns   string
+	ctx  context.Context
 	data interface {
 		resetTasks()
 		getTombstonedTasks(ns string) tq.QueueData
 		getScheduledTasks(ns string) tq.QueueData
 		getTransactionTasks(ns string) tq.AnonymousQueueData
+		getTagStats(now time.Time, queueName string) ([]tq.TagStatistics, error)
 		createQueue(queueName string)
 		createPullQueue(queueName string)
+		takeSnapshot() tq.TestingSnapshot
+		restoreSnapshot(tq.TestingSnapshot)
 	}
 }
 
@@ -571,3 +692,13 @@ func (t *taskQueueTestable) GetTransactionTasks() tq.AnonymousQueueData {
 }
 func (t *taskQueueTestable) CreateQueue(queueName string)     { t.data.createQueue(queueName) }
 func (t *taskQueueTestable) CreatePullQueue(queueName string) { t.data.createPullQueue(queueName) }
+func (t *taskQueueTestable) TagStats(queueName string) ([]tq.TagStatistics, error) {
+	return t.data.getTagStats(clock.Now(t.ctx), queueName)
+}
+func (t *taskQueueTestable) SelectTasks(m *tq.TaskMatcher) tq.MatchedTasks {
+	return t.GetScheduledTasks().Select(m)
+}
+func (t *taskQueueTestable) TakeSnapshot() tq.TestingSnapshot { return t.data.takeSnapshot() }
+func (t *taskQueueTestable) RestoreSnapshot(snap tq.TestingSnapshot) {
+	t.data.restoreSnapshot(snap)
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -368,6 +370,17 @@ func TestTaskQueue(t *testing.T) {
 				}, nil), ShouldBeNil)
 			})
 
+			Convey("unless you Add to a queue of the wrong mode", func() {
+				tqt.CreatePullQueue("pull")
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					So(tq.Add(c, "pull", &tq.Task{Method: "PULL"}), ShouldBeNil)
+					So(tq.Add(c, "pull", &tq.Task{Path: "/push"}).Error(), ShouldContainSubstring, "INVALID_QUEUE_MODE")
+					So(tq.Add(c, "", &tq.Task{Method: "PULL"}).Error(), ShouldContainSubstring, "INVALID_QUEUE_MODE")
+					return nil
+				}, nil), ShouldBeNil)
+				So(len(tqt.GetScheduledTasks()["pull"]), ShouldEqual, 1)
+			})
+
 			Convey("No other features are available, however", func() {
 				So(ds.RunInTransaction(c, func(c context.Context) error {
 					So(tq.Delete(c, "", t).Error(), ShouldContainSubstring, "cannot DeleteMulti from a transaction")
@@ -959,6 +972,196 @@ func TestTaskQueue(t *testing.T) {
 					So(leased[i].Name, ShouldEqual, fmt.Sprintf("task-%d", i))
 				}
 			})
+
+			Convey("TagStats", func() {
+				now := clock.Now(c)
+
+				// Push queues have no tags.
+				_, err := tqt.TagStats("push")
+				So(err, ShouldErrLike, "INVALID_QUEUE_MODE")
+
+				stats, err := tqt.TagStats("pull")
+				So(err, ShouldBeNil)
+				So(stats, ShouldResemble, []tq.TagStatistics{})
+
+				for i := 0; i < 3; i++ {
+					err := tq.Add(c, "pull",
+						&tq.Task{
+							Method: "PULL",
+							Name:   fmt.Sprintf("task-b-%d", i),
+							ETA:    now.Add(time.Duration(i+1) * time.Second),
+							Tag:    "b",
+						},
+						&tq.Task{
+							Method: "PULL",
+							Name:   fmt.Sprintf("task-a-%d", i),
+							ETA:    now.Add(time.Duration(i+2) * time.Second),
+							Tag:    "a",
+						})
+					So(err, ShouldBeNil)
+				}
+				So(tq.Add(c, "pull", &tq.Task{
+					Method: "PULL",
+					Name:   "task",
+					ETA:    now.Add(time.Second),
+				}), ShouldBeNil)
+
+				stats, err = tqt.TagStats("pull")
+				So(err, ShouldBeNil)
+				So(stats, ShouldResemble, []tq.TagStatistics{
+					{Tag: "", Tasks: 1, OldestETA: now.Add(time.Second)},
+					{Tag: "b", Tasks: 3, OldestETA: now.Add(time.Second)},
+					{Tag: "a", Tasks: 3, OldestETA: now.Add(2 * time.Second)},
+				})
+
+				Convey("reflects leases and deletions", func() {
+					tc.Add(time.Minute)
+
+					leasedB, err := tq.LeaseByTag(c, 100, "pull", time.Minute, "b")
+					So(err, ShouldBeNil)
+					So(len(leasedB), ShouldEqual, 3)
+					So(tq.Delete(c, "pull", leasedB[0]), ShouldBeNil)
+
+					leased, err := tq.LeaseByTag(c, 100, "pull", time.Minute, "")
+					So(err, ShouldBeNil)
+					So(tq.Delete(c, "pull", leased...), ShouldBeNil)
+
+					// The leased tasks aren't pending.
+					stats, err = tqt.TagStats("pull")
+					So(err, ShouldBeNil)
+					So(stats, ShouldResemble, []tq.TagStatistics{
+						{Tag: "a", Tasks: 3, OldestETA: now.Add(2 * time.Second)},
+					})
+
+					// Until their lease expires, or is released.
+					So(tq.ModifyLease(c, leasedB[1], "pull", 0), ShouldBeNil)
+					stats, err = tqt.TagStats("pull")
+					So(err, ShouldBeNil)
+					So(stats, ShouldResemble, []tq.TagStatistics{
+						{Tag: "a", Tasks: 3, OldestETA: now.Add(2 * time.Second)},
+						{Tag: "b", Tasks: 1, OldestETA: now.Add(time.Minute)},
+					})
+
+					tc.Add(time.Minute)
+					stats, err = tqt.TagStats("pull")
+					So(err, ShouldBeNil)
+					So(stats, ShouldResemble, []tq.TagStatistics{
+						{Tag: "a", Tasks: 3, OldestETA: now.Add(2 * time.Second)},
+						{Tag: "b", Tasks: 2, OldestETA: now.Add(time.Minute)},
+					})
+				})
+			})
+
+			Convey("LeaseOldestTag", func() {
+				now := clock.Now(c)
+				tqt.CreatePullQueue("pull2")
+
+				// Nothing anywhere.
+				qn, leased, err := tq.LeaseOldestTag(c, 100, time.Minute, "pull", "pull2")
+				So(err, ShouldBeNil)
+				So(qn, ShouldEqual, "")
+				So(leased, ShouldBeNil)
+
+				So(tq.Add(c, "pull",
+					&tq.Task{Method: "PULL", Name: "a", ETA: now.Add(2 * time.Second), Tag: "a"},
+					&tq.Task{Method: "PULL", Name: "b", ETA: now.Add(3 * time.Second), Tag: "b"},
+				), ShouldBeNil)
+				So(tq.Add(c, "pull2",
+					&tq.Task{Method: "PULL", Name: "c-0", ETA: now.Add(time.Second), Tag: "c"},
+					&tq.Task{Method: "PULL", Name: "c-1", ETA: now.Add(4 * time.Second), Tag: "c"},
+					&tq.Task{Method: "PULL", Name: "d", ETA: now.Add(time.Second), Tag: "d"},
+				), ShouldBeNil)
+
+				// Nothing ready yet.
+				qn, leased, err = tq.LeaseOldestTag(c, 100, time.Minute, "pull", "pull2")
+				So(err, ShouldBeNil)
+				So(qn, ShouldEqual, "")
+
+				tc.Add(time.Minute)
+
+				qn, leased, err = tq.LeaseOldestTag(c, 100, time.Minute, "pull", "pull2")
+				So(err, ShouldBeNil)
+				So(qn, ShouldEqual, "pull2")
+				So(len(leased), ShouldEqual, 2)
+				So(leased[0].Name, ShouldEqual, "c-0")
+				So(leased[1].Name, ShouldEqual, "c-1")
+
+				qn, leased, err = tq.LeaseOldestTag(c, 100, time.Minute, "pull", "pull2")
+				So(err, ShouldBeNil)
+				So(qn, ShouldEqual, "pull2")
+				So(len(leased), ShouldEqual, 1)
+				So(leased[0].Name, ShouldEqual, "d")
+
+				qn, leased, err = tq.LeaseOldestTag(c, 100, time.Minute, "pull", "pull2")
+				So(err, ShouldBeNil)
+				So(qn, ShouldEqual, "pull")
+				So(len(leased), ShouldEqual, 1)
+				So(leased[0].Name, ShouldEqual, "a")
+			})
+		})
+
+		Convey("Testable", func() {
+			tqt.CreatePullQueue("pull")
+
+			So(tq.Add(c, "", &tq.Task{Name: "a", Path: "/a?x=1", Delay: time.Minute}), ShouldBeNil)
+			So(tq.Add(c, "", tq.NewPOSTTask("/b", url.Values{"x": {"2"}})), ShouldBeNil)
+			So(tq.Add(c, "pull", &tq.Task{Name: "c", Method: "PULL", Tag: "t"}), ShouldBeNil)
+			So(tq.Add(info.MustNamespace(c, "ns"), "", &tq.Task{Name: "d", Path: "/d"}), ShouldBeNil)
+
+			Convey("can select tasks", func() {
+				all := tqt.SelectTasks(&tq.TaskMatcher{})
+				So(len(all), ShouldEqual, 3)
+				So(all[2].Name, ShouldEqual, "a") // the latest ETA
+
+				So(tqt.SelectTasks(&tq.TaskMatcher{DueBy: now}).Paths(), ShouldResemble, []string{"/b", ""})
+				So(tqt.SelectTasks(&tq.TaskMatcher{Queues: []string{""}}).Paths(), ShouldResemble, []string{"/b", "/a?x=1"})
+				So(tqt.SelectTasks(&tq.TaskMatcher{Path: "/a"}).Paths(), ShouldResemble, []string{"/a?x=1"})
+				So(tqt.SelectTasks(&tq.TaskMatcher{Tags: []string{"t"}}).Tasks()[0].Name, ShouldEqual, "c")
+				So(tqt.SelectTasks(&tq.TaskMatcher{Params: url.Values{"x": {"1"}}}).Paths(), ShouldResemble, []string{"/a?x=1"})
+				So(tqt.SelectTasks(&tq.TaskMatcher{Params: url.Values{"x": {"2"}}}).Paths(), ShouldResemble, []string{"/b"})
+				So(tqt.SelectTasks(&tq.TaskMatcher{
+					Header: http.Header{"content-type": {"application/x-www-form-urlencoded"}},
+				}).Paths(), ShouldResemble, []string{"/b"})
+
+				ns := tq.GetTestable(info.MustNamespace(c, "ns")).SelectTasks(&tq.TaskMatcher{})
+				So(ns.Paths(), ShouldResemble, []string{"/d"})
+			})
+
+			Convey("can diff tasks", func() {
+				got := tqt.SelectTasks(&tq.TaskMatcher{Queues: []string{"pull"}})
+				So(tq.DiffTasks(got, got), ShouldEqual, "")
+
+				want := tq.MatchedTasks{{"pull", &tq.Task{Method: "PULL", Tag: "u", ETA: now}}}
+				So(tq.DiffTasks(want, got), ShouldEqual, strings.Join([]string{
+					`+pull PULL eta=2000-01-01T01:01:01.000000001Z tag="t"`,
+					`-pull PULL eta=2000-01-01T01:01:01.000000001Z tag="u"`,
+				}, "\n"))
+			})
+
+			Convey("can snapshot and restore the state", func() {
+				So(tq.Delete(c, "", &tq.Task{Name: "a"}), ShouldBeNil)
+				snap := tqt.TakeSnapshot()
+
+				tqt.ResetTasks()
+				tqt.CreateQueue("other")
+				So(tq.Add(c, "other", &tq.Task{Name: "e"}), ShouldBeNil)
+
+				tqt.RestoreSnapshot(snap)
+				So(len(tqt.SelectTasks(&tq.TaskMatcher{})), ShouldEqual, 2)
+				So(tqt.GetTombstonedTasks()["default"], ShouldContainKey, "a")
+				So(tqt.GetScheduledTasks(), ShouldNotContainKey, "other")
+				So(tq.Add(c, "", &tq.Task{Name: "a"}), ShouldEqual, tq.ErrTaskAlreadyAdded)
+
+				// Leasing works on the restored pull queue, without touching the snapshot.
+				leased, err := tq.Lease(c, 10, "pull", time.Minute)
+				So(err, ShouldBeNil)
+				So(len(leased), ShouldEqual, 1)
+
+				tqt.RestoreSnapshot(snap)
+				leased, err = tq.Lease(c, 10, "pull", time.Minute)
+				So(err, ShouldBeNil)
+				So(len(leased), ShouldEqual, 1)
+			})
 		})
 	})
 }
@@ -7,6 +7,7 @@ package memory
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net/mail"
 	"net/url"
@@ -18,14 +19,64 @@ import (
 	"github.com/luci/gae/service/user"
 )
 
+var (
+	// ErrOAuthInvalidRequest is returned by CurrentOAuth and OAuthConsumerKey
+	// when the request doesn't carry an OAuth token, like the OAUTH_INVALID_REQUEST
+	// error of the production service.
+	ErrOAuthInvalidRequest = errors.New("user: OAUTH_INVALID_REQUEST")
+
+	// ErrOAuthInvalidToken is returned by CurrentOAuth and OAuthConsumerKey when
+	// the OAuth token of the request wasn't registered, or doesn't grant any of
+	// the requested scopes, like the OAUTH_INVALID_TOKEN error of the production
+	// service.
+	ErrOAuthInvalidToken = errors.New("user: OAUTH_INVALID_TOKEN")
+)
+
+// oauthToken is an OAuth token registered with AddOAuthToken.
+type oauthToken struct {
+	user   *user.User
+	scopes map[string]struct{}
+}
+
+// grants returns true if the token grants any of scopes, or if there are no
+// scopes.
+func (t *oauthToken) grants(scopes []string) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+	for _, s := range scopes {
+		if _, ok := t.scopes[s]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 type userData struct {
 	sync.RWMutex
 	user *user.User
+
+	// oauthTokens are the tokens registered with AddOAuthToken.
+	oauthTokens map[string]*oauthToken
+	// oauthToken is the OAuth token of the current request.
+	oauthToken string
 }
 
+// requestIdentity is the identity carried by the request of a context (see
+// WithRequest). It takes precedence over the one set with the Testable.
+type requestIdentity struct {
+	// user is the signed-in user, or nil.
+	user *user.User
+	// oauthToken is the OAuth bearer token, or empty.
+	oauthToken string
+}
+
+var requestIdentityKey = "holds a *requestIdentity"
+
 // userImpl is a contextual pointer to the current userData.
 type userImpl struct {
 	data *userData
+	req  *requestIdentity
 }
 
 var _ user.RawInterface = (*userImpl)(nil)
@@ -33,14 +84,23 @@ var _ user.RawInterface = (*userImpl)(nil)
 // useUser adds a user.RawInterface implementation to context, accessible
 // by user.Raw(c) or the exported user methods.
 func useUser(c context.Context) context.Context {
-	data := &userData{}
+	data := &userData{oauthTokens: map[string]*oauthToken{}}
 
 	return user.SetFactory(c, func(ic context.Context) user.RawInterface {
-		return &userImpl{data}
+		req, _ := ic.Value(&requestIdentityKey).(*requestIdentity)
+		if req == nil {
+			req = &requestIdentity{}
+		}
+		return &userImpl{data, req}
 	})
 }
 
 func (u *userImpl) Current() *user.User {
+	if u.req.user != nil {
+		ret := *u.req.user
+		return &ret
+	}
+
 	u.data.RLock()
 	defer u.data.RUnlock()
 	if u.data.user != nil && u.data.user.ClientID == "" {
@@ -51,17 +111,41 @@ func (u *userImpl) Current() *user.User {
 }
 
 func (u *userImpl) CurrentOAuth(scopes ...string) (*user.User, error) {
-	// TODO(riannucci): something more clever in the Testable interface here?
 	u.data.RLock()
 	defer u.data.RUnlock()
+	usr, err := u.currentOAuthLocked(scopes)
+	if err != nil {
+		return nil, err
+	}
+	ret := *usr
+	return &ret, nil
+}
+
+// currentOAuthLocked returns the user of the OAuth token of the request, or of
+// the user logged in with a client ID, who is granted all the scopes.
+func (u *userImpl) currentOAuthLocked(scopes []string) (*user.User, error) {
+	token := u.req.oauthToken
+	if token == "" {
+		token = u.data.oauthToken
+	}
+	if token != "" {
+		tok, ok := u.data.oauthTokens[token]
+		if !ok || !tok.grants(scopes) {
+			return nil, ErrOAuthInvalidToken
+		}
+		return tok.user, nil
+	}
 	if u.data.user != nil && u.data.user.ClientID != "" {
-		ret := *u.data.user
-		return &ret, nil
+		return u.data.user, nil
 	}
-	return nil, nil
+	return nil, ErrOAuthInvalidRequest
 }
 
 func (u *userImpl) IsAdmin() bool {
+	if u.req.user != nil {
+		return u.req.user.Admin
+	}
+
 	u.data.RLock()
 	defer u.data.RUnlock()
 	return u.data.user != nil && u.data.user.Admin
@@ -76,11 +160,38 @@ func (u *userImpl) LogoutURL(dest string) (string, error) {
 }
 
 func (u *userImpl) LoginURLFederated(dest, identity string) (string, error) {
-	return "", fmt.Errorf("LoginURLFederated is deprecated")
+	if _, err := federatedProvider(identity); err != nil {
+		return "", err
+	}
+	return "https://fakeapp.example.com/_ah/login?redirect=" + url.QueryEscape(dest) +
+		"&federated_identity=" + url.QueryEscape(identity), nil
 }
 
+// OAuthConsumerKey returns the client ID of the OAuth token of the request.
 func (u *userImpl) OAuthConsumerKey() (string, error) {
-	return "", fmt.Errorf("OAuthConsumerKey is deprecated")
+	u.data.RLock()
+	defer u.data.RUnlock()
+	usr, err := u.currentOAuthLocked(nil)
+	if err != nil {
+		return "", err
+	}
+	return usr.ClientID, nil
+}
+
+// federatedProvider returns the provider (the host) of a federated identity
+// URL.
+func federatedProvider(identity string) (string, error) {
+	if !strings.Contains(identity, "://") {
+		identity = "https://" + identity
+	}
+	u, err := url.Parse(identity)
+	if err != nil {
+		return "", fmt.Errorf("invalid federated identity (%q): %s", identity, err)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid federated identity (%q): no provider", identity)
+	}
+	return u.Host, nil
 }
 
 func (u *userImpl) GetTestable() user.Testable { return u }
@@ -92,6 +203,48 @@ func (u *userImpl) SetUser(user *user.User) {
 }
 
 func (u *userImpl) Login(email, clientID string, admin bool) {
+	u.SetUser(makeUser(email, clientID, admin))
+}
+
+func (u *userImpl) LoginFederated(email, identity string, admin bool) {
+	provider, err := federatedProvider(identity)
+	if err != nil {
+		panic(err)
+	}
+
+	usr := makeUser(email, "", admin)
+	usr.FederatedIdentity = identity
+	usr.FederatedProvider = provider
+	u.SetUser(usr)
+}
+
+func (u *userImpl) AddOAuthToken(token, email, clientID string, admin bool, scopes ...string) {
+	if token == "" || clientID == "" {
+		panic(errors.New("an OAuth token needs a token and a client ID"))
+	}
+
+	tok := &oauthToken{
+		user:   makeUser(email, clientID, admin),
+		scopes: make(map[string]struct{}, len(scopes)),
+	}
+	for _, s := range scopes {
+		tok.scopes[s] = struct{}{}
+	}
+
+	u.data.Lock()
+	defer u.data.Unlock()
+	u.data.oauthTokens[token] = tok
+}
+
+func (u *userImpl) SetOAuthToken(token string) {
+	u.data.Lock()
+	defer u.data.Unlock()
+	u.data.oauthToken = token
+}
+
+// makeUser generates a User object with values derived from email, clientID
+// and admin.
+func makeUser(email, clientID string, admin bool) *user.User {
 	adr, err := mail.ParseAddress(email)
 	if err != nil {
 		panic(err)
@@ -105,14 +258,14 @@ func (u *userImpl) Login(email, clientID string, admin bool) {
 
 	id := sha256.Sum256([]byte("ID:" + email))
 
-	u.SetUser(&user.User{
+	return &user.User{
 		Email:      email,
 		AuthDomain: parts[1],
 		Admin:      admin,
 
 		ID:       fmt.Sprint(binary.LittleEndian.Uint64(id[:])),
 		ClientID: clientID,
-	})
+	}
 }
 
 func (u *userImpl) Logout() {
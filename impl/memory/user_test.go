@@ -25,7 +25,7 @@ func TestUser(t *testing.T) {
 			So(user.Current(c), ShouldBeNil)
 
 			usr, err := user.CurrentOAuth(c, "something")
-			So(err, ShouldBeNil)
+			So(err, ShouldEqual, ErrOAuthInvalidRequest)
 			So(usr, ShouldBeNil)
 
 			So(user.IsAdmin(c), ShouldBeFalse)
@@ -41,7 +41,7 @@ func TestUser(t *testing.T) {
 
 			usr, err := user.CurrentOAuth(c, "scope")
 			So(usr, ShouldBeNil)
-			So(err, ShouldBeNil)
+			So(err, ShouldEqual, ErrOAuthInvalidRequest)
 
 			Convey("and logout", func() {
 				user.GetTestable(c).Logout()
@@ -49,7 +49,7 @@ func TestUser(t *testing.T) {
 
 				usr, err := user.CurrentOAuth(c, "scope")
 				So(usr, ShouldBeNil)
-				So(err, ShouldBeNil)
+				So(err, ShouldEqual, ErrOAuthInvalidRequest)
 			})
 		})
 
@@ -83,7 +83,7 @@ func TestUser(t *testing.T) {
 
 				usr, err := user.CurrentOAuth(c, "scope")
 				So(usr, ShouldBeNil)
-				So(err, ShouldBeNil)
+				So(err, ShouldEqual, ErrOAuthInvalidRequest)
 			})
 		})
 
@@ -103,15 +103,75 @@ func TestUser(t *testing.T) {
 			So(url, ShouldEqual, "https://fakeapp.example.com/_ah/logout?redirect=https%3A%2F%2Ffunky.example.com")
 		})
 
-		Convey("Some stuff is deprecated", func() {
-			url, err := user.LoginURLFederated(c, "https://something", "something")
-			So(err, ShouldErrLike, "LoginURLFederated is deprecated")
-			So(url, ShouldEqual, "")
+		Convey("oauth tokens", func() {
+			tst := user.GetTestable(c)
+			tst.AddOAuthToken("token", "hello@world.com", "clientID", false, "scope1", "scope2")
+
+			Convey("authenticate the request", func() {
+				tst.SetOAuthToken("token")
+
+				usr, err := user.CurrentOAuth(c, "other", "scope2")
+				So(err, ShouldBeNil)
+				So(usr, ShouldResemble, &user.User{
+					Email:      "hello@world.com",
+					AuthDomain: "world.com",
+					ID:         "14628837901535854097",
+					ClientID:   "clientID",
+				})
+
+				key, err := user.OAuthConsumerKey(c)
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "clientID")
+
+				So(user.Current(c), ShouldBeNil)
+
+				Convey("for the scopes of the token only", func() {
+					usr, err := user.CurrentOAuth(c, "other")
+					So(err, ShouldEqual, ErrOAuthInvalidToken)
+					So(usr, ShouldBeNil)
+				})
+
+				Convey("until the token is removed", func() {
+					tst.SetOAuthToken("")
+					_, err := user.CurrentOAuth(c)
+					So(err, ShouldEqual, ErrOAuthInvalidRequest)
+					_, err = user.OAuthConsumerKey(c)
+					So(err, ShouldEqual, ErrOAuthInvalidRequest)
+				})
+			})
+
+			Convey("must be registered", func() {
+				tst.SetOAuthToken("unknown")
+
+				_, err := user.CurrentOAuth(c)
+				So(err, ShouldEqual, ErrOAuthInvalidToken)
+				_, err = user.OAuthConsumerKey(c)
+				So(err, ShouldEqual, ErrOAuthInvalidToken)
+			})
 
-			key, err := user.OAuthConsumerKey(c)
-			So(err, ShouldErrLike, "OAuthConsumerKey is deprecated")
-			So(key, ShouldEqual, "")
+			Convey("need a client ID", func() {
+				So(func() { tst.AddOAuthToken("token", "hello@world.com", "", false) },
+					ShouldPanicLike, "needs a token and a client ID")
+			})
 		})
 
+		Convey("federated logins", func() {
+			url, err := user.LoginURLFederated(c, "https://funky.example.com", "https://openid.example.com/me")
+			So(err, ShouldBeNil)
+			So(url, ShouldEqual, "https://fakeapp.example.com/_ah/login?redirect=https%3A%2F%2Ffunky.example.com"+
+				"&federated_identity=https%3A%2F%2Fopenid.example.com%2Fme")
+
+			_, err = user.LoginURLFederated(c, "https://funky.example.com", "")
+			So(err, ShouldErrLike, "invalid federated identity")
+
+			user.GetTestable(c).LoginFederated("hello@world.com", "openid.example.com/me", false)
+			So(user.Current(c), ShouldResemble, &user.User{
+				Email:             "hello@world.com",
+				AuthDomain:        "world.com",
+				ID:                "14628837901535854097",
+				FederatedIdentity: "openid.example.com/me",
+				FederatedProvider: "openid.example.com",
+			})
+		})
 	})
 }
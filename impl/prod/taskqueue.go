@@ -7,6 +7,7 @@ package prod
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/luci/gae/impl/prod/constraints"
@@ -148,8 +149,13 @@ func (t tqImpl) LeaseByTag(maxTasks int, queueName string, leaseTime time.Durati
 func (t tqImpl) ModifyLease(task *tq.Task, queueName string, leaseTime time.Duration) error {
 	realTask := tqF2R(task)
 	err := taskqueue.ModifyLease(t.aeCtx, realTask, queueName, int(leaseTime/time.Second))
-	if err == nil {
+	switch {
+	case err == nil:
 		task.ETA = realTask.ETA
+	case strings.Contains(err.Error(), "TASK_LEASE_EXPIRED"):
+		// The SDK doesn't export the service error codes, so this is the best we
+		// can do to surface lease loss in a uniform way.
+		err = tq.ErrTaskLeaseExpired
 	}
 	return err
 }
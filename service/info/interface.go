@@ -46,6 +46,24 @@ type RawInterface interface {
 type Testable interface {
 	SetVersionID(string) context.Context
 	SetRequestID(string) context.Context
+
+	SetModuleName(string) context.Context
+	SetInstanceID(string) context.Context
+	SetDatacenter(string) context.Context
+	SetServerSoftware(string) context.Context
+	SetIsDevAppServer(bool) context.Context
+	SetDefaultVersionHostname(string) context.Context
+
+	// SetModuleVersions adds module, with the given versions, to the topology
+	// of the application, which ModuleHostname uses to resolve hostnames. If
+	// module was already there, its versions are replaced. defaultVersion is
+	// the version serving the module's traffic by default.
+	SetModuleVersions(module, defaultVersion string, versions ...string) context.Context
+
+	// SetAccessToken makes AccessToken return token and expiry when it's called
+	// with the given scopes, in any order. AccessToken mints fake tokens for the
+	// other scopes.
+	SetAccessToken(token string, expiry time.Time, scopes ...string) context.Context
 }
 
 // AppID returns the current App ID.
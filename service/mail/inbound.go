@@ -0,0 +1,316 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	net_mail "net/mail"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The paths to which App Engine delivers the inbound messages and the bounce
+// notifications of the application.
+const (
+	// InboundPath is followed by the address of the recipient, e.g.
+	// "/_ah/mail/support@app-id.appspotmail.com".
+	InboundPath = "/_ah/mail/"
+	BouncePath  = "/_ah/bounce"
+)
+
+// maxBounceMemory is the memory used to parse a bounce notification, beyond
+// which its fields are stored on disk.
+const maxBounceMemory = 32 << 20
+
+// InboundMessage is a message received by the application.
+type InboundMessage struct {
+	// Message is the received message:
+	//   * Sender is its From address, and To and Cc its recipients. Bcc is
+	//     always empty.
+	//   * Subject has its encoded words decoded, unless their charset isn't
+	//     supported (i.e. other than UTF-8, ISO-8859-1 and US-ASCII). The
+	//     names of the addresses in such charsets are dropped.
+	//   * Body and HTMLBody are its first text/plain and text/html parts, which
+	//     aren't attachments. They are assumed to be UTF-8.
+	//   * Attachments are its other parts, including the inline ones (with a
+	//     ContentID).
+	//   * Headers are all of its headers.
+	Message
+
+	// Recipient is the address to which the message was delivered, which may
+	// not be in To or Cc (e.g. for Bcc recipients).
+	Recipient string
+
+	// Date is the date of the message, or zero if it has none.
+	Date time.Time
+}
+
+// ParseInboundMessage parses the MIME message read from r, as delivered by App
+// Engine. The Recipient of the message isn't set.
+func ParseInboundMessage(r io.Reader) (*InboundMessage, error) {
+	m, err := net_mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("mail: invalid message: %s", err)
+	}
+
+	msg := &InboundMessage{Message: Message{Headers: m.Header}}
+	if msg.Sender, err = parseAddress(m.Header, "From"); err != nil {
+		return nil, err
+	}
+	if msg.ReplyTo, err = parseAddress(m.Header, "Reply-To"); err != nil {
+		return nil, err
+	}
+	if msg.To, err = parseAddressList(m.Header, "To"); err != nil {
+		return nil, err
+	}
+	if msg.Cc, err = parseAddressList(m.Header, "Cc"); err != nil {
+		return nil, err
+	}
+	msg.Subject = decodeHeader(m.Header.Get("Subject"))
+	if date, err := m.Header.Date(); err == nil {
+		msg.Date = date
+	}
+
+	if err := msg.readPart(textproto.MIMEHeader(m.Header), m.Body); err != nil {
+		return nil, fmt.Errorf("mail: invalid message body: %s", err)
+	}
+	return msg, nil
+}
+
+// readPart reads the MIME entity with header h and body r into msg.
+func (msg *InboundMessage) readPart(h textproto.MIMEHeader, r io.Reader) error {
+	mediaType, params := "text/plain", map[string]string(nil)
+	if ct := h.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return err
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if params["boundary"] == "" {
+			return fmt.Errorf("missing boundary of %s part", mediaType)
+		}
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := msg.readPart(p.Header, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if disposition != "attachment" && name == "" {
+		switch {
+		case mediaType == "text/plain" && msg.Body == "":
+			msg.Body = string(data)
+			return nil
+		case mediaType == "text/html" && msg.HTMLBody == "":
+			msg.HTMLBody = string(data)
+			return nil
+		}
+	}
+
+	msg.Attachments = append(msg.Attachments, Attachment{
+		Name:      name,
+		Data:      data,
+		ContentID: strings.Trim(h.Get("Content-ID"), "<>"),
+	})
+	return nil
+}
+
+// parseAddress returns the address in the header k of h, or "" if there's
+// none.
+func parseAddress(h net_mail.Header, k string) (string, error) {
+	if h.Get(k) == "" {
+		return "", nil
+	}
+	adrs, err := parseAddressList(h, k)
+	if err != nil {
+		return "", err
+	}
+	if len(adrs) != 1 {
+		return "", fmt.Errorf("mail: invalid %s: expected one address, got %d", k, len(adrs))
+	}
+	return adrs[0], nil
+}
+
+// decodeHeader returns the value v of a header with its encoded words decoded.
+// If v uses a charset which isn't supported, it's returned as is.
+func decodeHeader(v string) string {
+	if dv, err := (&mime.WordDecoder{}).DecodeHeader(v); err == nil {
+		return dv
+	}
+	return v
+}
+
+// undecodedCharset is a mime.WordDecoder.CharsetReader which leaves the text
+// of any charset undecoded.
+func undecodedCharset(charset string, input io.Reader) (io.Reader, error) {
+	return input, nil
+}
+
+// parseAddressList returns the addresses in the header k of h. If the names of
+// the addresses use a charset which isn't supported, only the addresses are
+// returned.
+func parseAddressList(h net_mail.Header, k string) ([]string, error) {
+	if h.Get(k) == "" {
+		return nil, nil
+	}
+	adrs, err := h.AddressList(k)
+	dropNames := false
+	if err != nil {
+		p := &net_mail.AddressParser{WordDecoder: &mime.WordDecoder{CharsetReader: undecodedCharset}}
+		var perr error
+		if adrs, perr = p.ParseList(h.Get(k)); perr != nil {
+			return nil, fmt.Errorf("mail: invalid %s: %s", k, err)
+		}
+		dropNames = true
+	}
+	ret := make([]string, len(adrs))
+	for i, adr := range adrs {
+		if adr.Name == "" || dropNames {
+			ret[i] = adr.Address
+		} else {
+			ret[i] = adr.String()
+		}
+	}
+	return ret, nil
+}
+
+// BounceNotification is the notification App Engine sends to the application
+// when a message it sent bounced.
+//
+// Only the Sender, To, Cc, Bcc, Subject and Body fields of its messages are
+// set.
+type BounceNotification struct {
+	// Original is the message which bounced.
+	Original Message
+	// Notification is the message notifying the bounce.
+	Notification Message
+}
+
+// ParseBounceNotification parses the bounce notification posted by App Engine
+// in r.
+func ParseBounceNotification(r *http.Request) (*BounceNotification, error) {
+	if err := r.ParseMultipartForm(maxBounceMemory); err != nil {
+		return nil, fmt.Errorf("mail: invalid bounce notification: %s", err)
+	}
+	return &BounceNotification{
+		Original:     bounceMessage(r, "original-"),
+		Notification: bounceMessage(r, "notification-"),
+	}, nil
+}
+
+func bounceMessage(r *http.Request, prefix string) Message {
+	return Message{
+		Sender:  r.FormValue(prefix + "from"),
+		To:      splitAddresses(r.FormValue(prefix + "to")),
+		Cc:      splitAddresses(r.FormValue(prefix + "cc")),
+		Bcc:     splitAddresses(r.FormValue(prefix + "bcc")),
+		Subject: r.FormValue(prefix + "subject"),
+		Body:    r.FormValue(prefix + "text"),
+	}
+}
+
+// splitAddresses splits a comma-separated list of addresses.
+func splitAddresses(s string) []string {
+	var ret []string
+	for _, adr := range strings.Split(s, ",") {
+		if adr = strings.TrimSpace(adr); adr != "" {
+			ret = append(ret, adr)
+		}
+	}
+	return ret
+}
+
+// NewInboundRequest returns the request with which App Engine delivers the
+// MIME message data to recipient. It is designed to be used by testing
+// implementations.
+func NewInboundRequest(recipient string, data []byte) (*http.Request, error) {
+	u := &url.URL{Path: InboundPath + recipient}
+	r, err := http.NewRequest("POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "message/rfc822")
+	return r, nil
+}
+
+// NewBounceRequest returns the request with which App Engine posts n. It is
+// designed to be used by testing implementations.
+func NewBounceRequest(n *BounceNotification) (*http.Request, error) {
+	form := map[string]string{}
+	for prefix, m := range map[string]*Message{"original-": &n.Original, "notification-": &n.Notification} {
+		for k, v := range map[string]string{
+			"from":    m.Sender,
+			"to":      strings.Join(m.To, ", "),
+			"cc":      strings.Join(m.Cc, ", "),
+			"bcc":     strings.Join(m.Bcc, ", "),
+			"subject": m.Subject,
+			"text":    m.Body,
+		} {
+			if v != "" {
+				form[prefix+k] = v
+			}
+		}
+	}
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for _, k := range keys {
+		if err := mw.WriteField(k, form[k]); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	r, err := http.NewRequest("POST", BouncePath, buf)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r, nil
+}
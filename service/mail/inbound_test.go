@@ -0,0 +1,208 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"golang.org/x/net/context"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const inboundMessage = "From: =?utf-8?q?Valued_Customer?= <customer@example.com>\r\n" +
+	"To: support@app.example.com, Sales <sales@app.example.com>\r\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9?=\r\n" +
+	"Date: Tue, 02 Feb 2016 04:05:06 +0000\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=mixed\r\n" +
+	"\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: multipart/alternative; boundary=alt\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=C3=A9\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Caf\xc3\xa9 <img src=\"cid:logo\"></p>\r\n" +
+	"--alt--\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: inline; filename=logo.png\r\n" +
+	"Content-ID: <logo>\r\n" +
+	"\r\n" +
+	"iVBORw==\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: text/plain; name=notes.txt\r\n" +
+	"\r\n" +
+	"Some notes\r\n" +
+	"--mixed--\r\n"
+
+func TestInbound(t *testing.T) {
+	t.Parallel()
+
+	Convey("ParseInboundMessage", t, func() {
+		Convey("parses messages", func() {
+			msg, err := ParseInboundMessage(strings.NewReader(inboundMessage))
+			So(err, ShouldBeNil)
+			So(msg.Sender, ShouldEqual, `"Valued Customer" <customer@example.com>`)
+			So(msg.To, ShouldResemble, []string{"support@app.example.com", `"Sales" <sales@app.example.com>`})
+			So(msg.Cc, ShouldBeNil)
+			So(msg.Subject, ShouldEqual, "Café")
+			So(msg.Date.Equal(time.Date(2016, 2, 2, 4, 5, 6, 0, time.UTC)), ShouldBeTrue)
+			So(msg.Body, ShouldEqual, "Café")
+			So(msg.HTMLBody, ShouldEqual, `<p>Café <img src="cid:logo"></p>`)
+			So(msg.Attachments, ShouldResemble, []Attachment{
+				{Name: "logo.png", Data: []byte{0x89, 'P', 'N', 'G'}, ContentID: "logo"},
+				{Name: "notes.txt", Data: []byte("Some notes")},
+			})
+			So(msg.Headers.Get("Mime-Version"), ShouldEqual, "1.0")
+		})
+
+		Convey("parses single part messages", func() {
+			msg, err := ParseInboundMessage(strings.NewReader(
+				"From: customer@example.com\r\n" +
+					"Content-Transfer-Encoding: quoted-printable\r\n" +
+					"\r\n" +
+					"a=3Db"))
+			So(err, ShouldBeNil)
+			So(msg.Sender, ShouldEqual, "customer@example.com")
+			So(msg.Body, ShouldEqual, "a=b")
+			So(msg.Attachments, ShouldBeNil)
+		})
+
+		Convey("keeps the words in unsupported charsets", func() {
+			msg, err := ParseInboundMessage(strings.NewReader(
+				"From: =?ISO-2022-JP?B?GyRCJUYlOSVIGyhC?= <customer@example.com>\r\n" +
+					"To: =?utf-8?q?Support?= <support@app.example.com>\r\n" +
+					"Subject: =?windows-1252?Q?Caf=E9?=\r\n" +
+					"\r\n" +
+					"body"))
+			So(err, ShouldBeNil)
+			So(msg.Sender, ShouldEqual, "customer@example.com")
+			So(msg.To, ShouldResemble, []string{`"Support" <support@app.example.com>`})
+			So(msg.Subject, ShouldEqual, "=?windows-1252?Q?Caf=E9?=")
+			So(msg.Body, ShouldEqual, "body")
+		})
+
+		Convey("rejects invalid messages", func() {
+			_, err := ParseInboundMessage(strings.NewReader("From: not an address\r\n\r\nbody"))
+			So(err, ShouldErrLike, "mail: invalid From")
+
+			_, err = ParseInboundMessage(strings.NewReader("Content-Type: multipart/mixed\r\n\r\nbody"))
+			So(err, ShouldErrLike, "mail: invalid message body")
+		})
+	})
+
+	Convey("Router", t, func() {
+		c := context.Background()
+		rt := &Router{}
+		routed := map[string]string{}
+		handle := func(name string) InboundHandler {
+			return func(c context.Context, msg *InboundMessage) error {
+				routed[msg.Recipient] = name
+				return nil
+			}
+		}
+		rt.Handle("Support@*", handle("support"))
+		rt.Handle("*@bugs.example.com", handle("bugs"))
+		rt.Default = handle("default")
+
+		Convey("routes by recipient", func() {
+			for _, rcpt := range []string{"support@example.com", "SUPPORT@bugs.example.com", "crash@bugs.example.com", "sales@example.com"} {
+				So(rt.Deliver(c, &InboundMessage{Recipient: rcpt}), ShouldBeNil)
+			}
+			So(routed, ShouldResemble, map[string]string{
+				"support@example.com":      "support",
+				"SUPPORT@bugs.example.com": "support",
+				"crash@bugs.example.com":   "bugs",
+				"sales@example.com":        "default",
+			})
+
+			rt.Default = nil
+			So(rt.Deliver(c, &InboundMessage{Recipient: "sales@example.com"}), ShouldEqual, ErrNoRoute)
+		})
+
+		Convey("panics on invalid patterns", func() {
+			So(func() { rt.Handle("[", handle("bad")) }, ShouldPanicLike, `mail: invalid pattern "["`)
+		})
+
+		Convey("serves requests", func() {
+			serve := func(r *http.Request) int {
+				rec := httptest.NewRecorder()
+				rt.ServeRequest(c, rec, r)
+				return rec.Code
+			}
+
+			Convey("of inbound messages", func() {
+				r, err := NewInboundRequest("support@app.example.com", []byte(inboundMessage))
+				So(err, ShouldBeNil)
+				So(serve(r), ShouldEqual, http.StatusOK)
+				So(routed["support@app.example.com"], ShouldEqual, "support")
+
+				r, err = NewInboundRequest("support@app.example.com", []byte("From: not an address\r\n\r\n"))
+				So(err, ShouldBeNil)
+				So(serve(r), ShouldEqual, http.StatusBadRequest)
+
+				rt.Handle("crash@*", func(c context.Context, msg *InboundMessage) error {
+					return errors.New("boom")
+				})
+				r, err = NewInboundRequest("crash@app.example.com", []byte(inboundMessage))
+				So(err, ShouldBeNil)
+				So(serve(r), ShouldEqual, http.StatusInternalServerError)
+
+				rt.Default = nil
+				r, err = NewInboundRequest("sales@app.example.com", []byte(inboundMessage))
+				So(err, ShouldBeNil)
+				So(serve(r), ShouldEqual, http.StatusNotFound)
+
+				r, err = http.NewRequest("GET", InboundPath+"support@app.example.com", nil)
+				So(err, ShouldBeNil)
+				So(serve(r), ShouldEqual, http.StatusMethodNotAllowed)
+			})
+
+			Convey("of bounce notifications", func() {
+				n := &BounceNotification{
+					Original: Message{
+						Sender:  "admin@example.com",
+						To:      []string{"nobody@example.com", "Someone <someone@example.com>"},
+						Subject: "Hello",
+						Body:    "Hello",
+					},
+					Notification: Message{
+						Sender: "mailer-daemon@example.com",
+						To:     []string{"admin@example.com"},
+						Body:   "Delivery failed",
+					},
+				}
+				r, err := NewBounceRequest(n)
+				So(err, ShouldBeNil)
+				So(serve(r), ShouldEqual, http.StatusNotFound)
+
+				var got *BounceNotification
+				rt.Bounce = func(c context.Context, n *BounceNotification) error {
+					got = n
+					return nil
+				}
+				r, err = NewBounceRequest(n)
+				So(err, ShouldBeNil)
+				So(serve(r), ShouldEqual, http.StatusOK)
+				So(got, ShouldResemble, n)
+			})
+		})
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// ErrNoRoute is returned by Router.Deliver when no handler accepts the
+// recipient of a message.
+var ErrNoRoute = errors.New("mail: no handler for the recipient")
+
+// InboundHandler handles an inbound message.
+type InboundHandler func(c context.Context, msg *InboundMessage) error
+
+// BounceHandler handles a bounce notification.
+type BounceHandler func(c context.Context, n *BounceNotification) error
+
+// Router routes the inbound messages of the application to handlers, by
+// recipient address.
+//
+// Its ServeRequest method serves the requests with which App Engine delivers
+// them, so that it's typically installed with the middleware of the
+// implementation, e.g.:
+//   http.Handle(mail.InboundPath, cloud.Middleware(c, router.ServeRequest))
+//   http.Handle(mail.BouncePath, cloud.Middleware(c, router.ServeRequest))
+type Router struct {
+	routes []route
+
+	// Default handles the messages which no route accepts. If nil, they aren't
+	// delivered (see ErrNoRoute).
+	Default InboundHandler
+
+	// Bounce handles the bounce notifications. If nil, they're rejected.
+	Bounce BounceHandler
+}
+
+type route struct {
+	pattern string
+	h       InboundHandler
+}
+
+// Handle routes the messages to the recipients matching pattern to h. Routes
+// are tried in the order in which they were added.
+//
+// The pattern is matched against the lowercased address of the recipient with
+// path.Match, e.g. "support@*" or "*@bugs.example.com". It panics if pattern
+// is malformed.
+func (rt *Router) Handle(pattern string, h InboundHandler) {
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic(fmt.Errorf("mail: invalid pattern %q: %s", pattern, err))
+	}
+	rt.routes = append(rt.routes, route{pattern, h})
+}
+
+// Deliver delivers msg to the handler of its Recipient, or returns ErrNoRoute
+// if there's none.
+func (rt *Router) Deliver(c context.Context, msg *InboundMessage) error {
+	recipient := strings.ToLower(msg.Recipient)
+	for _, r := range rt.routes {
+		if ok, _ := path.Match(r.pattern, recipient); ok {
+			return r.h(c, msg)
+		}
+	}
+	if rt.Default != nil {
+		return rt.Default(c, msg)
+	}
+	return ErrNoRoute
+}
+
+// ServeRequest serves a request made by App Engine to InboundPath or
+// BouncePath. It responds with:
+//   * 200 if the message was handled.
+//   * 400 if the message is malformed.
+//   * 404 if there's no handler for it.
+//   * 500 if its handler failed.
+func (rt *Router) ServeRequest(c context.Context, rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(rw, "mail: expected a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	switch p := r.URL.Path; {
+	case p == BouncePath:
+		if rt.Bounce == nil {
+			http.Error(rw, "mail: bounce notifications aren't handled", http.StatusNotFound)
+			return
+		}
+		n, perr := ParseBounceNotification(r)
+		if perr != nil {
+			http.Error(rw, perr.Error(), http.StatusBadRequest)
+			return
+		}
+		err = rt.Bounce(c, n)
+
+	case strings.HasPrefix(p, InboundPath):
+		msg, perr := ParseInboundMessage(r.Body)
+		if perr != nil {
+			http.Error(rw, perr.Error(), http.StatusBadRequest)
+			return
+		}
+		msg.Recipient = strings.TrimPrefix(p, InboundPath)
+		err = rt.Deliver(c, msg)
+
+	default:
+		http.NotFound(rw, r)
+		return
+	}
+
+	switch err {
+	case nil:
+		rw.WriteHeader(http.StatusOK)
+	case ErrNoRoute:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
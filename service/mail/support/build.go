@@ -0,0 +1,179 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package support
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/luci/gae/service/mail"
+)
+
+// BuildMessage returns the MIME message of msg, dated date, whose attachments
+// have the given MIME types (see CheckMessage). The Bcc recipients aren't part
+// of it.
+//
+// The body is a text/plain or text/html part, or a multipart/alternative part
+// if msg has both. If msg has attachments, they follow the body in a
+// multipart/mixed message. The attachments with a ContentID are inline, so
+// that the HTML body may refer to them with "cid:" URLs.
+func BuildMessage(msg *mail.Message, mimeTypes []string, date time.Time) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", msg.Sender)
+	if msg.ReplyTo != "" {
+		header.Set("Reply-To", msg.ReplyTo)
+	}
+	if len(msg.To) > 0 {
+		header.Set("To", strings.Join(msg.To, ", "))
+	}
+	if len(msg.Cc) > 0 {
+		header.Set("Cc", strings.Join(msg.Cc, ", "))
+	}
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header.Set("Date", date.Format(time.RFC1123Z))
+	header.Set("MIME-Version", "1.0")
+	for k, vals := range msg.Headers {
+		header[k] = vals
+	}
+
+	toplevel := func(h textproto.MIMEHeader) (io.Writer, error) {
+		writeHeader(buf, h)
+		return buf, nil
+	}
+
+	if len(msg.Attachments) == 0 {
+		if err := writeBody(header, msg, toplevel); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(buf)
+	header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	writeHeader(buf, header)
+
+	if err := writeBody(textproto.MIMEHeader{}, msg, mw.CreatePart); err != nil {
+		return nil, err
+	}
+
+	for i, att := range msg.Attachments {
+		ah := textproto.MIMEHeader{}
+		ah.Set("Content-Type", mime.FormatMediaType(mimeTypes[i], map[string]string{"name": att.Name}))
+		ah.Set("Content-Transfer-Encoding", "base64")
+		disposition := "attachment"
+		if att.ContentID != "" {
+			disposition = "inline"
+			ah.Set("Content-ID", "<"+strings.Trim(att.ContentID, "<>")+">")
+		}
+		ah.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": att.Name}))
+
+		pw, err := mw.CreatePart(ah)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64(pw, att.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBody writes the body of msg as a MIME entity with header, which it
+// creates with create.
+func writeBody(header textproto.MIMEHeader, msg *mail.Message, create func(textproto.MIMEHeader) (io.Writer, error)) error {
+	if msg.Body == "" || msg.HTMLBody == "" {
+		text, contentType := msg.Body, "text/plain; charset=utf-8"
+		if text == "" {
+			text, contentType = msg.HTMLBody, "text/html; charset=utf-8"
+		}
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, err := create(header)
+		if err != nil {
+			return err
+		}
+		return writeQuotedPrintable(w, text)
+	}
+
+	boundary := multipart.NewWriter(nil).Boundary()
+	header.Set("Content-Type", "multipart/alternative; boundary="+boundary)
+	w, err := create(header)
+	if err != nil {
+		return err
+	}
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+	for _, part := range []struct{ text, contentType string }{
+		{msg.Body, "text/plain; charset=utf-8"},
+		{msg.HTMLBody, "text/html; charset=utf-8"},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		if err := writeQuotedPrintable(pw, part.text); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// writeHeader writes header, sorted by key, and the blank line ending it.
+func writeHeader(w io.Writer, header textproto.MIMEHeader) {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+	fmt.Fprint(w, "\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qw, text); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// writeBase64 writes data in base64, in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) error {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 0 {
+		n := 76
+		if n > len(enc) {
+			n = len(enc)
+		}
+		if _, err := io.WriteString(w, enc[:n]+"\r\n"); err != nil {
+			return err
+		}
+		enc = enc[n:]
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package support provides Mail-related support functionality. It is designed
+// to be used by implementing packages.
+package support
+
+import (
+	"fmt"
+	net_mail "net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+
+	"github.com/luci/gae/service/mail"
+)
+
+// ParseEmails returns an error if any of emails isn't a valid address.
+func ParseEmails(emails ...string) error {
+	for _, e := range emails {
+		if _, err := net_mail.ParseAddress(e); err != nil {
+			return fmt.Errorf("invalid email (%q): %s", e, err)
+		}
+	}
+	return nil
+}
+
+// AllowedHeader returns true if the header k may be set in Message.Headers.
+func AllowedHeader(k string) bool {
+	return okHeaders.Has(textproto.CanonicalMIMEHeaderKey(k))
+}
+
+// AttachmentMIMEType returns the MIME type of an attachment, from the extension
+// of its name, or an error if the extension isn't allowed.
+func AttachmentMIMEType(name string) (string, error) {
+	ext := strings.TrimLeft(strings.ToLower(filepath.Ext(name)), ".")
+	if badExtensions.Has(ext) {
+		return "", fmt.Errorf("illegal attachment extension for %q", name)
+	}
+	if mimetype := extensionMapping[ext]; mimetype != "" {
+		return mimetype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// CheckMessage validates msg the way the App Engine mail service does, for the
+// implementations which don't rely on it:
+//   * The Sender must be one of senders, and the ReplyTo (if any) must be
+//     valid.
+//   * There must be at least one valid recipient, and all of the recipients
+//     must be valid.
+//   * There must be a Body or an HTMLBody.
+//   * The attachments must have an allowed extension (see AttachmentMIMEType),
+//     and their names and Content-IDs must be on a single line.
+//   * The Headers must be allowed (see AllowedHeader), and their values must
+//     be on a single line.
+//
+// The keys of msg.Headers are canonicalized, and the MIME types of the
+// attachments are returned.
+func CheckMessage(msg *mail.Message, senders ...string) (mimeTypes []string, err error) {
+	sender, err := net_mail.ParseAddress(msg.Sender)
+	if err != nil {
+		return nil, fmt.Errorf("unparsable Sender address: %s: %s", msg.Sender, err)
+	}
+	senderOK := false
+	for _, s := range senders {
+		if sender.Address == s {
+			senderOK = true
+			break
+		}
+	}
+	if !senderOK {
+		return nil, fmt.Errorf("invalid Sender: %s", msg.Sender)
+	}
+
+	if msg.ReplyTo != "" {
+		if _, err := net_mail.ParseAddress(msg.ReplyTo); err != nil {
+			return nil, fmt.Errorf("unparsable ReplyTo address: %s: %s", msg.ReplyTo, err)
+		}
+	}
+
+	if len(msg.To) == 0 && len(msg.Cc) == 0 && len(msg.Bcc) == 0 {
+		return nil, fmt.Errorf("one of To, Cc or Bcc must be non-empty")
+	}
+
+	if err := ParseEmails(msg.To...); err != nil {
+		return nil, err
+	}
+	if err := ParseEmails(msg.Cc...); err != nil {
+		return nil, err
+	}
+	if err := ParseEmails(msg.Bcc...); err != nil {
+		return nil, err
+	}
+
+	if len(msg.Body) == 0 && len(msg.HTMLBody) == 0 {
+		return nil, fmt.Errorf("one of Body or HTMLBody must be non-empty")
+	}
+
+	if len(msg.Attachments) > 0 {
+		mimeTypes = make([]string, len(msg.Attachments))
+		for i, att := range msg.Attachments {
+			if strings.ContainsAny(att.Name, "\r\n") {
+				return nil, fmt.Errorf("invalid attachment name: %q", att.Name)
+			}
+			if strings.ContainsAny(att.ContentID, "\r\n") {
+				return nil, fmt.Errorf("invalid Content-ID of attachment %s: %q", att.Name, att.ContentID)
+			}
+			if mimeTypes[i], err = AttachmentMIMEType(att.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	fixKeys := map[string]string{}
+	for k := range msg.Headers {
+		canonK := textproto.CanonicalMIMEHeaderKey(k)
+		if !okHeaders.Has(canonK) {
+			return nil, fmt.Errorf("disallowed header: %s", k)
+		}
+		for _, v := range msg.Headers[k] {
+			if strings.ContainsAny(v, "\r\n") {
+				return nil, fmt.Errorf("invalid value of header %s: %q", k, v)
+			}
+		}
+		if canonK != k {
+			fixKeys[k] = canonK
+		}
+	}
+	for k, canonK := range fixKeys {
+		vals := msg.Headers[k]
+		delete(msg.Headers, k)
+		msg.Headers[canonK] = vals
+	}
+
+	return mimeTypes, nil
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed under the Apache License, Version 2.0
 // that can be found in the LICENSE file.
 
-package memory
+package support
 
 import (
 	"github.com/luci/luci-go/common/data/stringset"
@@ -0,0 +1,38 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package templates renders mail.Message from text/template and html/template
+// pairs.
+//
+// A Set holds the templates of the messages of an application. Layouts added
+// to it define templates shared by all of its messages, and images added to
+// it may be inlined in their HTML bodies with the "image" function, which
+// returns the "cid:" URL of an image:
+//
+//	s := templates.New(nil)
+//	err := s.AddLayout(
+//		`{{define "layout"}}{{template "content" .}}
+//	--
+//	The Example team{{end}}`,
+//		`{{define "layout"}}<img src="{{image "logo.png"}}">{{template "content" .}}{{end}}`)
+//	err = s.AddImage("logo.png", logo)
+//	err = s.Add("welcome", templates.Template{
+//		Subject: `Welcome, {{.Name}}`,
+//		Text:    `{{define "content"}}Hello {{.Name}}!{{end}}{{template "layout" .}}`,
+//		HTML:    `{{define "content"}}<p>Hello {{.Name}}!</p>{{end}}{{template "layout" .}}`,
+//	})
+//
+//	msg, err := s.Render("welcome", user)
+//	msg.Sender, msg.To = "noreply@example.com", []string{user.Email}
+//	err = mail.Send(c, msg)
+//
+// The images that the "image" function resolves while rendering the HTML body
+// of a message are attached to it, with their names as Content-IDs. The
+// attachments and the headers of the messages follow the rules of App Engine
+// (see service/mail/support), and Validate checks a whole message ahead of
+// Send.
+//
+// CheckGolden compares the messages sent in a test (see
+// mail.Testable.SentMessages) with a golden file.
+package templates
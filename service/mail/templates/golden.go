@@ -0,0 +1,113 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package templates
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/luci/gae/service/mail"
+
+	"golang.org/x/net/context"
+)
+
+// FormatMessages returns a readable representation of msgs, which only depends
+// on their content, for golden files. The attachments are represented by their
+// MIME type, Content-ID, size and SHA-256 hash.
+func FormatMessages(msgs []*mail.TestMessage) []byte {
+	buf := &bytes.Buffer{}
+	for i, msg := range msgs {
+		fmt.Fprintf(buf, "=== Message %d\n", i+1)
+		fmt.Fprintf(buf, "Sender: %s\n", msg.Sender)
+		if msg.ReplyTo != "" {
+			fmt.Fprintf(buf, "ReplyTo: %s\n", msg.ReplyTo)
+		}
+		for _, rcpts := range []struct {
+			k     string
+			addrs []string
+		}{{"To", msg.To}, {"Cc", msg.Cc}, {"Bcc", msg.Bcc}} {
+			if len(rcpts.addrs) > 0 {
+				fmt.Fprintf(buf, "%s: %s\n", rcpts.k, strings.Join(rcpts.addrs, ", "))
+			}
+		}
+		fmt.Fprintf(buf, "Subject: %s\n", msg.Subject)
+
+		keys := make([]string, 0, len(msg.Headers))
+		for k := range msg.Headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range msg.Headers[k] {
+				fmt.Fprintf(buf, "Header %s: %s\n", k, v)
+			}
+		}
+
+		for _, body := range []struct{ k, text string }{{"Body", msg.Body}, {"HTMLBody", msg.HTMLBody}} {
+			if body.text != "" {
+				fmt.Fprintf(buf, "--- %s\n%s", body.k, body.text)
+				if !strings.HasSuffix(body.text, "\n") {
+					buf.WriteByte('\n')
+				}
+			}
+		}
+
+		for j, att := range msg.Attachments {
+			mimeType := ""
+			if j < len(msg.MIMETypes) {
+				mimeType = msg.MIMETypes[j]
+			}
+			fmt.Fprintf(buf, "--- Attachment %s\n", att.Name)
+			fmt.Fprintf(buf, "MIME type: %s\n", mimeType)
+			if att.ContentID != "" {
+				fmt.Fprintf(buf, "Content-ID: %s\n", att.ContentID)
+			}
+			fmt.Fprintf(buf, "Size: %d\n", len(att.Data))
+			fmt.Fprintf(buf, "SHA-256: %x\n", sha256.Sum256(att.Data))
+		}
+	}
+	return buf.Bytes()
+}
+
+// CheckGolden compares the messages sent with the mail service of c (see
+// mail.Testable.SentMessages), formatted with FormatMessages, with the golden
+// file at path. If update is true, it writes them to the golden file instead.
+func CheckGolden(c context.Context, path string, update bool) error {
+	t := mail.GetTestable(c)
+	if t == nil {
+		return fmt.Errorf("templates: the mail service isn't testable")
+	}
+	got := FormatMessages(t.SentMessages())
+	if update {
+		return ioutil.WriteFile(path, got, 0644)
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("templates: reading the golden file: %s", err)
+	}
+	if bytes.Equal(got, want) {
+		return nil
+	}
+
+	gotLines, wantLines := strings.Split(string(got), "\n"), strings.Split(string(want), "\n")
+	for i := 0; ; i++ {
+		g, w := "<EOF>", "<EOF>"
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if g != w {
+			return fmt.Errorf("templates: the sent messages differ from %s at line %d:\n  got:  %q\n  want: %q",
+				path, i+1, g, w)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	net_mail "net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/luci/gae/service/mail"
+	"github.com/luci/gae/service/mail/support"
+)
+
+// Template is the source of the template of a message.
+type Template struct {
+	// Subject is the text/template of the subject. Its whitespace is collapsed,
+	// so that the subject is on a single line.
+	Subject string
+
+	// Text and HTML are the text/template of Body and the html/template of
+	// HTMLBody. At least one of them must be set.
+	Text string
+	HTML string
+
+	// Headers are the headers of the message. They must be allowed (see
+	// support.AllowedHeader).
+	Headers net_mail.Header
+}
+
+// Set is a set of message templates, which share layouts, functions and
+// images.
+//
+// Its templates may be rendered concurrently, once they were all added.
+type Set struct {
+	funcs map[string]interface{}
+
+	text *texttemplate.Template
+	html *htmltemplate.Template
+
+	images   map[string]mail.Attachment
+	messages map[string]*message
+}
+
+// message is a parsed Template.
+type message struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	// html is never executed itself: Render executes a clone of it, which
+	// records the images it uses.
+	html    *htmltemplate.Template
+	headers net_mail.Header
+}
+
+// validImageName matches the RFC 2045 tokens, which may be used as Content-IDs.
+var validImageName = regexp.MustCompile("^[!#$%&'*+\\-.0-9A-Z^_`a-z{|}~]+$")
+
+// New returns an empty Set, whose templates may call funcs in addition to the
+// "image" function.
+func New(funcs map[string]interface{}) *Set {
+	s := &Set{
+		funcs:    funcs,
+		images:   map[string]mail.Attachment{},
+		messages: map[string]*message{},
+	}
+	s.text = texttemplate.New("").Funcs(funcs)
+	s.html = htmltemplate.New("").Funcs(htmltemplate.FuncMap{"image": s.image}).Funcs(funcs)
+	return s
+}
+
+// image returns the URL of the image name, for the HTML templates.
+func (s *Set) image(name string) (htmltemplate.URL, error) {
+	if _, ok := s.images[name]; !ok {
+		return "", fmt.Errorf("templates: unknown image %q", name)
+	}
+	return htmltemplate.URL("cid:" + name), nil
+}
+
+// recordImages returns an "image" function which adds the names of the images
+// it resolves to used.
+func (s *Set) recordImages(used map[string]struct{}) func(string) (htmltemplate.URL, error) {
+	return func(name string) (htmltemplate.URL, error) {
+		u, err := s.image(name)
+		if err == nil {
+			used[name] = struct{}{}
+		}
+		return u, err
+	}
+}
+
+// AddLayout adds the templates defined by the text/template text and the
+// html/template html to all of the messages. They are only visible to the
+// messages added after them.
+func (s *Set) AddLayout(text, html string) error {
+	if _, err := s.text.Parse(text); err != nil {
+		return fmt.Errorf("templates: invalid text layout: %s", err)
+	}
+	if _, err := s.html.Parse(html); err != nil {
+		return fmt.Errorf("templates: invalid HTML layout: %s", err)
+	}
+	return nil
+}
+
+// AddImage adds an image, which the HTML templates may inline with
+// {{image name}}. Its name is also its Content-ID, so it must be an RFC 2045
+// token, and it must have an allowed extension (see
+// support.AttachmentMIMEType).
+func (s *Set) AddImage(name string, data []byte) error {
+	if !validImageName.MatchString(name) {
+		return fmt.Errorf("templates: invalid image name %q", name)
+	}
+	if _, err := support.AttachmentMIMEType(name); err != nil {
+		return fmt.Errorf("templates: %s", err)
+	}
+	s.images[name] = mail.Attachment{Name: name, Data: data, ContentID: name}
+	return nil
+}
+
+// Add adds the template of the message name.
+func (s *Set) Add(name string, t Template) error {
+	if _, ok := s.messages[name]; ok {
+		return fmt.Errorf("templates: duplicate message %q", name)
+	}
+	if t.Text == "" && t.HTML == "" {
+		return fmt.Errorf("templates: message %q has no Text or HTML", name)
+	}
+	for k := range t.Headers {
+		if !support.AllowedHeader(k) {
+			return fmt.Errorf("templates: message %q: disallowed header: %s", name, k)
+		}
+	}
+
+	m := &message{headers: t.Headers}
+	var err error
+	if m.subject, err = texttemplate.New(name).Funcs(s.funcs).Parse(t.Subject); err != nil {
+		return fmt.Errorf("templates: message %q: invalid Subject: %s", name, err)
+	}
+	if t.Text != "" {
+		if m.text, err = s.text.Clone(); err == nil {
+			m.text, err = m.text.New(name).Parse(t.Text)
+		}
+		if err != nil {
+			return fmt.Errorf("templates: message %q: invalid Text: %s", name, err)
+		}
+	}
+	if t.HTML != "" {
+		if m.html, err = s.html.Clone(); err == nil {
+			m.html, err = m.html.New(name).Parse(t.HTML)
+		}
+		if err != nil {
+			return fmt.Errorf("templates: message %q: invalid HTML: %s", name, err)
+		}
+	}
+	s.messages[name] = m
+	return nil
+}
+
+// Render returns the message name rendered with data. Its Subject, Body,
+// HTMLBody, Attachments and Headers are set, and the caller is expected to
+// set its Sender and recipients.
+//
+// The images resolved by the "image" function while rendering HTMLBody are
+// attached to the message, in the order of their names.
+func (s *Set) Render(name string, data interface{}) (*mail.Message, error) {
+	m := s.messages[name]
+	if m == nil {
+		return nil, fmt.Errorf("templates: unknown message %q", name)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := m.subject.Execute(buf, data); err != nil {
+		return nil, fmt.Errorf("templates: message %q: rendering Subject: %s", name, err)
+	}
+	msg := &mail.Message{Subject: strings.Join(strings.Fields(buf.String()), " ")}
+
+	if m.text != nil {
+		buf.Reset()
+		if err := m.text.Execute(buf, data); err != nil {
+			return nil, fmt.Errorf("templates: message %q: rendering Text: %s", name, err)
+		}
+		msg.Body = buf.String()
+	}
+
+	if m.html != nil {
+		used := map[string]struct{}{}
+		html, err := m.html.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("templates: message %q: %s", name, err)
+		}
+		html.Funcs(htmltemplate.FuncMap{"image": s.recordImages(used)})
+
+		buf.Reset()
+		if err := html.Execute(buf, data); err != nil {
+			return nil, fmt.Errorf("templates: message %q: rendering HTML: %s", name, err)
+		}
+		msg.HTMLBody = buf.String()
+
+		names := make([]string, 0, len(used))
+		for name := range used {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			msg.Attachments = append(msg.Attachments, s.images[name])
+		}
+	}
+
+	if len(m.headers) > 0 {
+		msg.Headers = (&mail.Message{Headers: m.headers}).Copy().Headers
+	}
+	return msg, nil
+}
+
+// Validate returns an error if msg wouldn't be sent by App Engine, if sent by
+// one of senders (see support.CheckMessage). It doesn't modify msg.
+func Validate(msg *mail.Message, senders ...string) error {
+	_, err := support.CheckMessage(msg.Copy(), senders...)
+	return err
+}
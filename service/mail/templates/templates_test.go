@@ -0,0 +1,145 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package templates
+
+import (
+	"flag"
+	"io/ioutil"
+	net_mail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/luci/gae/impl/memory"
+	"github.com/luci/gae/service/mail"
+
+	"golang.org/x/net/context"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "update the golden files in testdata")
+
+const (
+	textLayout = `{{define "layout"}}{{template "content" .}}
+--
+The {{.Team}} team{{end}}`
+
+	htmlLayout = `{{define "layout"}}<img src="{{image "logo.png"}}">{{template "content" .}}{{end}}`
+)
+
+type welcome struct {
+	Name string
+	Team string
+}
+
+func TestTemplates(t *testing.T) {
+	t.Parallel()
+
+	Convey("A template Set", t, func() {
+		s := New(map[string]interface{}{"upper": strings.ToUpper})
+		So(s.AddLayout(textLayout, htmlLayout), ShouldBeNil)
+		So(s.AddImage("logo.png", []byte("\x89PNG")), ShouldBeNil)
+		So(s.AddImage("unused.gif", []byte("GIF89a")), ShouldBeNil)
+		So(s.Add("welcome", Template{
+			Subject: "Welcome,\n  {{.Name}}",
+			Text:    `{{define "content"}}Hello {{.Name}}!{{end}}{{template "layout" .}}`,
+			HTML:    `{{define "content"}}<p>Hello {{.Name}}!</p>{{end}}{{template "layout" .}}`,
+			Headers: net_mail.Header{"List-Id": {"welcome.example.com"}},
+		}), ShouldBeNil)
+		So(s.Add("shout", Template{
+			Subject: "{{upper .Name}}",
+			Text:    `{{define "content"}}{{upper .Name}}{{end}}{{template "layout" .}}`,
+		}), ShouldBeNil)
+
+		data := &welcome{Name: "<Bob>", Team: "Example"}
+
+		Convey("renders messages", func() {
+			msg, err := s.Render("welcome", data)
+			So(err, ShouldBeNil)
+			So(msg, ShouldResemble, &mail.Message{
+				Subject:  "Welcome, <Bob>",
+				Body:     "Hello <Bob>!\n--\nThe Example team",
+				HTMLBody: `<img src="cid:logo.png"><p>Hello &lt;Bob&gt;!</p>`,
+				Attachments: []mail.Attachment{
+					{Name: "logo.png", Data: []byte("\x89PNG"), ContentID: "logo.png"},
+				},
+				Headers: net_mail.Header{"List-Id": {"welcome.example.com"}},
+			})
+
+			msg, err = s.Render("shout", data)
+			So(err, ShouldBeNil)
+			So(msg.Subject, ShouldEqual, "<BOB>")
+			So(msg.Body, ShouldEqual, "<BOB>\n--\nThe Example team")
+			So(msg.HTMLBody, ShouldEqual, "")
+			So(msg.Attachments, ShouldBeNil)
+
+			// Only the images resolved by the templates are attached.
+			msg, err = s.Render("welcome", &welcome{Name: "cid:unused.gif"})
+			So(err, ShouldBeNil)
+			So(msg.HTMLBody, ShouldContainSubstring, "cid:unused.gif")
+			So(msg.Attachments, ShouldResemble, []mail.Attachment{
+				{Name: "logo.png", Data: []byte("\x89PNG"), ContentID: "logo.png"},
+			})
+
+			_, err = s.Render("unknown", data)
+			So(err, ShouldErrLike, `unknown message "unknown"`)
+		})
+
+		Convey("rejects invalid templates", func() {
+			So(s.Add("welcome", Template{Text: "again"}), ShouldErrLike, `duplicate message "welcome"`)
+			So(s.Add("empty", Template{Subject: "Nothing"}), ShouldErrLike, "has no Text or HTML")
+			So(s.Add("spam", Template{Text: "Buy", Headers: net_mail.Header{"X-Spam": {"yes"}}}),
+				ShouldErrLike, "disallowed header: X-Spam")
+			So(s.Add("broken", Template{Text: "{{"}), ShouldErrLike, "invalid Text")
+			So(s.AddImage("evil.exe", []byte("MZ")), ShouldErrLike, `illegal attachment extension for "evil.exe"`)
+			So(s.AddImage("my logo.png", []byte("\x89PNG")), ShouldErrLike, `invalid image name "my logo.png"`)
+			So(s.AddImage("<logo@example.com>.png", []byte("\x89PNG")), ShouldErrLike, "invalid image name")
+
+			So(s.Add("missing", Template{HTML: `<img src="{{image "missing.png"}}">`}), ShouldBeNil)
+			_, err := s.Render("missing", data)
+			So(err, ShouldErrLike, `unknown image "missing.png"`)
+		})
+
+		Convey("validates messages", func() {
+			msg, err := s.Render("welcome", data)
+			So(err, ShouldBeNil)
+			So(Validate(msg, "noreply@example.com"), ShouldErrLike, "unparsable Sender address")
+
+			msg.Sender = "noreply@example.com"
+			So(Validate(msg, "noreply@example.com"), ShouldErrLike, "one of To, Cc or Bcc must be non-empty")
+
+			msg.To = []string{"bob@example.com"}
+			So(Validate(msg, "noreply@example.com"), ShouldBeNil)
+			So(Validate(msg, "admin@example.com"), ShouldErrLike, "invalid Sender")
+		})
+
+		Convey("checks the sent messages against golden files", func() {
+			c := memory.Use(context.Background())
+			for _, name := range []string{"welcome", "shout"} {
+				msg, err := s.Render(name, data)
+				So(err, ShouldBeNil)
+				msg.Sender = "admin@example.com"
+				msg.To = []string{"Bob <bob@example.com>"}
+				So(mail.Send(c, msg), ShouldBeNil)
+			}
+			So(CheckGolden(c, filepath.Join("testdata", "welcome.golden"), *updateGolden), ShouldBeNil)
+
+			Convey("reporting the first difference", func() {
+				f, err := ioutil.TempFile("", "golden")
+				So(err, ShouldBeNil)
+				defer os.Remove(f.Name())
+				_, err = f.WriteString("=== Message 1\nSender: someone@example.com\n")
+				So(err, ShouldBeNil)
+				So(f.Close(), ShouldBeNil)
+
+				So(CheckGolden(c, f.Name(), false), ShouldErrLike,
+					"at line 2:\n  got:  \"Sender: admin@example.com\"\n  want: \"Sender: someone@example.com\"")
+			})
+		})
+	})
+}
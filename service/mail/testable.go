@@ -4,6 +4,10 @@
 
 package mail
 
+import (
+	"net/http"
+)
+
 // TestMessage is the message struct which will be returned from SentMessages.
 //
 // It augments the Message struct by also including the derived MIMEType for any
@@ -43,4 +47,18 @@ type Testable interface {
 
 	// Reset clears the SentMessages queue.
 	Reset()
+
+	// SetInboundHandler sets the handler serving the requests of DeliverInbound
+	// and DeliverBounce, e.g. the Router.ServeRequest method of the application
+	// wrapped in the middleware of the implementation.
+	SetInboundHandler(h http.Handler)
+
+	// DeliverInbound delivers msg to each of its To, Cc and Bcc recipients, the
+	// way App Engine does (see InboundPath). It returns an error if the handler
+	// doesn't respond with 200.
+	DeliverInbound(msg *Message) error
+
+	// DeliverBounce posts n to the inbound handler, the way App Engine does (see
+	// BouncePath). It returns an error if the handler doesn't respond with 200.
+	DeliverBounce(n *BounceNotification) error
 }
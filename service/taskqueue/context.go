@@ -13,6 +13,7 @@ type key int
 var (
 	taskQueueKey       key
 	taskQueueFilterKey key = 1
+	requestHeadersKey  key = 2
 )
 
 // RawFactory is the function signature for RawFactory methods compatible with
@@ -0,0 +1,303 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package deferred
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+
+	ds "github.com/luci/gae/service/datastore"
+	"github.com/luci/gae/service/info"
+	tq "github.com/luci/gae/service/taskqueue"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// Path is the default URL path of the deferred tasks. Handler must be
+	// installed there.
+	Path = "/_ah/queue/deferred"
+
+	// PayloadKind is the datastore kind of the entities holding the payloads
+	// which are too large to fit in a task.
+	PayloadKind = "DeferredPayload"
+)
+
+// MaxInlinePayload is the size (in bytes) of the largest encoded call which is
+// stored in the task itself. Larger calls are stored in the datastore.
+var MaxInlinePayload = 90 * 1024
+
+// namespaceHeader is the header which carries the namespace of the task.
+var namespaceHeader = http.CanonicalHeaderKey("X-AppEngine-Current-Namespace")
+
+// Encoding is the way the arguments of a deferred function are encoded.
+type Encoding int
+
+const (
+	// GobEncoding encodes arguments with encoding/gob.
+	GobEncoding Encoding = iota
+	// JSONEncoding encodes arguments with encoding/json.
+	JSONEncoding
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case GobEncoding:
+		return "gob"
+	case JSONEncoding:
+		return "json"
+	default:
+		return fmt.Sprintf("Encoding(%d)", int(e))
+	}
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+var registry = struct {
+	sync.RWMutex
+	funcs map[string]*Function
+}{funcs: map[string]*Function{}}
+
+// Function is a function which can be called through the task queue.
+type Function struct {
+	name     string
+	encoding Encoding
+	fv       reflect.Value
+	ft       reflect.Type
+}
+
+// Func registers fn under name, encoding its arguments with gob.
+//
+// See Register.
+func Func(name string, fn interface{}) *Function {
+	return Register(name, fn, GobEncoding)
+}
+
+// Register registers fn under name, encoding its arguments with enc.
+//
+// fn must be a non-variadic function whose first parameter is a
+// context.Context, whose other parameters are not interfaces, and which
+// returns either nothing or an error. A non-nil error causes the task to be
+// retried.
+//
+// The name identifies the function in the enqueued tasks, so it must be stable
+// across versions of the application which share a queue. Register panics if
+// fn is invalid or if name is already registered; it's meant to be called at
+// init time.
+func Register(name string, fn interface{}, enc Encoding) *Function {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	switch {
+	case ft.Kind() != reflect.Func:
+		panic(fmt.Errorf("deferred: %q is a %s, not a function", name, ft))
+	case ft.IsVariadic():
+		panic(fmt.Errorf("deferred: %q is variadic", name))
+	case ft.NumIn() == 0 || ft.In(0) != contextType:
+		panic(fmt.Errorf("deferred: the first parameter of %q must be a context.Context", name))
+	case ft.NumOut() > 1 || (ft.NumOut() == 1 && ft.Out(0) != errorType):
+		panic(fmt.Errorf("deferred: %q must return nothing or an error", name))
+	}
+	for i := 1; i < ft.NumIn(); i++ {
+		if ft.In(i).Kind() == reflect.Interface {
+			panic(fmt.Errorf("deferred: parameter %d of %q is an interface", i, name))
+		}
+	}
+	if enc != GobEncoding && enc != JSONEncoding {
+		panic(fmt.Errorf("deferred: unknown encoding %s for %q", enc, name))
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.funcs[name]; ok {
+		panic(fmt.Errorf("deferred: %q is already registered", name))
+	}
+	f := &Function{name: name, encoding: enc, fv: fv, ft: ft}
+	registry.funcs[name] = f
+	return f
+}
+
+func lookup(name string) *Function {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.funcs[name]
+}
+
+// Name returns the name the function was registered under.
+func (f *Function) Name() string { return f.name }
+
+// Call enqueues a call of f with args to the queue queueName.
+//
+// If c is transactional, the call is only enqueued if the transaction
+// commits, and a large payload is written as part of the transaction.
+func (f *Function) Call(c context.Context, queueName string, args ...interface{}) error {
+	t, err := f.Task(c, args...)
+	if err != nil {
+		return err
+	}
+	return tq.Add(c, queueName, t)
+}
+
+// Task returns the task which runs f with args, without enqueueing it. The
+// task can be customized (e.g. its Delay or Name) before it's added to a queue.
+//
+// If the payload is too large to fit in the task, it's written to the
+// datastore right away.
+func (f *Function) Task(c context.Context, args ...interface{}) (*tq.Task, error) {
+	inv, err := f.encode(args)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > MaxInlinePayload {
+		p := &payload{Data: data}
+		if err := ds.Put(c, p); err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(&invocation{Name: f.name, PayloadID: p.ID}); err != nil {
+			return nil, err
+		}
+	}
+
+	h := make(http.Header)
+	h.Set("Content-Type", "application/json")
+	if ns := info.GetNamespace(c); ns != "" {
+		h.Set(namespaceHeader, ns)
+	}
+	return &tq.Task{
+		Path:    Path,
+		Payload: data,
+		Header:  h,
+		Method:  "POST",
+	}, nil
+}
+
+// invocation is the payload of a deferred task.
+type invocation struct {
+	Name     string   `json:"name"`
+	Encoding Encoding `json:"enc,omitempty"`
+	Args     [][]byte `json:"args,omitempty"`
+
+	// PayloadID, if not zero, is the ID of the payload entity which holds the
+	// actual invocation.
+	PayloadID int64 `json:"payload,omitempty"`
+}
+
+// payload holds an invocation which is too large to fit in a task.
+type payload struct {
+	_kind string `gae:"$kind,DeferredPayload"`
+	ID    int64  `gae:"$id"`
+
+	Data []byte `gae:",noindex"`
+}
+
+func (f *Function) encode(args []interface{}) (*invocation, error) {
+	if len(args) != f.ft.NumIn()-1 {
+		return nil, fmt.Errorf("deferred: %q takes %d arguments, got %d", f.name, f.ft.NumIn()-1, len(args))
+	}
+
+	inv := &invocation{Name: f.name, Encoding: f.encoding, Args: make([][]byte, len(args))}
+	for i, arg := range args {
+		pt := f.ft.In(i + 1)
+
+		var v reflect.Value
+		if arg == nil {
+			switch pt.Kind() {
+			case reflect.Map, reflect.Ptr, reflect.Slice:
+				v = reflect.Zero(pt)
+			default:
+				return nil, fmt.Errorf("deferred: argument %d of %q can't be nil", i, f.name)
+			}
+		} else {
+			v = reflect.ValueOf(arg)
+			if !v.Type().AssignableTo(pt) {
+				return nil, fmt.Errorf("deferred: argument %d of %q is a %s, not a %s", i, f.name, v.Type(), pt)
+			}
+		}
+
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			// gob can't encode nil pointers. An empty argument decodes to nil.
+			continue
+		}
+
+		var err error
+		if inv.Args[i], err = encodeValue(f.encoding, v); err != nil {
+			return nil, fmt.Errorf("deferred: failed to encode argument %d of %q: %s", i, f.name, err)
+		}
+	}
+	return inv, nil
+}
+
+func (f *Function) decode(inv *invocation) ([]reflect.Value, error) {
+	if len(inv.Args) != f.ft.NumIn()-1 {
+		return nil, fmt.Errorf("deferred: %q takes %d arguments, got %d", f.name, f.ft.NumIn()-1, len(inv.Args))
+	}
+
+	args := make([]reflect.Value, len(inv.Args))
+	for i, data := range inv.Args {
+		v := reflect.New(f.ft.In(i + 1))
+		if len(data) == 0 {
+			// A nil pointer (see encode).
+			args[i] = v.Elem()
+			continue
+		}
+		if err := decodeValue(inv.Encoding, data, v); err != nil {
+			return nil, fmt.Errorf("deferred: failed to decode argument %d of %q: %s", i, f.name, err)
+		}
+		args[i] = v.Elem()
+	}
+	return args, nil
+}
+
+func (f *Function) run(c context.Context, args []reflect.Value) error {
+	out := f.fv.Call(append([]reflect.Value{reflect.ValueOf(c)}, args...))
+	if len(out) == 1 && !out[0].IsNil() {
+		return out[0].Interface().(error)
+	}
+	return nil
+}
+
+func encodeValue(enc Encoding, v reflect.Value) ([]byte, error) {
+	switch enc {
+	case GobEncoding:
+		buf := bytes.Buffer{}
+		if err := gob.NewEncoder(&buf).EncodeValue(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case JSONEncoding:
+		return json.Marshal(v.Interface())
+
+	default:
+		return nil, fmt.Errorf("unknown encoding %s", enc)
+	}
+}
+
+// decodeValue decodes data into v, which must be a pointer.
+func decodeValue(enc Encoding, data []byte, v reflect.Value) error {
+	switch enc {
+	case GobEncoding:
+		return gob.NewDecoder(bytes.NewReader(data)).DecodeValue(v)
+
+	case JSONEncoding:
+		return json.Unmarshal(data, v.Interface())
+
+	default:
+		return fmt.Errorf("unknown encoding %s", enc)
+	}
+}
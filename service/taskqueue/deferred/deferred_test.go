@@ -0,0 +1,202 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package deferred
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/luci/gae/impl/memory"
+	ds "github.com/luci/gae/service/datastore"
+	"github.com/luci/gae/service/info"
+	tq "github.com/luci/gae/service/taskqueue"
+
+	"golang.org/x/net/context"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type greeting struct {
+	Who   string
+	Times int
+}
+
+type testRecorder struct {
+	calls []string
+}
+
+func (r *testRecorder) record(c context.Context, s string) {
+	r.calls = append(r.calls, info.GetNamespace(c)+":"+s)
+}
+
+var (
+	rec = &testRecorder{}
+
+	testGreet = Func("test-greet", func(c context.Context, g *greeting, suffix string) {
+		rec.record(c, strings.Repeat(g.Who, g.Times)+suffix)
+	})
+
+	testGreetJSON = Register("test-greet-json", func(c context.Context, g greeting) error {
+		rec.record(c, g.Who)
+		return nil
+	}, JSONEncoding)
+
+	testMaybeGreet = Func("test-maybe-greet", func(c context.Context, g *greeting) {
+		if g == nil {
+			rec.record(c, "nobody")
+		} else {
+			rec.record(c, g.Who)
+		}
+	})
+
+	testCountdown *Function
+
+	testFail = Func("test-fail", func(c context.Context) error {
+		return errors.New("test error")
+	})
+)
+
+func init() {
+	testCountdown = Func("test-countdown", func(c context.Context, n int) error {
+		rec.record(c, strings.Repeat("*", n))
+		if n > 0 {
+			return testCountdown.Call(c, "", n-1)
+		}
+		return nil
+	})
+}
+
+func TestDeferred(t *testing.T) {
+	Convey(`With a testing context`, t, func() {
+		c := memory.Use(context.Background())
+		rec.calls = nil
+
+		Convey(`Rejects invalid functions.`, func() {
+			So(func() { Func("bad", 1) }, ShouldPanic)
+			So(func() { Func("bad", func() {}) }, ShouldPanic)
+			So(func() { Func("bad", func(context.Context) int { return 0 }) }, ShouldPanic)
+			So(func() { Func("bad", func(context.Context, ...int) {}) }, ShouldPanic)
+			So(func() { Func("bad", func(context.Context, interface{}) {}) }, ShouldPanic)
+			So(func() { Func("test-greet", func(context.Context) {}) }, ShouldPanic)
+		})
+
+		Convey(`Rejects bad arguments.`, func() {
+			So(testGreet.Call(c, "", &greeting{}), ShouldErrLike, "takes 2 arguments, got 1")
+			So(testGreet.Call(c, "", greeting{}, ""), ShouldErrLike, "not a *deferred.greeting")
+			So(testGreetJSON.Call(c, "", nil), ShouldErrLike, "can't be nil")
+		})
+
+		Convey(`Can enqueue and run a call.`, func() {
+			So(testGreet.Call(c, "", &greeting{"hi", 2}, "!"), ShouldBeNil)
+			So(testGreetJSON.Call(c, "", greeting{Who: "json"}), ShouldBeNil)
+
+			tasks := tq.GetTestable(c).GetScheduledTasks()["default"]
+			So(tasks, ShouldHaveLength, 2)
+			for _, t := range tasks {
+				So(t.Path, ShouldEqual, Path)
+			}
+			So(rec.calls, ShouldBeNil)
+
+			So(RunPending(c), ShouldBeNil)
+			So(rec.calls, ShouldHaveLength, 2)
+			So(rec.calls, ShouldContain, ":hihi!")
+			So(rec.calls, ShouldContain, ":json")
+			So(tq.GetTestable(c).GetScheduledTasks()["default"], ShouldHaveLength, 0)
+		})
+
+		Convey(`Passes nil pointers.`, func() {
+			task, err := testMaybeGreet.Task(c, nil)
+			So(err, ShouldBeNil)
+			So(task, ShouldNotBeNil)
+
+			So(testMaybeGreet.Call(c, "", nil), ShouldBeNil)
+			So(testMaybeGreet.Call(c, "", (*greeting)(nil)), ShouldBeNil)
+			So(testMaybeGreet.Call(c, "", &greeting{Who: "someone"}), ShouldBeNil)
+			So(RunPending(c), ShouldBeNil)
+			So(rec.calls, ShouldHaveLength, 3)
+			So(rec.calls, ShouldContain, ":nobody")
+			So(rec.calls, ShouldContain, ":someone")
+		})
+
+		Convey(`Runs chains of calls.`, func() {
+			So(testCountdown.Call(c, "", 3), ShouldBeNil)
+			So(RunPending(c), ShouldBeNil)
+			So(rec.calls, ShouldResemble, []string{":***", ":**", ":*", ":"})
+		})
+
+		Convey(`Restores the namespace of the call.`, func() {
+			nc := info.MustNamespace(c, "other")
+			So(testCountdown.Call(nc, "", 1), ShouldBeNil)
+			So(RunPending(c), ShouldBeNil)
+			So(rec.calls, ShouldResemble, []string{"other:*", "other:"})
+		})
+
+		Convey(`Stores large payloads in the datastore.`, func() {
+			So(testGreet.Call(c, "", &greeting{strings.Repeat("x", MaxInlinePayload), 1}, ""), ShouldBeNil)
+
+			var tasks []*tq.Task
+			for _, t := range tq.GetTestable(c).GetScheduledTasks()["default"] {
+				tasks = append(tasks, t)
+			}
+			So(tasks, ShouldHaveLength, 1)
+			So(len(tasks[0].Payload), ShouldBeLessThan, 1024)
+
+			q := ds.NewQuery(PayloadKind)
+			ds.GetTestable(c).CatchupIndexes()
+			count, err := ds.Count(c, q)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+
+			So(RunTask(c, tasks[0]), ShouldBeNil)
+			So(rec.calls, ShouldHaveLength, 1)
+			So(len(rec.calls[0]), ShouldEqual, MaxInlinePayload+1)
+
+			ds.GetTestable(c).CatchupIndexes()
+			count, err = ds.Count(c, q)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+
+			Convey(`And drops the task once the payload is gone.`, func() {
+				err := RunTask(c, tasks[0])
+				So(IsPermanent(err), ShouldBeTrue)
+				So(err, ShouldErrLike, "missing payload")
+			})
+		})
+
+		Convey(`Serves deferred tasks over HTTP.`, func() {
+			h := Handler(func(*http.Request) context.Context { return c })
+			serve := func(t *tq.Task) int {
+				req, err := http.NewRequest("POST", Path, bytes.NewReader(t.Payload))
+				So(err, ShouldBeNil)
+				req.Header = t.Header
+				rw := httptest.NewRecorder()
+				h.ServeHTTP(rw, req)
+				return rw.Code
+			}
+
+			t, err := testGreet.Task(info.MustNamespace(c, "ns"), &greeting{"a", 3}, "")
+			So(err, ShouldBeNil)
+			So(serve(t), ShouldEqual, http.StatusOK)
+			So(rec.calls, ShouldResemble, []string{"ns:aaa"})
+
+			Convey(`Failing calls are retried.`, func() {
+				t, err := testFail.Task(c)
+				So(err, ShouldBeNil)
+				So(serve(t), ShouldEqual, http.StatusInternalServerError)
+			})
+
+			Convey(`Broken tasks are dropped.`, func() {
+				t.Payload = []byte(`{"name": "unknown"}`)
+				So(serve(t), ShouldEqual, http.StatusOK)
+				So(IsPermanent(RunTask(c, t)), ShouldBeTrue)
+			})
+		})
+	})
+}
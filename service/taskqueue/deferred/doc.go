@@ -0,0 +1,35 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package deferred runs Go functions asynchronously through the task queue,
+// in the spirit of the Python SDK's deferred library.
+//
+// Functions are registered under a name at init time, and calls to them are
+// enqueued as push tasks whose payload holds the encoded arguments:
+//
+//	var sendReport = deferred.Func("send-report", func(c context.Context, user string, n int) error {
+//		...
+//	})
+//
+//	func handler(c context.Context) error {
+//		return sendReport.Call(c, "", "someone@example.com", 10)
+//	}
+//
+// The tasks are executed by Handler, which must be installed at Path (or at
+// whatever path is used for the tasks' queue). The namespace that was active
+// when the call was enqueued is restored before the function runs.
+//
+// Arguments are encoded with encoding/gob by default, or with encoding/json for
+// functions registered with JSONEncoding. Each argument is decoded into the
+// type of the corresponding parameter, so parameters of interface types (other
+// than the leading context.Context) are not supported.
+//
+// Calls whose encoded payload is larger than MaxInlinePayload are stored in a
+// datastore entity of kind PayloadKind, which is deleted once the call
+// succeeds.
+//
+// With impl/memory, RunPending can be used to execute the deferred calls that
+// were scheduled (including any calls they enqueue in turn), so deferred chains
+// can be unit tested.
+package deferred
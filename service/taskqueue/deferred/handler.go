@@ -0,0 +1,218 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package deferred
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	ds "github.com/luci/gae/service/datastore"
+	"github.com/luci/gae/service/info"
+	tq "github.com/luci/gae/service/taskqueue"
+
+	"github.com/luci/luci-go/common/data/stringset"
+	"github.com/luci/luci-go/common/errors"
+	log "github.com/luci/luci-go/common/logging"
+
+	"golang.org/x/net/context"
+)
+
+// PermanentError wraps errors which will keep happening no matter how many
+// times the task is retried, e.g. because it names an unknown function or its
+// payload can't be decoded.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+
+// IsPermanent returns true if err is a PermanentError.
+func IsPermanent(err error) bool {
+	_, ok := err.(*PermanentError)
+	return ok
+}
+
+// Handler returns an http.Handler which executes deferred tasks.
+//
+// mkContext is called with each request to get the base context to run the
+// function in. The namespace of the task is applied on top of it.
+//
+// A task whose function returns an error is answered with a 500 status, so
+// that it's retried. A task failing with a PermanentError is logged and
+// answered with a 200 status, so that it's dropped.
+func Handler(mkContext func(r *http.Request) context.Context) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c := mkContext(r)
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = run(c, r.Header, body)
+		}
+
+		switch {
+		case err == nil:
+			rw.WriteHeader(http.StatusOK)
+
+		case IsPermanent(err):
+			(log.Fields{log.ErrorKey: err}).Errorf(c, "deferred: dropping task")
+			rw.WriteHeader(http.StatusOK)
+
+		default:
+			(log.Fields{log.ErrorKey: err}).Warningf(c, "deferred: task failed")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// RunTask executes the deferred call held by task in c, the same way that
+// Handler would.
+func RunTask(c context.Context, task *tq.Task) error {
+	return run(c, task.Header, task.Payload)
+}
+
+func run(c context.Context, h http.Header, body []byte) error {
+	if ns := h.Get(namespaceHeader); ns != "" {
+		var err error
+		if c, err = info.Namespace(c, ns); err != nil {
+			return &PermanentError{err}
+		}
+	}
+
+	inv := &invocation{}
+	if err := json.Unmarshal(body, inv); err != nil {
+		return &PermanentError{fmt.Errorf("deferred: failed to decode the task: %s", err)}
+	}
+
+	var p *payload
+	if inv.PayloadID != 0 {
+		p = &payload{ID: inv.PayloadID}
+		switch err := ds.Get(c, p); err {
+		case nil:
+		case ds.ErrNoSuchEntity:
+			// The call already succeeded, or the entity was deleted.
+			return &PermanentError{fmt.Errorf("deferred: missing payload %d of %q", inv.PayloadID, inv.Name)}
+		default:
+			return err
+		}
+
+		inv = &invocation{}
+		if err := json.Unmarshal(p.Data, inv); err != nil {
+			return &PermanentError{fmt.Errorf("deferred: failed to decode payload %d: %s", p.ID, err)}
+		}
+	}
+
+	f := lookup(inv.Name)
+	if f == nil {
+		return &PermanentError{fmt.Errorf("deferred: unknown function %q", inv.Name)}
+	}
+	args, err := f.decode(inv)
+	if err != nil {
+		return &PermanentError{err}
+	}
+
+	if err := f.run(c, args); err != nil {
+		return err
+	}
+
+	if p != nil {
+		// The call succeeded; if the payload can't be deleted, it's just garbage.
+		if err := ds.Delete(c, p); err != nil {
+			(log.Fields{log.ErrorKey: err}).Warningf(c, "deferred: failed to delete payload %d", p.ID)
+		}
+	}
+	return nil
+}
+
+// RunPending runs the deferred tasks (the tasks whose path is Path) scheduled
+// in the testing task queue of c (see taskqueue.Testable), including the ones
+// which they enqueue in turn, until none are left. Each task is removed from
+// its queue before it runs.
+//
+// Tasks in the namespace of c are run, as well as tasks in the namespaces of
+// the tasks which were run. Tasks run in the order of their ETA, regardless of
+// the current time. Tasks which fail are not retried; their errors are
+// returned as an errors.MultiError.
+//
+// This is intended for tests, e.g. with impl/memory.
+func RunPending(c context.Context) error {
+	namespaces := stringset.NewFromSlice(info.GetNamespace(c))
+
+	var lme errors.MultiError
+	for {
+		pending, err := pendingTasks(c, namespaces)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		for _, pt := range pending {
+			ns := pt.task.Header.Get(namespaceHeader)
+			namespaces.Add(ns)
+			if err := tq.Delete(info.MustNamespace(c, ns), pt.queueName, pt.task); err != nil {
+				return err
+			}
+			if err := RunTask(c, pt.task); err != nil {
+				lme = append(lme, err)
+			}
+		}
+	}
+
+	if len(lme) > 0 {
+		return lme
+	}
+	return nil
+}
+
+type pendingTask struct {
+	queueName string
+	task      *tq.Task
+}
+
+// pendingTasks returns the deferred tasks scheduled in namespaces, sorted by
+// ETA.
+func pendingTasks(c context.Context, namespaces stringset.Set) ([]pendingTask, error) {
+	var ret []pendingTask
+	for _, ns := range namespaces.ToSlice() {
+		nc, err := info.Namespace(c, ns)
+		if err != nil {
+			return nil, err
+		}
+		tqt := tq.GetTestable(nc)
+		if tqt == nil {
+			return nil, errors.New("deferred: the task queue is not testable")
+		}
+		for queueName, tasks := range tqt.GetScheduledTasks() {
+			for _, t := range tasks {
+				if t.Path == Path {
+					ret = append(ret, pendingTask{queueName, t})
+				}
+			}
+		}
+	}
+
+	sort.Sort(pendingTasksByETA(ret))
+	return ret, nil
+}
+
+type pendingTasksByETA []pendingTask
+
+func (s pendingTasksByETA) Len() int      { return len(s) }
+func (s pendingTasksByETA) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s pendingTasksByETA) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	switch {
+	case !a.task.ETA.Equal(b.task.ETA):
+		return a.task.ETA.Before(b.task.ETA)
+	case a.queueName != b.queueName:
+		return a.queueName < b.queueName
+	default:
+		return a.task.Name < b.task.Name
+	}
+}
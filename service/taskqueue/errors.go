@@ -5,9 +5,16 @@
 package taskqueue
 
 import (
+	"errors"
+
 	"google.golang.org/appengine/taskqueue"
 )
 
 // ErrTaskAlreadyAdded is the error returned when a named task is added to a
 // task queue more than once.
 var ErrTaskAlreadyAdded = taskqueue.ErrTaskAlreadyAdded
+
+// ErrTaskLeaseExpired is the error returned by ModifyLease when the caller no
+// longer owns the lease on the task, either because the lease timed out or
+// because the task was leased by someone else in the meantime.
+var ErrTaskLeaseExpired = errors.New("TASK_LEASE_EXPIRED")
@@ -7,6 +7,7 @@ package taskqueue
 import (
 	"time"
 
+	"github.com/luci/luci-go/common/clock"
 	"github.com/luci/luci-go/common/errors"
 
 	"golang.org/x/net/context"
@@ -62,28 +63,13 @@ func Delete(c context.Context, queueName string, tasks ...*Task) error {
 	return err
 }
 
-// NOTE(riannucci): Pull task queues API can be extended to support automatic
-// lease management.
-//
-// The theory is that a good lease API might look like:
-//
-//   func Lease(queueName, tag string, batchSize int, duration time.Time, cb func(*Task, error<-))
-//
-// Which blocks and calls cb for each task obtained. Lease would then do all
-// necessary backoff negotiation with the backend. The callback could execute
-// synchronously (stuffing an error into the chan or panicing if it fails), or
-// asynchronously (dispatching a goroutine which will then populate the error
-// channel if needed). If it operates asynchronously, it has the option of
-// processing multiple work items at a time.
-//
-// Lease would also take care of calling ModifyLease as necessary to ensure
-// that each call to cb would have 'duration' amount of time to work on the
-// task, as well as releasing as many leased tasks as it can on a failure.
-
 // Lease leases tasks from a queue.
 //
 // leaseTime has seconds precision. The number of tasks fetched will be at most
 // maxTasks.
+//
+// See Leaser for a helper which manages the leases of the fetched tasks
+// automatically.
 func Lease(c context.Context, maxTasks int, queueName string, leaseTime time.Duration) ([]*Task, error) {
 	return Raw(c).Lease(maxTasks, queueName, leaseTime)
 }
@@ -140,6 +126,42 @@ func Stats(c context.Context, queueNames ...string) ([]Statistics, error) {
 	return ret, err
 }
 
+// LeaseOldestTag leases tasks grouped by tag from whichever of the named pull
+// queues has the oldest pending task, using the tag of that task.
+//
+// It returns the name of the queue the tasks were leased from. If none of the
+// queues has a task ready to be leased, it returns an empty queue name and no
+// tasks.
+//
+// The queue is selected using Stats, so this works with every implementation,
+// though it is only as accurate as the underlying Statistics are.
+func LeaseOldestTag(c context.Context, maxTasks int, leaseTime time.Duration, queueNames ...string) (string, []*Task, error) {
+	stats, err := Stats(c, queueNames...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := clock.Now(c)
+	best := -1
+	for i, s := range stats {
+		if s.Tasks == 0 || s.OldestETA.IsZero() || s.OldestETA.After(now) {
+			continue
+		}
+		if best < 0 || s.OldestETA.Before(stats[best].OldestETA) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", nil, nil
+	}
+
+	tasks, err := LeaseByTag(c, maxTasks, queueNames[best], leaseTime, "")
+	if err != nil {
+		return "", nil, err
+	}
+	return queueNames[best], tasks, nil
+}
+
 // GetTestable returns a Testable for the current task queue service in c, or
 // nil if it does not offer one.
 func GetTestable(c context.Context) Testable {
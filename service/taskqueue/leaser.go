@@ -0,0 +1,320 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package taskqueue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/luci/luci-go/common/clock"
+	"github.com/luci/luci-go/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultLeaseTime is the lease duration used by Leaser if its LeaseTime is
+	// not set.
+	DefaultLeaseTime = time.Minute
+
+	// DefaultLeaseBatchSize is the number of tasks leased at once by Leaser if
+	// its BatchSize is not set.
+	DefaultLeaseBatchSize = 100
+
+	// DefaultDeleteBatchSize is the number of completed tasks deleted at once by
+	// Leaser if its DeleteBatchSize is not set.
+	DefaultDeleteBatchSize = 100
+)
+
+// LeaseHandler processes a single leased task.
+//
+// The supplied context is canceled if the lease on the task is lost while the
+// handler is running. In that case the handler's return value is ignored and
+// the task is left in the queue.
+type LeaseHandler func(c context.Context, task *Task) error
+
+// Leaser is an augmentation to the top-level pull queue API that manages task
+// leases on behalf of the caller.
+//
+// Leaser leases a batch of tasks, runs a LeaseHandler for each of them, and
+// keeps extending the leases in the background while the batch is being
+// processed. Tasks whose handler succeeds are deleted from the queue in
+// batches. Tasks whose handler fails have their lease released, so they can be
+// picked up again right away.
+type Leaser struct {
+	// QueueName is the name of the pull queue to lease tasks from.
+	QueueName string
+
+	// ByTag, if true, leases tasks grouped by tag (see LeaseByTag). If Tag is
+	// empty, the tag of the task with the earliest ETA is used.
+	ByTag bool
+	// Tag is the tag to lease. It is only used if ByTag is true.
+	Tag string
+
+	// BatchSize is the maximum number of tasks to lease at once. If it's <= 0,
+	// DefaultLeaseBatchSize will be used.
+	BatchSize int
+
+	// LeaseTime is the duration of each lease, and of each lease extension. It
+	// has seconds precision. If it's <= 0, DefaultLeaseTime will be used.
+	LeaseTime time.Duration
+
+	// ExtendInterval is how often the leases of the tasks that are still being
+	// processed, or which were completed but not deleted yet, are extended. If
+	// it's <= 0, half of LeaseTime will be used.
+	ExtendInterval time.Duration
+
+	// DeleteBatchSize is the maximum number of completed tasks to delete at
+	// once. If it's <= 0, DefaultDeleteBatchSize will be used.
+	DeleteBatchSize int
+}
+
+// Process leases a single batch of tasks and runs h for each of them
+// sequentially.
+//
+// It returns the leased tasks, which is empty if there were no tasks ready to
+// be leased. If leasing itself fails, that error is returned directly.
+// Otherwise, any per-task failures are returned as an errors.MultiError whose
+// indexes correspond to the returned tasks. A task whose lease was lost gets
+// ErrTaskLeaseExpired.
+func (l *Leaser) Process(c context.Context, h LeaseHandler) ([]*Task, error) {
+	raw := Raw(c)
+
+	var (
+		tasks []*Task
+		err   error
+	)
+	if l.ByTag {
+		tasks, err = raw.LeaseByTag(l.batchSize(), l.QueueName, l.leaseTime(), l.Tag)
+	} else {
+		tasks, err = raw.Lease(l.batchSize(), l.QueueName, l.leaseTime())
+	}
+	if err != nil || len(tasks) == 0 {
+		return nil, err
+	}
+
+	lts := make([]*leasedTask, len(tasks))
+	for i, t := range tasks {
+		lts[i] = &leasedTask{task: t.Duplicate()}
+	}
+
+	// Arm the extension timer before any handler runs, so that the first
+	// extension is relative to the time the tasks were leased.
+	timer := clock.NewTimer(c)
+	timer.Reset(l.extendInterval())
+	stopC := make(chan struct{})
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		defer timer.Stop()
+		l.extendLoop(c, raw, timer, stopC, lts)
+	}()
+
+	lme := errors.NewLazyMultiError(len(tasks))
+	// The completed tasks keep having their lease extended until they're
+	// deleted, so that nobody else leases them in the meantime.
+	var toDelete []*leasedTask
+	var toDeleteIdx []int
+	flush := func() {
+		if len(toDelete) == 0 {
+			return
+		}
+		batch := make([]*Task, 0, len(toDelete))
+		batchIdx := make([]int, 0, len(toDelete))
+		for j, lt := range toDelete {
+			if t, lost := lt.release(); lost {
+				lme.Assign(toDeleteIdx[j], ErrTaskLeaseExpired)
+			} else {
+				batch = append(batch, t)
+				batchIdx = append(batchIdx, toDeleteIdx[j])
+			}
+		}
+		toDelete, toDeleteIdx = nil, nil
+		if len(batch) == 0 {
+			return
+		}
+
+		i := 0
+		err := raw.DeleteMulti(batch, l.QueueName, func(err error) {
+			lme.Assign(batchIdx[i], err)
+			i++
+		})
+		if err != nil {
+			for _, idx := range batchIdx {
+				lme.Assign(idx, err)
+			}
+		}
+	}
+
+	for i, lt := range lts {
+		tc, cancel := context.WithCancel(c)
+		lt.start(cancel)
+		herr := h(tc, tasks[i])
+		lost := lt.finish()
+		cancel()
+
+		switch {
+		case lost:
+			lme.Assign(i, ErrTaskLeaseExpired)
+			lt.release()
+
+		case herr != nil:
+			lme.Assign(i, herr)
+			// Release the lease so that someone else can retry the task right away.
+			// This is best effort: if it fails, the lease will just time out.
+			t, _ := lt.release()
+			raw.ModifyLease(t, l.QueueName, 0)
+
+		default:
+			toDelete = append(toDelete, lt)
+			toDeleteIdx = append(toDeleteIdx, i)
+			if len(toDelete) >= l.deleteBatchSize() {
+				flush()
+			}
+		}
+	}
+
+	close(stopC)
+	<-doneC
+	flush()
+
+	return tasks, lme.Get()
+}
+
+func (l *Leaser) extendLoop(c context.Context, raw RawInterface, timer clock.Timer, stopC <-chan struct{}, lts []*leasedTask) {
+	for {
+		select {
+		case <-stopC:
+			return
+		case tr := <-timer.GetC():
+			if tr.Err != nil {
+				return
+			}
+		}
+
+		for _, lt := range lts {
+			t, ok := lt.snapshot()
+			if !ok {
+				continue
+			}
+			err := raw.ModifyLease(t, l.QueueName, l.leaseTime())
+			if err == nil {
+				lt.extended(t.ETA)
+				continue
+			}
+			// Transient errors are tolerated for as long as the current lease is
+			// still valid; after that someone else may have leased the task.
+			if err == ErrTaskLeaseExpired || !clock.Now(c).Before(t.ETA) {
+				lt.lose()
+			}
+		}
+		timer.Reset(l.extendInterval())
+	}
+}
+
+func (l *Leaser) batchSize() int {
+	if l.BatchSize > 0 {
+		return l.BatchSize
+	}
+	return DefaultLeaseBatchSize
+}
+
+func (l *Leaser) leaseTime() time.Duration {
+	if l.LeaseTime > 0 {
+		return l.LeaseTime
+	}
+	return DefaultLeaseTime
+}
+
+func (l *Leaser) extendInterval() time.Duration {
+	if l.ExtendInterval > 0 {
+		return l.ExtendInterval
+	}
+	return l.leaseTime() / 2
+}
+
+func (l *Leaser) deleteBatchSize() int {
+	if l.DeleteBatchSize > 0 {
+		return l.DeleteBatchSize
+	}
+	return DefaultDeleteBatchSize
+}
+
+// leasedTask tracks the lease of a single task owned by a Leaser.
+//
+// The task's ETA is the lease "cookie" which must be round-tripped to
+// ModifyLease, so it is only accessed under the lock.
+type leasedTask struct {
+	sync.Mutex
+
+	task *Task
+	// done is true once the task's lease isn't needed anymore, i.e. once it is
+	// released or deleted.
+	done   bool
+	lost   bool
+	cancel context.CancelFunc
+}
+
+func (lt *leasedTask) start(cancel context.CancelFunc) {
+	lt.Lock()
+	defer lt.Unlock()
+
+	lt.cancel = cancel
+	if lt.lost {
+		cancel()
+	}
+}
+
+// finish records that the handler of the task returned, and returns whether
+// the lease was lost. The lease keeps being extended until release.
+func (lt *leasedTask) finish() bool {
+	lt.Lock()
+	defer lt.Unlock()
+
+	lt.cancel = nil
+	return lt.lost
+}
+
+// release marks the task as done, returning a copy of it carrying the current
+// lease ETA, and whether the lease was lost.
+func (lt *leasedTask) release() (*Task, bool) {
+	lt.Lock()
+	defer lt.Unlock()
+
+	lt.done = true
+	return lt.task.Duplicate(), lt.lost
+}
+
+// snapshot returns a copy of the task suitable for ModifyLease, or false if
+// the task no longer needs its lease extended.
+func (lt *leasedTask) snapshot() (*Task, bool) {
+	lt.Lock()
+	defer lt.Unlock()
+
+	if lt.done || lt.lost {
+		return nil, false
+	}
+	return lt.task.Duplicate(), true
+}
+
+func (lt *leasedTask) extended(eta time.Time) {
+	lt.Lock()
+	defer lt.Unlock()
+
+	lt.task.ETA = eta
+}
+
+func (lt *leasedTask) lose() {
+	lt.Lock()
+	defer lt.Unlock()
+
+	if lt.done {
+		return
+	}
+	lt.lost = true
+	if lt.cancel != nil {
+		lt.cancel()
+	}
+}
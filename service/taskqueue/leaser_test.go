@@ -0,0 +1,191 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package taskqueue
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luci/luci-go/common/clock"
+	"github.com/luci/luci-go/common/clock/testclock"
+	lerrors "github.com/luci/luci-go/common/errors"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeLeaseQueue struct {
+	RawInterface
+	sync.Mutex
+
+	c        context.Context
+	pending  []*Task
+	lost     map[string]bool
+	modified chan string
+
+	deleteCalls int
+	deleted     []string
+	released    []string
+}
+
+func (f *fakeLeaseQueue) Lease(maxTasks int, queueName string, leaseTime time.Duration) ([]*Task, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if maxTasks > len(f.pending) {
+		maxTasks = len(f.pending)
+	}
+	ret := make([]*Task, maxTasks)
+	for i, t := range f.pending[:maxTasks] {
+		t.ETA = clock.Now(f.c).Add(leaseTime)
+		ret[i] = t.Duplicate()
+	}
+	f.pending = f.pending[maxTasks:]
+	return ret, nil
+}
+
+func (f *fakeLeaseQueue) ModifyLease(task *Task, queueName string, leaseTime time.Duration) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.lost[task.Name] {
+		return ErrTaskLeaseExpired
+	}
+	if leaseTime == 0 {
+		f.released = append(f.released, task.Name)
+		return nil
+	}
+	task.ETA = clock.Now(f.c).Add(leaseTime)
+	f.modified <- task.Name
+	return nil
+}
+
+func (f *fakeLeaseQueue) DeleteMulti(tasks []*Task, queueName string, cb RawCB) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.deleteCalls++
+	for _, t := range tasks {
+		f.deleted = append(f.deleted, t.Name)
+		cb(nil)
+	}
+	return nil
+}
+
+func TestLeaser(t *testing.T) {
+	t.Parallel()
+
+	Convey("A Leaser on a testing pull queue", t, func() {
+		now := time.Date(2000, time.January, 1, 1, 1, 1, 1, time.UTC)
+		c, tc := testclock.UseTime(context.Background(), now)
+
+		fq := &fakeLeaseQueue{
+			c:        c,
+			lost:     map[string]bool{},
+			modified: make(chan string, 10),
+		}
+		for _, n := range []string{"a", "b", "c"} {
+			fq.pending = append(fq.pending, &Task{Name: n, Method: "PULL"})
+		}
+		c = SetRaw(c, fq)
+
+		l := Leaser{QueueName: "pull", LeaseTime: time.Minute}
+
+		Convey(`Returns nothing for an empty queue.`, func() {
+			fq.pending = nil
+			tasks, err := l.Process(c, func(context.Context, *Task) error {
+				panic("should not be called")
+			})
+			So(err, ShouldBeNil)
+			So(tasks, ShouldBeNil)
+		})
+
+		Convey(`Deletes completed tasks in batches.`, func() {
+			l.DeleteBatchSize = 2
+
+			var seen []string
+			tasks, err := l.Process(c, func(c context.Context, t *Task) error {
+				seen = append(seen, t.Name)
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(len(tasks), ShouldEqual, 3)
+			So(seen, ShouldResemble, []string{"a", "b", "c"})
+			So(fq.deleted, ShouldResemble, []string{"a", "b", "c"})
+			So(fq.deleteCalls, ShouldEqual, 2)
+		})
+
+		Convey(`Releases the lease of failed tasks.`, func() {
+			testErr := errors.New("test error")
+			tasks, err := l.Process(c, func(c context.Context, t *Task) error {
+				if t.Name == "b" {
+					return testErr
+				}
+				return nil
+			})
+			So(len(tasks), ShouldEqual, 3)
+			So(err, ShouldResemble, lerrors.MultiError{nil, testErr, nil})
+			So(fq.deleted, ShouldResemble, []string{"a", "c"})
+			So(fq.released, ShouldResemble, []string{"b"})
+		})
+
+		Convey(`Extends leases while handlers run.`, func() {
+			l.BatchSize = 1
+			_, err := l.Process(c, func(c context.Context, t *Task) error {
+				tc.Add(40 * time.Second)
+				So(<-fq.modified, ShouldEqual, "a")
+				return c.Err()
+			})
+			So(err, ShouldBeNil)
+			So(fq.deleted, ShouldResemble, []string{"a"})
+		})
+
+		Convey(`Extends the leases of completed tasks until they're deleted.`, func() {
+			_, err := l.Process(c, func(c context.Context, t *Task) error {
+				if t.Name == "b" {
+					tc.Add(40 * time.Second)
+					modified := []string{<-fq.modified, <-fq.modified, <-fq.modified}
+					So(modified, ShouldResemble, []string{"a", "b", "c"})
+				}
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(fq.deleted, ShouldResemble, []string{"a", "b", "c"})
+			So(fq.deleteCalls, ShouldEqual, 1)
+
+			Convey(`Unless their lease is lost.`, func() {
+				fq.deleted = nil
+				fq.pending = []*Task{{Name: "a", Method: "PULL"}, {Name: "b", Method: "PULL"}}
+				_, err := l.Process(c, func(c context.Context, t *Task) error {
+					if t.Name == "b" {
+						fq.Lock()
+						fq.lost["a"] = true
+						fq.Unlock()
+						tc.Add(40 * time.Second)
+						So(<-fq.modified, ShouldEqual, "b")
+					}
+					return nil
+				})
+				So(err, ShouldResemble, lerrors.MultiError{ErrTaskLeaseExpired, nil})
+				So(fq.deleted, ShouldResemble, []string{"b"})
+			})
+		})
+
+		Convey(`Cancels the handler when the lease is lost.`, func() {
+			l.BatchSize = 1
+			fq.lost["a"] = true
+			_, err := l.Process(c, func(c context.Context, t *Task) error {
+				tc.Add(40 * time.Second)
+				<-c.Done()
+				return nil
+			})
+			So(err, ShouldResemble, lerrors.MultiError{ErrTaskLeaseExpired})
+			So(fq.deleted, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,289 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package taskqueue
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TaskMatcher selects tasks in a testing task queue. Every field which is set
+// must match for a task to be selected; the zero TaskMatcher selects all
+// tasks.
+type TaskMatcher struct {
+	// Queues, if not empty, is the list of queues to select tasks from. The
+	// empty queue name is the "default" queue.
+	Queues []string
+
+	// DueBy, if not zero, selects the tasks whose ETA is not after it.
+	DueBy time.Time
+
+	// Method, if not empty, is the HTTP method of the tasks (or "PULL").
+	Method string
+
+	// Path, if not empty, is the path of the tasks, without their query string.
+	Path string
+	// PathPrefix, if not empty, is a prefix of the path of the tasks.
+	PathPrefix string
+
+	// Tags, if not empty, selects the tasks which have one of these tags. The
+	// empty tag selects untagged tasks.
+	Tags []string
+
+	// Header selects the tasks which have all of these header values.
+	Header http.Header
+
+	// Params selects the tasks which have all of these parameter values. The
+	// parameters of a task are the ones in the query string of its path, and
+	// the ones in its payload if it's form-encoded (see NewPOSTTask).
+	Params url.Values
+
+	// Predicate, if not nil, is called for the tasks which match all other
+	// fields.
+	Predicate func(queueName string, t *Task) bool
+}
+
+// Match returns true if the task t in queue queueName matches m.
+func (m *TaskMatcher) Match(queueName string, t *Task) bool {
+	if queueName == "" {
+		queueName = "default"
+	}
+
+	if len(m.Queues) > 0 && !containsString(m.Queues, queueName, "default") {
+		return false
+	}
+	if !m.DueBy.IsZero() && t.ETA.After(m.DueBy) {
+		return false
+	}
+	if m.Method != "" && m.Method != t.Method {
+		return false
+	}
+
+	path := t.Path
+	if idx := strings.IndexRune(path, '?'); idx >= 0 {
+		path = path[:idx]
+	}
+	if m.Path != "" && m.Path != path {
+		return false
+	}
+	if m.PathPrefix != "" && !strings.HasPrefix(path, m.PathPrefix) {
+		return false
+	}
+
+	if len(m.Tags) > 0 && !containsString(m.Tags, t.Tag, "") {
+		return false
+	}
+	for k, vs := range m.Header {
+		if !containsAll(t.Header[http.CanonicalHeaderKey(k)], vs) {
+			return false
+		}
+	}
+	if len(m.Params) > 0 {
+		params := taskParams(t)
+		for k, vs := range m.Params {
+			if !containsAll(params[k], vs) {
+				return false
+			}
+		}
+	}
+
+	return m.Predicate == nil || m.Predicate(queueName, t)
+}
+
+// taskParams returns the parameters in the query string of the task's path and
+// in its form-encoded payload.
+func taskParams(t *Task) url.Values {
+	ret := url.Values{}
+	add := func(s string) {
+		vs, err := url.ParseQuery(s)
+		if err != nil {
+			return
+		}
+		for k, v := range vs {
+			ret[k] = append(ret[k], v...)
+		}
+	}
+
+	if idx := strings.IndexRune(t.Path, '?'); idx >= 0 {
+		add(t.Path[idx+1:])
+	}
+	switch t.Header.Get("Content-Type") {
+	case "application/x-www-form-urlencoded", "":
+		add(string(t.Payload))
+	}
+	return ret
+}
+
+func containsString(set []string, s, empty string) bool {
+	for _, v := range set {
+		if v == "" {
+			v = empty
+		}
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAll(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchedTask is a task selected by a TaskMatcher.
+type MatchedTask struct {
+	QueueName string
+	*Task
+}
+
+// String returns a description of the task. See DescribeTask.
+func (t MatchedTask) String() string {
+	return DescribeTask(t.QueueName, t.Task)
+}
+
+// MatchedTasks is a list of tasks selected by a TaskMatcher, sorted by ETA,
+// then by queue and name.
+type MatchedTasks []MatchedTask
+
+// Tasks returns the selected tasks.
+func (ms MatchedTasks) Tasks() []*Task {
+	ret := make([]*Task, len(ms))
+	for i, m := range ms {
+		ret[i] = m.Task
+	}
+	return ret
+}
+
+// Paths returns the path of each selected task.
+func (ms MatchedTasks) Paths() []string {
+	ret := make([]string, len(ms))
+	for i, m := range ms {
+		ret[i] = m.Path
+	}
+	return ret
+}
+
+// Describe returns the description of each selected task. See DescribeTask.
+func (ms MatchedTasks) Describe() []string {
+	ret := make([]string, len(ms))
+	for i, m := range ms {
+		ret[i] = m.String()
+	}
+	return ret
+}
+
+func (ms MatchedTasks) Len() int      { return len(ms) }
+func (ms MatchedTasks) Swap(i, j int) { ms[i], ms[j] = ms[j], ms[i] }
+func (ms MatchedTasks) Less(i, j int) bool {
+	a, b := ms[i], ms[j]
+	switch {
+	case !a.ETA.Equal(b.ETA):
+		return a.ETA.Before(b.ETA)
+	case a.QueueName != b.QueueName:
+		return a.QueueName < b.QueueName
+	default:
+		return a.Name < b.Name
+	}
+}
+
+// Select returns the tasks in qd which match m.
+func (qd QueueData) Select(m *TaskMatcher) MatchedTasks {
+	var ret MatchedTasks
+	for queueName, tasks := range qd {
+		for _, t := range tasks {
+			if m.Match(queueName, t) {
+				ret = append(ret, MatchedTask{queueName, t})
+			}
+		}
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+// DescribeTask returns a single line describing the task t in queue
+// queueName, suitable for comparisons in tests.
+//
+// The description includes the queue, the method, the path, the ETA, the tag,
+// the headers and the payload of the task, but not its name (which is often
+// generated), nor its retry options.
+func DescribeTask(queueName string, t *Task) string {
+	if queueName == "" {
+		queueName = "default"
+	}
+	parts := []string{queueName, t.Method}
+	if t.Path != "" {
+		parts = append(parts, t.Path)
+	}
+	if !t.ETA.IsZero() {
+		parts = append(parts, "eta="+t.ETA.UTC().Format(time.RFC3339Nano))
+	}
+	if t.Tag != "" {
+		parts = append(parts, fmt.Sprintf("tag=%q", t.Tag))
+	}
+	if len(t.Header) > 0 {
+		keys := make([]string, 0, len(t.Header))
+		for k := range t.Header {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("%s=%q", k, t.Header[k]))
+		}
+	}
+	if len(t.Payload) > 0 {
+		parts = append(parts, fmt.Sprintf("payload=%q", t.Payload))
+	}
+	return strings.Join(parts, " ")
+}
+
+// DiffTasks compares the expected and the actual tasks by their description
+// (see DescribeTask), ignoring their order.
+//
+// It returns an empty string if they are the same. Otherwise, it returns one
+// line per difference: expected tasks which are missing are prefixed with "-",
+// and unexpected tasks are prefixed with "+".
+func DiffTasks(expected, actual MatchedTasks) string {
+	counts := map[string]int{}
+	for _, d := range expected.Describe() {
+		counts[d]++
+	}
+	for _, d := range actual.Describe() {
+		counts[d]--
+	}
+
+	descs := make([]string, 0, len(counts))
+	for d := range counts {
+		descs = append(descs, d)
+	}
+	sort.Strings(descs)
+
+	var lines []string
+	for _, d := range descs {
+		n := counts[d]
+		for ; n > 0; n-- {
+			lines = append(lines, "-"+d)
+		}
+		for ; n < 0; n++ {
+			lines = append(lines, "+"+d)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package taskqueue
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The headers which App Engine sets on push task requests.
+const (
+	QueueNameHeader            = "X-AppEngine-QueueName"
+	TaskNameHeader             = "X-AppEngine-TaskName"
+	TaskRetryCountHeader       = "X-AppEngine-TaskRetryCount"
+	TaskExecutionCountHeader   = "X-AppEngine-TaskExecutionCount"
+	TaskETAHeader              = "X-AppEngine-TaskETA"
+	TaskPreviousResponseHeader = "X-AppEngine-TaskPreviousResponse"
+	TaskRetryReasonHeader      = "X-AppEngine-TaskRetryReason"
+	FailFastHeader             = "X-AppEngine-FailFast"
+)
+
+// RequestHeaders describes the push task being executed by a request, from
+// the X-AppEngine-* headers of the request.
+type RequestHeaders struct {
+	QueueName string
+	TaskName  string
+
+	// TaskRetryCount is the number of times the task was retried. It doesn't
+	// count the attempts which failed because no instance was available.
+	TaskRetryCount int64
+	// TaskExecutionCount is the number of times the task was executed and
+	// failed.
+	TaskExecutionCount int64
+	// TaskETA is the time at which the task was scheduled to run.
+	TaskETA time.Time
+
+	// TaskPreviousResponse is the HTTP status of the previous attempt, or 0.
+	TaskPreviousResponse int
+	// TaskRetryReason is the reason of the retry, if this is one.
+	TaskRetryReason string
+
+	// FailFast is true if the task should fail immediately, instead of waiting
+	// for an instance, if none are available.
+	FailFast bool
+}
+
+// ParseRequestHeaders returns the RequestHeaders of a request, or nil if h
+// doesn't have an X-AppEngine-QueueName header (i.e. the request isn't a push
+// task).
+func ParseRequestHeaders(h http.Header) (*RequestHeaders, error) {
+	queueName := h.Get(QueueNameHeader)
+	if queueName == "" {
+		return nil, nil
+	}
+
+	ret := &RequestHeaders{
+		QueueName:       queueName,
+		TaskName:        h.Get(TaskNameHeader),
+		TaskRetryReason: h.Get(TaskRetryReasonHeader),
+		FailFast:        h.Get(FailFastHeader) != "",
+	}
+
+	parseInt := func(header string, bits int) (int64, error) {
+		v := h.Get(header)
+		if v == "" {
+			return 0, nil
+		}
+		i, err := strconv.ParseInt(v, 10, bits)
+		if err != nil {
+			return 0, fmt.Errorf("taskqueue: invalid %s header (%q): %s", header, v, err)
+		}
+		return i, nil
+	}
+
+	var err error
+	if ret.TaskRetryCount, err = parseInt(TaskRetryCountHeader, 64); err != nil {
+		return nil, err
+	}
+	if ret.TaskExecutionCount, err = parseInt(TaskExecutionCountHeader, 64); err != nil {
+		return nil, err
+	}
+	prev, err := parseInt(TaskPreviousResponseHeader, 32)
+	if err != nil {
+		return nil, err
+	}
+	ret.TaskPreviousResponse = int(prev)
+
+	// The ETA is in seconds since the epoch, with microseconds.
+	if v := h.Get(TaskETAHeader); v != "" {
+		eta, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("taskqueue: invalid %s header (%q): %s", TaskETAHeader, v, err)
+		}
+		usec := int64(eta*1e6 + 0.5)
+		ret.TaskETA = time.Unix(usec/1e6, (usec%1e6)*int64(time.Microsecond)).UTC()
+	}
+	return ret, nil
+}
+
+// WithRequestHeaders returns a context for executing the push task described by
+// h. Implementations of the services install it in the contexts of task
+// requests.
+func WithRequestHeaders(c context.Context, h *RequestHeaders) context.Context {
+	return context.WithValue(c, requestHeadersKey, h)
+}
+
+// GetRequestHeaders returns the push task being executed by the request of c,
+// or nil if it isn't a push task request (or if the implementation doesn't
+// install them).
+func GetRequestHeaders(c context.Context) *RequestHeaders {
+	h, _ := c.Value(requestHeadersKey).(*RequestHeaders)
+	return h
+}
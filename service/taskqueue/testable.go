@@ -10,6 +10,11 @@ type QueueData map[string]map[string]*Task
 // AnonymousQueueData is {queueName: [*TQTask]}
 type AnonymousQueueData map[string][]*Task
 
+// TestingSnapshot is an opaque implementation-defined snapshot type.
+type TestingSnapshot interface {
+	ImATestingSnapshot()
+}
+
 // Testable is the testable interface for fake taskqueue implementations
 type Testable interface {
 	CreateQueue(queueName string)
@@ -18,4 +23,23 @@ type Testable interface {
 	GetTombstonedTasks() QueueData
 	GetTransactionTasks() AnonymousQueueData
 	ResetTasks()
+
+	// TagStats returns statistics for each tag with pending (i.e. not leased)
+	// tasks in the given pull queue, ordered by OldestETA (oldest first) and
+	// then by tag.
+	TagStats(queueName string) ([]TagStatistics, error)
+
+	// SelectTasks returns the scheduled tasks which match m, sorted by ETA.
+	SelectTasks(m *TaskMatcher) MatchedTasks
+
+	// TakeSnapshot returns a snapshot of the queues and of all their tasks
+	// (scheduled and tombstoned, in every namespace), which can be restored
+	// later with RestoreSnapshot.
+	//
+	// Tasks added in a pending transaction are not part of the snapshot.
+	TakeSnapshot() TestingSnapshot
+
+	// RestoreSnapshot replaces the queues and their tasks with the ones in the
+	// snapshot. The snapshot can be restored several times.
+	RestoreSnapshot(TestingSnapshot)
 }
@@ -26,3 +26,11 @@ type Statistics struct {
 	InFlight        int     // tasks executing now
 	EnforcedRate    float64 // requests per second
 }
+
+// TagStatistics represents statistics about the tasks sharing a single tag in
+// a pull queue.
+type TagStatistics struct {
+	Tag       string    // empty for untagged tasks
+	Tasks     int       // tasks which aren't leased
+	OldestETA time.Time // ETA of the oldest of these tasks
+}
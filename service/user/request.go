@@ -0,0 +1,46 @@
+// Copyright 2016 The LUCI Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package user
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The headers in which the App Engine frontend describes the signed-in user
+// of a request.
+const (
+	EmailHeader             = "X-AppEngine-User-Email"
+	IDHeader                = "X-AppEngine-User-Id"
+	IsAdminHeader           = "X-AppEngine-User-Is-Admin"
+	AuthDomainHeader        = "X-AppEngine-Auth-Domain"
+	FederatedIdentityHeader = "X-AppEngine-Federated-Identity"
+	FederatedProviderHeader = "X-AppEngine-Federated-Provider"
+)
+
+// FromRequestHeaders returns the signed-in user described by the X-AppEngine-*
+// headers of a request, or nil if there's no X-AppEngine-User-Email header.
+//
+// These headers can only be trusted if the App Engine frontend (or a local
+// development server) strips them from the incoming requests.
+func FromRequestHeaders(h http.Header) *User {
+	email := h.Get(EmailHeader)
+	if email == "" {
+		return nil
+	}
+
+	authDomain := h.Get(AuthDomainHeader)
+	if authDomain == "" {
+		authDomain = email[strings.LastIndex(email, "@")+1:]
+	}
+	return &User{
+		Email:             email,
+		AuthDomain:        authDomain,
+		Admin:             h.Get(IsAdminHeader) == "1",
+		ID:                h.Get(IDHeader),
+		FederatedIdentity: h.Get(FederatedIdentityHeader),
+		FederatedProvider: h.Get(FederatedProviderHeader),
+	}
+}
@@ -17,4 +17,19 @@ type Testable interface {
 
 	// Equivalent to SetUser(nil), but a bit more obvious to read in the code :).
 	Logout()
+
+	// LoginFederated is like Login, but the User will look like they logged in
+	// through the OpenID provider of the identity URL (see LoginURLFederated).
+	LoginFederated(email, identity string, admin bool)
+
+	// AddOAuthToken registers an OAuth token, which authenticates the User
+	// derived from email and admin (like Login) on behalf of the OAuth client
+	// clientID, for the given scopes.
+	AddOAuthToken(token, email, clientID string, admin bool, scopes ...string)
+
+	// SetOAuthToken sets the OAuth token presented by the current request, or no
+	// token if it's empty. CurrentOAuth then returns the User of this token, as
+	// long as it was registered with AddOAuthToken for one of the requested
+	// scopes.
+	SetOAuthToken(token string)
 }